@@ -16,9 +16,6 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>. */
 package main
 
 import (
-	"io/ioutil"
-	"log"
-	"os/exec"
 	"regexp"
 	"strconv"
 	"strings"
@@ -27,19 +24,7 @@ import (
 )
 
 func AccountsData() []byte {
-	cmd := exec.Command("squeue", "-a", "-r", "-h", "-o %A|%a|%T|%C")
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
-	}
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
-	}
-	out, _ := ioutil.ReadAll(stdout)
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
-	}
-	return out
+	return Execute("squeue", []string{"-a", "-r", "-h", "-o %A|%a|%T|%C"})
 }
 
 type JobMetrics struct {
@@ -89,10 +74,10 @@ type AccountsCollector struct {
 func NewAccountsCollector() *AccountsCollector {
 	labels := []string{"account"}
 	return &AccountsCollector{
-		pending:      prometheus.NewDesc("slurm_account_jobs_pending", "Pending jobs for account", labels, nil),
-		running:      prometheus.NewDesc("slurm_account_jobs_running", "Running jobs for account", labels, nil),
-		running_cpus: prometheus.NewDesc("slurm_account_cpus_running", "Running cpus for account", labels, nil),
-		suspended:    prometheus.NewDesc("slurm_account_jobs_suspended", "Suspended jobs for account", labels, nil),
+		pending:      NewDesc("slurm_account_jobs_pending", "Pending jobs for account", labels, nil),
+		running:      NewDesc("slurm_account_jobs_running", "Running jobs for account", labels, nil),
+		running_cpus: NewDesc("slurm_account_cpus_running", "Running cpus for account", labels, nil),
+		suspended:    NewDesc("slurm_account_jobs_suspended", "Suspended jobs for account", labels, nil),
 	}
 }
 
@@ -0,0 +1,193 @@
+/* Copyright 2020 Joeri Hermans, Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// An association of the accounting hierarchy: an account (user is empty)
+// or a user within an account, and its GrpTRES limits
+type Association struct {
+	account  string
+	user     string
+	parent   string
+	grp_tres map[string]float64
+}
+
+// Execute sacctmgr to get the GrpTRES limits of every association, the
+// parent of the accounts gives the hierarchy. The database is shared by
+// all the clusters, sacctmgr has no -M.
+func AssociationsData() []byte {
+	return Execute("sacctmgr", []string{"-n", "-P", "show", "assoc", "format=Cluster,Account,User,Partition,ParentName,GrpTRES"})
+}
+
+// Account and user of an association, the user is empty for an account
+type AssociationKey struct {
+	account string
+	user    string
+}
+
+// ParseAssociations takes the cluster|account|user|partition|parent|GrpTRES
+// lines of sacctmgr, e.g. hpc|physics|||root|gres/gpu=8 for an account and
+// hpc|physics|alice|||gres/gpu:a100=2 for a user of the account, and
+// returns the associations of the cluster (of all of them if empty).
+//
+// The associations by partition repeat the account and user: the one
+// without partition is kept, else the highest limits of the partitions,
+// whatever the order of the lines. So are the associations of several
+// clusters when the cluster is empty.
+func ParseAssociations(input []byte, cluster string, pe *ParseErrors) []Association {
+	associations := []Association{}
+	index := make(map[AssociationKey]int)
+	partitioned := make(map[AssociationKey]bool)
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) < 6 || fields[1] == "" || (cluster != "" && fields[0] != cluster) {
+			continue
+		}
+		a := Association{
+			account:  fields[1],
+			user:     fields[2],
+			parent:   fields[4],
+			grp_tres: ParseTRES(fields[5], pe),
+		}
+		key := AssociationKey{a.account, a.user}
+		i, seen := index[key]
+		switch {
+		case !seen:
+			index[key] = len(associations)
+			partitioned[key] = fields[3] != ""
+			associations = append(associations, a)
+		case partitioned[key] && fields[3] == "":
+			partitioned[key] = false
+			associations[i] = a
+		case partitioned[key] == (fields[3] != ""):
+			for resource, count := range a.grp_tres {
+				if count > associations[i].grp_tres[resource] {
+					associations[i].grp_tres[resource] = count
+				}
+			}
+			if associations[i].parent == "" {
+				associations[i].parent = a.parent
+			}
+		}
+	}
+	return associations
+}
+
+// Execute the squeue command and return the account, user and TRES of
+// the running jobs. The columns are unbounded and delimited, the account
+// and user names may be longer than the 20 characters by default.
+func AssociationUsageData() []byte {
+	args := []string{"--state=RUNNING", "--noheader", "--Format=account:.|,username:.|,tres-alloc:."}
+	return Execute("squeue", args)
+}
+
+// ParseAssociationUsage sums the TRES of the running jobs by association.
+// The GrpTRES of an account bounds its sub-accounts too, so a job is
+// counted for its user, its account and every parent of the account.
+func ParseAssociationUsage(input []byte, associations []Association, pe *ParseErrors) map[AssociationKey]map[string]float64 {
+	parents := make(map[string]string)
+	for _, a := range associations {
+		if a.user == "" {
+			parents[a.account] = a.parent
+		}
+	}
+	usage := make(map[AssociationKey]map[string]float64)
+	add := func(key AssociationKey, tres map[string]float64) {
+		if usage[key] == nil {
+			usage[key] = make(map[string]float64)
+		}
+		for resource, count := range tres {
+			usage[key][resource] += count
+		}
+	}
+	for _, line := range strings.Split(string(input), "\n") {
+		// account|user|tres, e.g. physics|alice|cpu=8,gres/gpu=2,node=1
+		fields := strings.Split(line, "|")
+		if len(fields) < 3 {
+			continue
+		}
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		tres := ParseTRES(fields[2], pe)
+		add(AssociationKey{fields[0], fields[1]}, tres)
+		// A broken hierarchy must not loop forever
+		seen := make(map[string]bool)
+		for account := fields[0]; account != "" && !seen[account]; account = parents[account] {
+			seen[account] = true
+			add(AssociationKey{account, ""}, tres)
+		}
+	}
+	return usage
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * Slurm association limits metrics into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+// The associations are those of the cluster of scontrol, the one of
+// -slurm.cluster-name if set, resolved on the first scrape.
+func NewAssociationsCollector() *AssociationsCollector {
+	labels := []string{"account", "user", "tres"}
+	return &AssociationsCollector{
+		parseErrors: &ParseErrors{},
+		limit:       NewDesc("slurm_assoc_grp_tres_limit", "GrpTRES limit of the association by TRES, the user is empty for an account", labels, nil),
+		used:        NewDesc("slurm_assoc_grp_tres_used", "TRES allocated to the running jobs of the association and its sub-accounts", labels, nil),
+	}
+}
+
+type AssociationsCollector struct {
+	limit       *prometheus.Desc
+	used        *prometheus.Desc
+	parseErrors *ParseErrors
+	cluster     string
+	resolve     sync.Once
+}
+
+func (ac *AssociationsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- ac.limit
+	ch <- ac.used
+}
+
+func (ac *AssociationsCollector) Collect(ch chan<- prometheus.Metric) {
+	ac.resolve.Do(func() {
+		ac.cluster = ParseSlurmConfig(SlurmConfigData())["ClusterName"]
+	})
+	associations := ParseAssociations(AssociationsData(), ac.cluster, ac.parseErrors)
+	usage := ParseAssociationUsage(AssociationUsageData(), associations, ac.parseErrors)
+	for _, a := range associations {
+		key := AssociationKey{a.account, a.user}
+		// Usage is only exported next to a limit, to see how close it is
+		for resource, count := range a.grp_tres {
+			if strings.HasPrefix(resource, "gres/gpu:") && !gpuTypeFilter.Allowed(strings.TrimPrefix(resource, "gres/gpu:")) {
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(ac.limit, prometheus.GaugeValue, count, a.account, a.user, resource)
+			ch <- prometheus.MustNewConstMetric(ac.used, prometheus.GaugeValue, usage[key][resource], a.account, a.user, resource)
+		}
+	}
+	if err := ac.parseErrors.Take(); err != nil {
+		ch <- prometheus.NewInvalidMetric(ac.limit, err)
+	}
+}
@@ -0,0 +1,90 @@
+/* Copyright 2020 Joeri Hermans, Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssociationUsage(t *testing.T) {
+	assoc, err := ioutil.ReadFile("test_data/sacctmgr_assoc.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	squeue, err := ioutil.ReadFile("test_data/squeue_assoc.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	associations := ParseAssociations(assoc, "hpc", nil)
+	assert.Equal(t, Association{"physics", "", "root", map[string]float64{"gres/gpu": 8, "cpu": 256}}, associations[2])
+	assert.Equal(t, map[string]float64{}, associations[4].grp_tres)
+
+	usage := ParseAssociationUsage(squeue, associations, nil)
+	assert.Equal(t, float64(2), usage[AssociationKey{"physics", "alice"}]["gres/gpu"])
+	// theory is a sub-account of physics
+	assert.Equal(t, float64(6), usage[AssociationKey{"physics", ""}]["gres/gpu"])
+	assert.Equal(t, float64(28), usage[AssociationKey{"physics", ""}]["cpu"])
+	assert.Equal(t, float64(3), usage[AssociationKey{"theory", ""}]["gres/gpu:a100"])
+	assert.Equal(t, float64(60), usage[AssociationKey{"root", ""}]["cpu"])
+
+	// Account and user names longer than the default width
+	usage = ParseAssociationUsage([]byte("computational-physics|a.very.long.user.name|cpu=8,gres/gpu=1\n"), associations, nil)
+	assert.Equal(t, float64(1), usage[AssociationKey{"computational-physics", "a.very.long.user.name"}]["gres/gpu"])
+}
+
+func TestAssociationsCollector(t *testing.T) {
+	defer fakeSlurm(t, map[string][]fakeOutput{
+		"sacctmgr": {{"*", "test_data/sacctmgr_assoc.txt"}},
+		"scontrol": {{"*", "test_data/scontrol_config.txt"}},
+		"squeue":   {{"*", "test_data/squeue_assoc.txt"}},
+	})()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewAssociationsCollector())
+	metrics := collectMetrics(t, registry)
+
+	assert.Equal(t, float64(8), metrics[`slurm_assoc_grp_tres_limit{account="physics",tres="gres/gpu",user=""}`])
+	assert.Equal(t, float64(6), metrics[`slurm_assoc_grp_tres_used{account="physics",tres="gres/gpu",user=""}`])
+	assert.Equal(t, float64(2), metrics[`slurm_assoc_grp_tres_limit{account="physics",tres="gres/gpu",user="alice"}`])
+	assert.Equal(t, float64(2), metrics[`slurm_assoc_grp_tres_used{account="physics",tres="gres/gpu",user="alice"}`])
+	assert.Equal(t, float64(4), metrics[`slurm_assoc_grp_tres_limit{account="theory",tres="gres/gpu:a100",user=""}`])
+	assert.Equal(t, float64(3), metrics[`slurm_assoc_grp_tres_used{account="theory",tres="gres/gpu:a100",user=""}`])
+	// Associations without a limit are left out
+	assert.NotContains(t, metrics, `slurm_assoc_grp_tres_used{account="chemistry",tres="cpu",user=""}`)
+	assert.NotContains(t, metrics, `slurm_assoc_grp_tres_used{account="physics",tres="gres/gpu",user="bob"}`)
+}
+
+func TestAssociationsClusters(t *testing.T) {
+	assoc, err := ioutil.ReadFile("test_data/sacctmgr_assoc_clusters.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	associations := ParseAssociations(assoc, "hpc", nil)
+	assert.Equal(t, 4, len(associations))
+	// The association without partition wins, wherever its line is
+	assert.Equal(t, Association{"physics", "alice", "", map[string]float64{"gres/gpu": 2}}, associations[1])
+	assert.Equal(t, Association{"physics", "", "root", map[string]float64{"gres/gpu": 8}}, associations[2])
+	// Else the highest limits of the partitions
+	assert.Equal(t, map[string]float64{"gres/gpu": 3, "cpu": 16}, associations[3].grp_tres)
+
+	assert.Equal(t, float64(64), ParseAssociations(assoc, "lab", nil)[0].grp_tres["gres/gpu"])
+	// The highest limits of all the clusters
+	assert.Equal(t, float64(64), ParseAssociations(assoc, "", nil)[2].grp_tres["gres/gpu"])
+}
@@ -0,0 +1,353 @@
+/* Copyright 2017-2020 Victor Penso, Matteo Dessalvi, Joeri Hermans
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// Slurm commands the collectors depend on
+var slurmBinaries = []string{"sinfo", "squeue", "sdiag", "sshare", "scontrol"}
+
+// Slurm commands which humanize the memory values (e.g. 1.95G) unless
+// run with --noconvert
+var noConvertBinaries = map[string]bool{"sacct": true, "sstat": true}
+
+// Slurm commands without -M: sacctmgr reads the QOS and associations in
+// the database shared by all the clusters, and sstat queries the slurmd
+// of the steps it is given, which only run on the local cluster
+var noClusterBinaries = map[string]bool{"sacctmgr": true, "sstat": true}
+
+// Slurm commands only needed with GPUs accounting
+var gpuBinaries = []string{"sacctmgr"}
+
+// Slurm commands of optional samples, which are skipped or fail their
+// scrape when the command is missing instead of stopping the exporter
+var optionalBinaries = map[string]bool{"sprio": true, "sstat": true}
+
+// NewSlurmBinariesAvailable builds the gauge of the Slurm commands found
+// at startup, like NewCommandOutputLines once the flags are parsed
+func NewSlurmBinariesAvailable() *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name:        MetricName("slurm_exporter_slurm_binaries_available"),
+		Help:        "Whether the Slurm command used by the exporter was found at startup",
+		ConstLabels: ConstLabels(),
+	}, []string{"command"})
+}
+
+// ProbeRequiredBinaries sets the availability of every binary and returns
+// the missing ones which are not optional, the exporter can't start
+// without them. A missing optional binary is only reported with 0.
+func ProbeRequiredBinaries(binaries []string, available *prometheus.GaugeVec) []string {
+	missing := make(map[string]bool)
+	for _, binary := range ProbeSlurmBinaries(binaries) {
+		missing[binary] = true
+	}
+	required := []string{}
+	for _, binary := range binaries {
+		if !missing[binary] {
+			available.WithLabelValues(binary).Set(1)
+			continue
+		}
+		available.WithLabelValues(binary).Set(0)
+		if !optionalBinaries[binary] {
+			required = append(required, binary)
+		}
+	}
+	return required
+}
+
+// ProbeSlurmBinaries returns the binaries which can not be found,
+// either in the PATH or at the given path.
+func ProbeSlurmBinaries(binaries []string) []string {
+	missing := []string{}
+	for _, binary := range binaries {
+		if _, err := exec.LookPath(binary); err != nil {
+			missing = append(missing, binary)
+		}
+	}
+	return missing
+}
+
+// SlurmArgs builds the arguments of a Slurm command, adding the options
+// which apply to every command (e.g. the cluster selection with -M or
+// --noconvert) and the extra arguments given for this command.
+func SlurmArgs(command string, arguments []string) []string {
+	args := []string{}
+	if *slurmClusterName != "" && !noClusterBinaries[command] {
+		args = append(args, "-M", *slurmClusterName)
+	}
+	args = append(args, arguments...)
+	if *slurmNoConvert && noConvertBinaries[command] {
+		args = append(args, "--noconvert")
+	}
+	if extra, ok := slurmExtraArgs[command]; ok {
+		args = append(args, strings.Fields(*extra)...)
+	}
+	return args
+}
+
+// With -M, sinfo and squeue print a "CLUSTER: <name>" line before the
+// output of each cluster, even with --noheader. The lines are detected
+// rather than expected with -slurm.cluster-name only, as the extra
+// arguments may query several clusters of a federation too (e.g. -M
+// all), whose outputs follow each other.
+func StripClusterHeader(out []byte) []byte {
+	if !bytes.Contains(out, []byte("CLUSTER: ")) {
+		return out
+	}
+	lines := strings.Split(string(out), "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "CLUSTER: ") {
+			kept = append(kept, line)
+		}
+	}
+	return []byte(strings.Join(kept, "\n"))
+}
+
+// Longest output kept for every recorded command
+const maxRecordedOutput = 4096
+
+// The last invocation of a command by a function, for diagnostics
+type CommandRecord struct {
+	Command  string    `json:"command"`
+	Caller   string    `json:"caller"`
+	Args     []string  `json:"args"`
+	ExitCode int       `json:"exit_code"`
+	Started  time.Time `json:"started"`
+	Duration float64   `json:"duration_seconds"`
+	Output   string    `json:"output"`
+}
+
+// CommandLog keeps the last invocation of every command by every function
+// running it and serves them as JSON on the /debug/commands endpoint. The
+// records are not keyed by the arguments, which change between scrapes
+// for some commands (e.g. the job list of sstat or the start of sacct).
+type CommandLog struct {
+	mu   sync.Mutex
+	last map[string]CommandRecord
+}
+
+func NewCommandLog() *CommandLog {
+	return &CommandLog{last: make(map[string]CommandRecord)}
+}
+
+var commandLog = NewCommandLog()
+
+func (cl *CommandLog) Record(record CommandRecord) {
+	if len(record.Output) > maxRecordedOutput {
+		record.Output = record.Output[:maxRecordedOutput]
+	}
+	key := record.Command + " " + record.Caller
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.last[key] = record
+}
+
+// Records returns the last invocations sorted by command and caller
+func (cl *CommandLog) Records() []CommandRecord {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	keys := make([]string, 0, len(cl.last))
+	for key := range cl.last {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	records := make([]CommandRecord, 0, len(keys))
+	for _, key := range keys {
+		records = append(records, cl.last[key])
+	}
+	return records
+}
+
+func (cl *CommandLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(cl.Records()); err != nil {
+		log.Errorf("Can not encode the commands: %v", err)
+	}
+}
+
+// Lines of the last output of every command by the function running it,
+// a command suddenly printing no line points at an issue of the
+// controller rather than an empty cluster
+var commandOutputLines = NewCommandOutputLines()
+
+// NewCommandOutputLines builds the gauge of the output lines, it is built
+// again once the flags are parsed to get the metric prefix
+func NewCommandOutputLines() *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name:        MetricName("slurm_command_output_lines"),
+		Help:        "Number of non-empty lines of the last output of the Slurm command by the function running it",
+		ConstLabels: ConstLabels(),
+	}, []string{"command", "caller"})
+}
+
+// Slurm commands running, a pileup of slow scrapes shows up as a growing
+// number of commands in flight
+var commandsInFlight = NewCommandsInFlight()
+
+// NewCommandsInFlight builds the gauge of the commands in flight, like
+// NewCommandOutputLines once the flags are parsed
+func NewCommandsInFlight() prometheus.Gauge {
+	return prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        MetricName("slurm_exporter_commands_in_flight"),
+		Help:        "Number of Slurm commands currently running",
+		ConstLabels: ConstLabels(),
+	})
+}
+
+// CountLines counts the non-empty lines of a command output
+func CountLines(out []byte) float64 {
+	lines := float64(0)
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines++
+		}
+	}
+	return lines
+}
+
+// Execute a Slurm command and return its output, the exporter exits if
+// the command fails
+func Execute(command string, arguments []string) []byte {
+	out, err := execute(command, arguments, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return out
+}
+
+// ExecuteError runs a Slurm command like Execute but returns its failure,
+// e.g. a non-zero exit code, for the collectors which tell an empty
+// output from a failed command.
+func ExecuteError(command string, arguments []string) ([]byte, error) {
+	return execute(command, arguments, false)
+}
+
+// A command in progress, shared with the identical calls arriving meanwhile
+type sharedCall struct {
+	done    chan struct{}
+	out     []byte
+	err     error
+	waiting int
+}
+
+var sharedCalls = struct {
+	sync.Mutex
+	calls map[string]*sharedCall
+}{calls: make(map[string]*sharedCall)}
+
+// ExecuteShared runs a Slurm command like ExecuteError, a call with the
+// same command and arguments arriving while it runs waits for its output
+// instead of running the command again. The collectors of a scrape run
+// concurrently, those needing the same output (e.g. the node dump of
+// scontrol) run the command once.
+func ExecuteShared(command string, arguments []string) ([]byte, error) {
+	key := command + "\x00" + strings.Join(arguments, "\x00")
+	sharedCalls.Lock()
+	if call, ok := sharedCalls.calls[key]; ok {
+		call.waiting++
+		sharedCalls.Unlock()
+		<-call.done
+		return call.out, call.err
+	}
+	call := &sharedCall{done: make(chan struct{})}
+	sharedCalls.calls[key] = call
+	sharedCalls.Unlock()
+
+	call.out, call.err = execute(command, arguments, false)
+
+	sharedCalls.Lock()
+	delete(sharedCalls.calls, key)
+	sharedCalls.Unlock()
+	close(call.done)
+	return call.out, call.err
+}
+
+// ExecuteIgnoreExit runs a Slurm command which reports a state with its
+// exit code, e.g. scontrol ping when a controller is down, and returns
+// its output whatever the exit code.
+func ExecuteIgnoreExit(command string, arguments []string) []byte {
+	out, err := execute(command, arguments, true)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return out
+}
+
+// CommandCaller returns the function which called Execute, ExecuteError,
+// ExecuteShared or ExecuteIgnoreExit, e.g. TotalGPUsData
+func CommandCaller() string {
+	pc := make([]uintptr, 8)
+	// Skip runtime.Callers, CommandCaller and execute
+	frames := runtime.CallersFrames(pc[:runtime.Callers(3, pc)])
+	for {
+		frame, more := frames.Next()
+		// Without the package path, e.g. main.TotalGPUsData
+		function := frame.Function[strings.LastIndex(frame.Function, "/")+1:]
+		function = function[strings.Index(function, ".")+1:]
+		if function != "Execute" && function != "ExecuteError" && function != "ExecuteShared" && function != "ExecuteIgnoreExit" {
+			return function
+		}
+		if !more {
+			return ""
+		}
+	}
+}
+
+func execute(command string, arguments []string, ignoreExit bool) ([]byte, error) {
+	args := SlurmArgs(command, arguments)
+	commandsInFlight.Inc()
+	defer commandsInFlight.Dec()
+	record := CommandRecord{Command: command, Caller: CommandCaller(), Args: args, Started: time.Now()}
+	defer func() {
+		record.Duration = time.Since(record.Started).Seconds()
+		commandLog.Record(record)
+	}()
+
+	cmd := exec.Command(command, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	out, _ := ioutil.ReadAll(stdout)
+	record.Output = string(out)
+	err = cmd.Wait()
+	record.ExitCode = cmd.ProcessState.ExitCode()
+	if _, exited := err.(*exec.ExitError); err != nil && !(exited && ignoreExit) {
+		return nil, fmt.Errorf("%s %s: %v", command, strings.Join(args, " "), err)
+	}
+	out = StripClusterHeader(out)
+	commandOutputLines.WithLabelValues(command, record.Caller).Set(CountLines(out))
+	return out, nil
+}
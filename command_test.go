@@ -0,0 +1,255 @@
+/* Copyright 2017-2020 Victor Penso, Matteo Dessalvi, Joeri Hermans
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlurmArgsClusterName(t *testing.T) {
+	defer func(name string) { *slurmClusterName = name }(*slurmClusterName)
+
+	*slurmClusterName = ""
+	assert.Equal(t, []string{"-h", "-o %C"}, SlurmArgs("sinfo", []string{"-h", "-o %C"}))
+
+	*slurmClusterName = "remote"
+	assert.Equal(t, []string{"-M", "remote", "-h", "-o %P,%T,%C,%r,%u"}, SlurmArgs("squeue", []string{"-h", "-o %P,%T,%C,%r,%u"}))
+	assert.Equal(t, []string{"-M", "remote", "-h", "-o %C"}, SlurmArgs("sinfo", []string{"-h", "-o %C"}))
+	assert.Equal(t, []string{"-M", "remote", "-a", "-X", "--noheader"}, SlurmArgs("sacct", []string{"-a", "-X", "--noheader"}))
+	assert.Equal(t, []string{"-M", "remote"}, SlurmArgs("sdiag", nil))
+	assert.Equal(t, []string{"-n", "-P", "show", "qos"}, SlurmArgs("sacctmgr", []string{"-n", "-P", "show", "qos"}))
+	// sstat has no -M or --clusters
+	assert.Equal(t, []string{"-a", "-n", "-P", "-j", "12"}, SlurmArgs("sstat", []string{"-a", "-n", "-P", "-j", "12"}))
+}
+
+func TestSlurmArgsExtraArgs(t *testing.T) {
+	defer func(extra string) { *slurmExtraArgs["squeue"] = extra }(*slurmExtraArgs["squeue"])
+
+	*slurmExtraArgs["squeue"] = " --federation  --local "
+	assert.Equal(t, []string{"-h", "-o %i", "--federation", "--local"}, SlurmArgs("squeue", []string{"-h", "-o %i"}))
+	assert.Equal(t, []string{"-h", "-o %C"}, SlurmArgs("sinfo", []string{"-h", "-o %C"}))
+	assert.Equal(t, []string{"--federation", "--local"}, SlurmArgs("squeue", nil))
+}
+
+func TestSlurmArgsNoConvert(t *testing.T) {
+	defer func(noconvert bool) { *slurmNoConvert = noconvert }(*slurmNoConvert)
+
+	*slurmNoConvert = true
+	assert.Equal(t, []string{"-a", "-n", "--noconvert"}, SlurmArgs("sstat", []string{"-a", "-n"}))
+	assert.Equal(t, []string{"-X", "--noconvert"}, SlurmArgs("sacct", []string{"-X"}))
+	// sinfo and squeue always report the memory in megabytes
+	assert.Equal(t, []string{"-h"}, SlurmArgs("sinfo", []string{"-h"}))
+	*slurmNoConvert = false
+	assert.Equal(t, []string{"-a", "-n"}, SlurmArgs("sstat", []string{"-a", "-n"}))
+}
+
+func TestStripClusterHeader(t *testing.T) {
+	defer func(name string) { *slurmClusterName = name }(*slurmClusterName)
+
+	out := []byte("CLUSTER: remote\n5725/877/34/6636\n")
+	*slurmClusterName = "remote"
+	assert.Equal(t, "5725/877/34/6636\n", string(StripClusterHeader(out)))
+	// -M passed with the extra arguments
+	*slurmClusterName = ""
+	assert.Equal(t, "5725/877/34/6636\n", string(StripClusterHeader(out)))
+	out = []byte("5725/877/34/6636\n")
+	assert.Equal(t, out, StripClusterHeader(out))
+}
+
+func TestFederatedTRESAlloc(t *testing.T) {
+	defer fakeSlurm(t, map[string][]fakeOutput{
+		"squeue": {{"*", "test_data/squeue_tres_federation.txt"}},
+	})()
+	// The outputs of both clusters, each after its header
+	tres, err := TRESAllocData([]string{"RUNNING"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]float64{"a100": 6, "v100": 1}, ParseAllocatedGPUs(SelectTRES(tres, []string{"RUNNING"}), nil))
+}
+
+func TestProbeSlurmBinaries(t *testing.T) {
+	assert.Equal(t, []string{"/nonexistent/bin/sinfo"}, ProbeSlurmBinaries([]string{"/nonexistent/bin/sinfo", "sh"}))
+	assert.Empty(t, ProbeSlurmBinaries([]string{"sh"}))
+}
+
+func TestProbeRequiredBinaries(t *testing.T) {
+	// Without any Slurm command in the PATH
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", "/nonexistent/bin")
+	defer os.Setenv("PATH", path)
+	available := NewSlurmBinariesAvailable()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(available)
+
+	// Only the missing commands which are not optional stop the exporter
+	missing := ProbeRequiredBinaries([]string{"/bin/sh", "/nonexistent/bin/sinfo", "sstat"}, available)
+	assert.Equal(t, []string{"/nonexistent/bin/sinfo"}, missing)
+	metrics := collectMetrics(t, registry)
+	assert.Equal(t, float64(1), metrics[`slurm_exporter_slurm_binaries_available{command="/bin/sh"}`])
+	assert.Equal(t, float64(0), metrics[`slurm_exporter_slurm_binaries_available{command="/nonexistent/bin/sinfo"}`])
+	assert.Equal(t, float64(0), metrics[`slurm_exporter_slurm_binaries_available{command="sstat"}`])
+}
+
+func TestCommandLog(t *testing.T) {
+	defer fakeSlurm(t, map[string][]fakeOutput{
+		"sdiag": {{"*", "test_data/sdiag.txt"}},
+	})()
+	defer func(cl *CommandLog) { commandLog = cl }(commandLog)
+	commandLog = NewCommandLog()
+
+	Execute("sdiag", nil)
+
+	recorder := httptest.NewRecorder()
+	commandLog.ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/commands", nil))
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	var records []CommandRecord
+	if err := json.NewDecoder(recorder.Body).Decode(&records); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, "sdiag", records[0].Command)
+	assert.Equal(t, "TestCommandLog", records[0].Caller)
+	assert.Equal(t, 0, records[0].ExitCode)
+	assert.Contains(t, records[0].Output, "Server thread count")
+}
+
+func TestCommandOutputLines(t *testing.T) {
+	defer fakeSlurm(t, map[string][]fakeOutput{
+		"sinfo": {{"*", "test_data/sinfo_inventory.txt"}},
+		"sdiag": {{"*", "/dev/null"}},
+	})()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(commandOutputLines)
+
+	Execute("sinfo", []string{"-N", "-h", "-o", "%R %n"})
+	Execute("sdiag", nil)
+	metrics := collectMetrics(t, registry)
+	assert.Equal(t, float64(8), metrics[`slurm_command_output_lines{caller="TestCommandOutputLines",command="sinfo"}`])
+	assert.Equal(t, float64(0), metrics[`slurm_command_output_lines{caller="TestCommandOutputLines",command="sdiag"}`])
+
+	// Every function running the command has its own series
+	InventoryData()
+	metrics = collectMetrics(t, registry)
+	assert.Equal(t, float64(8), metrics[`slurm_command_output_lines{caller="InventoryData",command="sinfo"}`])
+	assert.Equal(t, float64(0), metrics[`slurm_command_output_lines{caller="TestCommandOutputLines",command="sdiag"}`])
+}
+
+func TestCommandsInFlight(t *testing.T) {
+	defer fakeSlurm(t, map[string][]fakeOutput{
+		"sdiag": {{"*", "test_data/sdiag.txt"}},
+	})()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(commandsInFlight)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			Execute("sdiag", nil)
+		}()
+	}
+	wg.Wait()
+	metrics := collectMetrics(t, registry)
+	assert.Contains(t, metrics, `slurm_exporter_commands_in_flight`)
+	assert.Equal(t, float64(0), metrics[`slurm_exporter_commands_in_flight`])
+}
+
+func TestCommandLogTruncate(t *testing.T) {
+	cl := NewCommandLog()
+	cl.Record(CommandRecord{Command: "squeue", Args: []string{"-h"}, Output: strings.Repeat("x", 2*maxRecordedOutput)})
+	cl.Record(CommandRecord{Command: "sinfo", Args: []string{"-h"}})
+	records := cl.Records()
+	assert.Equal(t, "sinfo", records[0].Command)
+	assert.Equal(t, maxRecordedOutput, len(records[1].Output))
+}
+
+func TestCommandLogJobList(t *testing.T) {
+	defer fakeSlurm(t, map[string][]fakeOutput{
+		"sstat": {{"*", "test_data/sstat.txt"}},
+	})()
+	defer func(cl *CommandLog) { commandLog = cl }(commandLog)
+	commandLog = NewCommandLog()
+
+	// The job list changes with every scrape, the record is replaced
+	SstatData([]string{"1", "2"})
+	SstatData([]string{"2", "3"})
+	records := commandLog.Records()
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, "SstatData", records[0].Caller)
+	assert.Contains(t, records[0].Args, "2,3")
+}
+
+func TestExecuteShared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The fake scontrol blocks on the fifo until its output is written
+	fifo := filepath.Join(dir, "nodes")
+	if err := syscall.Mkfifo(fifo, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer fakeSlurm(t, map[string][]fakeOutput{
+		"scontrol": {{"*", fifo}},
+	})()
+	waiting := func() int {
+		sharedCalls.Lock()
+		defer sharedCalls.Unlock()
+		for _, call := range sharedCalls.calls {
+			return call.waiting
+		}
+		return -1
+	}
+
+	var wg sync.WaitGroup
+	outputs := make([][]byte, 2)
+	run := func(i int) {
+		defer wg.Done()
+		outputs[i], _ = ScontrolNodesData()
+	}
+	wg.Add(2)
+	go run(0)
+	for waiting() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// The second collector asks for the node dump while scontrol runs
+	go run(1)
+	for waiting() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := ioutil.WriteFile(fifo, []byte("NodeName=gpu01 Gres=gpu:a100:4\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	assert.Equal(t, "NodeName=gpu01 Gres=gpu:a100:4\n", string(outputs[0]))
+	assert.Equal(t, outputs[0], outputs[1])
+	// Once done, the next call runs the command again
+	assert.Equal(t, -1, waiting())
+}
@@ -0,0 +1,147 @@
+/* Copyright 2017 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Execute scontrol to get the configuration of the controller
+func SlurmConfigData() []byte {
+	return Execute("scontrol", []string{"show", "config"})
+}
+
+// ParseSlurmConfig takes the "Key = Value" lines of scontrol show config
+// and returns the values by key. Other lines (e.g. the header with the
+// date of the configuration) are skipped.
+func ParseSlurmConfig(input []byte) map[string]string {
+	config := make(map[string]string)
+	for _, line := range strings.Split(string(input), "\n") {
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			continue
+		}
+		key := strings.TrimSpace(line[:i])
+		if key == "" || strings.Contains(key, " ") {
+			continue
+		}
+		config[key] = strings.TrimSpace(line[i+1:])
+	}
+	return config
+}
+
+// Execute the squeue command and return the id of every job record
+func ClusterJobsData() []byte {
+	// Without -r a job array waiting to be split is a single record
+	return Execute("squeue", []string{"-a", "-h", "-o", "%A"})
+}
+
+// ParseClusterJobs counts the jobs in the squeue output
+func ParseClusterJobs(input []byte) float64 {
+	count := float64(0)
+	for _, line := range strings.Split(string(input), "\n") {
+		if strings.TrimSpace(line) != "" {
+			count++
+		}
+	}
+	return count
+}
+
+// State of a controller from scontrol ping
+type ControllerState struct {
+	role string
+	host string
+	up   bool
+}
+
+// Execute scontrol ping to get the state of the primary and backup
+// controllers, it exits with 1 when one of them is down
+func ControllerPingData() []byte {
+	return ExecuteIgnoreExit("scontrol", []string{"ping"})
+}
+
+// One controller per line, e.g. "Slurmctld(backup) at ctl02 is DOWN", or
+// all of them on a line before Slurm 18.08, e.g.
+// "Slurmctld(primary/backup) at ctl01/ctl02 are UP/DOWN"
+var controllerPingPattern = regexp.MustCompile(`^Slurmctld\(([^)]+)\) at (\S+) (?:is|are) (\S+)`)
+
+// ParseControllerPing returns the state of every controller in the order
+// of scontrol ping. The banner printed when the primary is down is
+// skipped.
+func ParseControllerPing(input []byte) []ControllerState {
+	controllers := []ControllerState{}
+	for _, line := range strings.Split(string(input), "\n") {
+		match := controllerPingPattern.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			continue
+		}
+		roles := strings.Split(match[1], "/")
+		hosts := strings.Split(match[2], "/")
+		states := strings.Split(match[3], "/")
+		for i := range roles {
+			if i >= len(hosts) || i >= len(states) {
+				break
+			}
+			controllers = append(controllers, ControllerState{roles[i], hosts[i], states[i] == "UP"})
+		}
+	}
+	return controllers
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * Slurm controller limits into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+func NewClusterCollector() *ClusterCollector {
+	return &ClusterCollector{
+		jobsLimit:    NewDesc("slurm_cluster_jobs_limit", "Maximum number of jobs the controller keeps (MaxJobCount), submissions fail beyond it", nil, nil),
+		jobsCurrent:  NewDesc("slurm_cluster_jobs_current", "Jobs currently known by the controller", nil, nil),
+		controllerUp: NewDesc("slurm_controller_up", "Whether the controller answers scontrol ping, by role (primary, backup) and host", []string{"role", "host"}, nil),
+	}
+}
+
+type ClusterCollector struct {
+	jobsLimit    *prometheus.Desc
+	jobsCurrent  *prometheus.Desc
+	controllerUp *prometheus.Desc
+}
+
+func (cc *ClusterCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cc.jobsLimit
+	ch <- cc.jobsCurrent
+	ch <- cc.controllerUp
+}
+
+func (cc *ClusterCollector) Collect(ch chan<- prometheus.Metric) {
+	config := ParseSlurmConfig(SlurmConfigData())
+	if limit, err := strconv.ParseFloat(config["MaxJobCount"], 64); err == nil {
+		ch <- prometheus.MustNewConstMetric(cc.jobsLimit, prometheus.GaugeValue, limit)
+	}
+	ch <- prometheus.MustNewConstMetric(cc.jobsCurrent, prometheus.GaugeValue, ParseClusterJobs(ClusterJobsData()))
+	for _, controller := range ParseControllerPing(ControllerPingData()) {
+		up := float64(0)
+		if controller.up {
+			up = 1
+		}
+		ch <- prometheus.MustNewConstMetric(cc.controllerUp, prometheus.GaugeValue, up, controller.role, controller.host)
+	}
+}
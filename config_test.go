@@ -0,0 +1,76 @@
+/* Copyright 2017 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSlurmConfig(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/scontrol_config.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	config := ParseSlurmConfig(data)
+	t.Logf("%+v", config)
+
+	assert.Equal(t, "10000", config["MaxJobCount"])
+	assert.Equal(t, "300 sec", config["MinJobAge"])
+	// Values may contain '='
+	assert.Equal(t, "bf_continue,bf_max_job_test=500,default_queue_depth=200", config["SchedulerParameters"])
+	assert.Equal(t, "slurmctl02(10.0.0.2)", config["SlurmctldHost[1]"])
+	assert.NotContains(t, config, "Configuration data as of 2023-06-02T09:00:00")
+}
+
+func TestClusterCollector(t *testing.T) {
+	defer fakeSlurm(t, map[string][]fakeOutput{
+		"scontrol": {
+			{"*ping*", "test_data/scontrol_ping.txt"},
+			{"*", "test_data/scontrol_config.txt"},
+		},
+		"squeue": {{"*", "test_data/squeue_jobs.txt"}},
+	})()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewClusterCollector())
+	metrics := collectMetrics(t, registry)
+
+	assert.Equal(t, float64(10000), metrics[`slurm_cluster_jobs_limit`])
+	assert.Equal(t, float64(10), metrics[`slurm_cluster_jobs_current`])
+	assert.Equal(t, float64(1), metrics[`slurm_controller_up{host="slurmctl01",role="primary"}`])
+	assert.Equal(t, float64(0), metrics[`slurm_controller_up{host="slurmctl02",role="backup"}`])
+}
+
+func TestControllerPing(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/scontrol_ping.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	assert.Equal(t, []ControllerState{
+		{"primary", "slurmctl01", true},
+		{"backup", "slurmctl02", false},
+	}, ParseControllerPing(data))
+
+	// Before Slurm 18.08 all the controllers are on one line
+	assert.Equal(t, []ControllerState{
+		{"primary", "slurmctl01", false},
+		{"backup", "slurmctl02", true},
+	}, ParseControllerPing([]byte("Slurmctld(primary/backup) at slurmctl01/slurmctl02 are DOWN/UP\n")))
+}
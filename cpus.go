@@ -17,9 +17,7 @@ package main
 
 import (
 	"github.com/prometheus/client_golang/prometheus"
-	"io/ioutil"
-	"log"
-	"os/exec"
+	"math"
 	"strconv"
 	"strings"
 )
@@ -47,21 +45,72 @@ func ParseCPUsMetrics(input []byte) *CPUsMetrics {
 	return &cm
 }
 
-// Execute the sinfo command and return its output
-func CPUsData() []byte {
-	cmd := exec.Command("sinfo", "-h", "-o %C")
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
-	}
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
+type CPUsJobsMetrics struct {
+	running float64
+	pending float64
+}
+
+// ParseCPUsJobsMetrics sums the cpu= TRES of running jobs and the CPUs
+// requested by pending jobs
+func ParseCPUsJobsMetrics(input []byte, pe *ParseErrors) *CPUsJobsMetrics {
+	var jm CPUsJobsMetrics
+	for _, line := range strings.Split(string(input), "\n") {
+		// state|tres, e.g. RUNNING|billing=30,cpu=16,mem=100G,node=1
+		fields := strings.Split(line, "|")
+		if len(fields) < 2 {
+			continue
+		}
+		cpus := ParseTRES(strings.TrimSpace(fields[1]), pe)["cpu"]
+		switch strings.TrimSpace(fields[0]) {
+		case "RUNNING":
+			jm.running += cpus
+		case "PENDING":
+			jm.pending += cpus
+		}
 	}
-	out, _ := ioutil.ReadAll(stdout)
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
+	return &jm
+}
+
+type SocketsMetrics struct {
+	alloc float64
+	total float64
+}
+
+// ParseSocketsMetrics sums the sockets of every node and the sockets
+// needed by its allocated CPUs, counted as if the allocated CPUs were
+// packed on the fewest sockets
+func ParseSocketsMetrics(input []byte) *SocketsMetrics {
+	var sm SocketsMetrics
+	nodes := make(map[string]bool)
+	for _, line := range strings.Split(string(input), "\n") {
+		// node sockets cores-per-socket threads-per-core A/I/O/T
+		fields := strings.Fields(line)
+		if len(fields) < 5 || nodes[fields[0]] {
+			continue
+		}
+		// With -N a node in several partitions has several lines
+		nodes[fields[0]] = true
+		sockets, _ := strconv.ParseFloat(fields[1], 64)
+		cores, _ := strconv.ParseFloat(fields[2], 64)
+		threads, _ := strconv.ParseFloat(fields[3], 64)
+		alloc, _ := strconv.ParseFloat(strings.Split(fields[4], "/")[0], 64)
+		sm.total += sockets
+		if cores*threads > 0 {
+			sm.alloc += math.Min(math.Ceil(alloc/(cores*threads)), sockets)
+		}
 	}
-	return out
+	return &sm
+}
+
+// Execute the sinfo command and return the socket layout and the CPUs of
+// every node
+func SocketsData() []byte {
+	return Execute("sinfo", []string{"-N", "-h", "-o", "%n %X %Y %Z %C"})
+}
+
+// Execute the sinfo command and return its output
+func CPUsData() []byte {
+	return Execute("sinfo", []string{"-h", "-o %C"})
 }
 
 /*
@@ -72,18 +121,30 @@ func CPUsData() []byte {
 
 func NewCPUsCollector() *CPUsCollector {
 	return &CPUsCollector{
-		alloc: prometheus.NewDesc("slurm_cpus_alloc", "Allocated CPUs", nil, nil),
-		idle:  prometheus.NewDesc("slurm_cpus_idle", "Idle CPUs", nil, nil),
-		other: prometheus.NewDesc("slurm_cpus_other", "Mix CPUs", nil, nil),
-		total: prometheus.NewDesc("slurm_cpus_total", "Total CPUs", nil, nil),
+		parseErrors: &ParseErrors{},
+		alloc:       NewDesc("slurm_cpus_alloc", "Allocated CPUs", nil, nil),
+		idle:        NewDesc("slurm_cpus_idle", "Idle CPUs", nil, nil),
+		other:       NewDesc("slurm_cpus_other", "Mix CPUs", nil, nil),
+		total:       NewDesc("slurm_cpus_total", "Total CPUs", nil, nil),
+		running:     NewDesc("slurm_cpus_running", "CPUs allocated to running jobs", nil, nil),
+		pending:     NewDesc("slurm_cpus_pending", "CPUs requested by pending jobs", nil, nil),
+
+		socketsAlloc: NewDesc("slurm_sockets_alloc", "Sockets holding allocated CPUs, with the allocated CPUs of every node packed on the fewest sockets", nil, nil),
+		socketsTotal: NewDesc("slurm_sockets_total", "Total sockets", nil, nil),
 	}
 }
 
 type CPUsCollector struct {
-	alloc *prometheus.Desc
-	idle  *prometheus.Desc
-	other *prometheus.Desc
-	total *prometheus.Desc
+	alloc   *prometheus.Desc
+	idle    *prometheus.Desc
+	other   *prometheus.Desc
+	total   *prometheus.Desc
+	running *prometheus.Desc
+	pending *prometheus.Desc
+
+	socketsAlloc *prometheus.Desc
+	socketsTotal *prometheus.Desc
+	parseErrors  *ParseErrors
 }
 
 // Send all metric descriptions
@@ -92,6 +153,10 @@ func (cc *CPUsCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- cc.idle
 	ch <- cc.other
 	ch <- cc.total
+	ch <- cc.running
+	ch <- cc.pending
+	ch <- cc.socketsAlloc
+	ch <- cc.socketsTotal
 }
 func (cc *CPUsCollector) Collect(ch chan<- prometheus.Metric) {
 	cm := CPUsGetMetrics()
@@ -99,4 +164,19 @@ func (cc *CPUsCollector) Collect(ch chan<- prometheus.Metric) {
 	ch <- prometheus.MustNewConstMetric(cc.idle, prometheus.GaugeValue, cm.idle)
 	ch <- prometheus.MustNewConstMetric(cc.other, prometheus.GaugeValue, cm.other)
 	ch <- prometheus.MustNewConstMetric(cc.total, prometheus.GaugeValue, cm.total)
+	// The squeue of the GPU collector, shared when both run in the scrape
+	jobs, err := TRESAllocData(JobStates(*gpuAllocStates))
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(cc.running, err)
+	} else {
+		jm := ParseCPUsJobsMetrics(JobColumns(SelectJobs(jobs, []string{"RUNNING", "PENDING"}, nil), jobState, jobTRES), cc.parseErrors)
+		ch <- prometheus.MustNewConstMetric(cc.running, prometheus.GaugeValue, jm.running)
+		ch <- prometheus.MustNewConstMetric(cc.pending, prometheus.GaugeValue, jm.pending)
+	}
+	sm := ParseSocketsMetrics(SocketsData())
+	ch <- prometheus.MustNewConstMetric(cc.socketsAlloc, prometheus.GaugeValue, sm.alloc)
+	ch <- prometheus.MustNewConstMetric(cc.socketsTotal, prometheus.GaugeValue, sm.total)
+	if err := cc.parseErrors.Take(); err != nil {
+		ch <- prometheus.NewInvalidMetric(cc.alloc, err)
+	}
 }
@@ -19,6 +19,8 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestCPUsMetrics(t *testing.T) {
@@ -30,3 +32,25 @@ func TestCPUsMetrics(t *testing.T) {
 	data, err := ioutil.ReadAll(file)
 	t.Logf("%+v", ParseCPUsMetrics(data))
 }
+
+func TestCPUsJobsMetrics(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/squeue_tres.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	jm := ParseCPUsJobsMetrics(data, nil)
+	assert.Equal(t, float64(84), jm.running)
+	assert.Equal(t, float64(10), jm.pending)
+}
+
+func TestSocketsMetrics(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sinfo_sockets.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	sm := ParseSocketsMetrics(data)
+	// a048 is listed twice, b002 needs a second socket for its 17th CPU
+	// and the CPUs of gpu01 are not allocated
+	assert.Equal(t, float64(14), sm.total)
+	assert.Equal(t, float64(2+1+0+2+0), sm.alloc)
+}
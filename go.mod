@@ -3,7 +3,7 @@ module github.com/vpenso/prometheus-slurm-exporter
 go 1.12
 
 require (
-	github.com/prometheus/client_golang v1.2.1
-	github.com/prometheus/common v0.7.0
-	github.com/stretchr/testify v1.3.0
+	github.com/prometheus/client_golang v1.5.1
+	github.com/prometheus/common v0.9.1
+	github.com/stretchr/testify v1.4.0
 )
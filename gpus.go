@@ -16,12 +16,16 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>. */
 package main
 
 import (
+	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
-	"io/ioutil"
-	"os/exec"
+	"math"
+	"regexp"
+	"sort"
 	"strings"
 	"strconv"
+	"sync"
+	"time"
 )
 
 type GPUsMetrics struct {
@@ -29,75 +33,1002 @@ type GPUsMetrics struct {
 	idle        float64
 	total       float64
 	utilization float64
+	no_consume  float64
+	exceeds     float64 // 1 when more GPUs are allocated than there are
 }
 
-// Returns map of ["gpu_type"]GPUsMetrics
-func GPUsGetMetrics() map[string]*GPUsMetrics {
-	return ParseGPUsMetrics()
+// GPUTypeFilter selects which GPU types produce metrics, e.g. to keep
+// test gres out of the dashboards. Both expressions are anchored.
+type GPUTypeFilter struct {
+	include *regexp.Regexp
+	exclude *regexp.Regexp
 }
 
-func ParseAllocatedGPUs() map[string]float64 {
-	gpu_map := make(map[string]float64)
+var gpuTypeFilter = &GPUTypeFilter{}
+
+// NewGPUTypeFilter compiles the include and exclude expressions, an empty
+// expression disables the corresponding check
+func NewGPUTypeFilter(include string, exclude string) (*GPUTypeFilter, error) {
+	var f GPUTypeFilter
+	var err error
+	if include != "" {
+		if f.include, err = regexp.Compile("^(?:" + include + ")$"); err != nil {
+			return nil, fmt.Errorf("invalid GPU type include expression: %v", err)
+		}
+	}
+	if exclude != "" {
+		if f.exclude, err = regexp.Compile("^(?:" + exclude + ")$"); err != nil {
+			return nil, fmt.Errorf("invalid GPU type exclude expression: %v", err)
+		}
+	}
+	return &f, nil
+}
+
+func (f *GPUTypeFilter) Allowed(gpu_type string) bool {
+	if f.include != nil && !f.include.MatchString(gpu_type) {
+		return false
+	}
+	return f.exclude == nil || !f.exclude.MatchString(gpu_type)
+}
+
+// Returns map of ["gpu_type"]GPUsMetrics
+func GPUsGetMetrics(pe *ParseErrors) (map[string]*GPUsMetrics, error) {
+	sinfo, err := TotalGPUsData()
+	if err != nil {
+		return nil, err
+	}
+	return ParseGPUsMetrics(ParseSinfoGPUs(sinfo, pe), AllocatedGPUsData(*gpuAllocStates), pe), nil
+}
 
+func AllocatedGPUsArgs(state string) []string {
 	// squeue --state RUNNING --noheader --Format=tres-alloc:.
-	args := []string{"--state=RUNNING", "--noheader", "--Format=tres-alloc:."}
-	output := string(Execute("squeue", args))
+	return []string{"--state=" + state, "--noheader", "--Format=tres-alloc:."}
+}
+
+// Execute the squeue command and return the TRES of the jobs in the given state
+func AllocatedGPUsData(state string) []byte {
+	return Execute("squeue", AllocatedGPUsArgs(state))
 	//args := []string{"-a", "-X", "--format=AllocTRES", "--state=RUNNING", "--noheader", "--parsable2"}
-	//output := string(Execute("sacct", args))
+	//return Execute("sacct", args)
+}
+
+// ParseAllocatedGPUs sums the allocated GPUs by type over TRES lines
+func ParseAllocatedGPUs(input []byte, pe *ParseErrors) map[string]float64 {
+	return GPUsOfTRES(ParseTRESAlloc(input, pe))
+}
+
+// The columns of the jobs listed by TRESAllocData, by index
+const (
+	jobState = iota
+	jobNodes
+	jobTimeLimit
+	jobAccount
+	jobUser
+	jobName
+	jobCommand
+	jobStartTime
+	jobNumNodes
+	jobPerJob
+	jobPerNode
+	jobTRES
+)
+
+// The squeue columns in the order of the indices, unbounded and delimited:
+// names, commands and requests of several types may be long or contain
+// spaces
+var jobColumns = []string{"state", "nodelist", "timelimit", "account", "username", "name", "command",
+	"starttime", "numnodes", "tres-per-job", "tres-per-node", "tres-alloc"}
 
-	if len(output) == 0 {
-		return make(map[string]float64)
+// The job states of squeue by short name, e.g. "R" for RUNNING
+var jobStateCodes = map[string]string{
+	"BF": "BOOT_FAIL", "CA": "CANCELLED", "CD": "COMPLETED", "CF": "CONFIGURING",
+	"CG": "COMPLETING", "DL": "DEADLINE", "F": "FAILED", "NF": "NODE_FAIL",
+	"OOM": "OUT_OF_MEMORY", "PD": "PENDING", "PR": "PREEMPTED", "R": "RUNNING",
+	"RD": "RESV_DEL_HOLD", "RF": "REQUEUE_FED", "RH": "REQUEUE_HOLD", "RQ": "REQUEUED",
+	"RS": "RESIZING", "RV": "REVOKED", "S": "SUSPENDED", "SE": "SPECIAL_EXIT",
+	"SI": "SIGNALING", "SO": "STAGE_OUT", "ST": "STOPPED", "TO": "TIMEOUT",
+}
+
+// NormalizeJobStates parses a comma-separated list of job states, in any
+// case and by full or short name, e.g. "r,S" for RUNNING,SUSPENDED, and
+// returns their full names once each
+func NormalizeJobStates(list string) ([]string, error) {
+	states := []string{}
+	for _, state := range strings.Split(list, ",") {
+		state = strings.ToUpper(strings.TrimSpace(state))
+		if name, ok := jobStateCodes[state]; ok {
+			state = name
+		}
+		known := false
+		for _, name := range jobStateCodes {
+			known = known || name == state
+		}
+		if !known {
+			return nil, fmt.Errorf("invalid job state %q", state)
+		}
+		if !StateSet(states)[state] {
+			states = append(states, state)
+		}
 	}
+	return states, nil
+}
 
-	for _, line := range strings.Split(output, "\n") {
-		if len(line) == 0 {
+// StateSet is the set of the given job states
+func StateSet(states []string) map[string]bool {
+	set := make(map[string]bool, len(states))
+	for _, state := range states {
+		set[state] = true
+	}
+	return set
+}
+
+// JobStates are the states listed by the squeue of the jobs: the states
+// counted as allocated (see -gpu.alloc-states), the suspended jobs which
+// keep their GPUs with gang scheduling, and the running and pending jobs
+// of the breakdowns and of the CPU and TRES collectors
+func JobStates(allocStates string) []string {
+	states := strings.Split(allocStates, ",")
+	listed := StateSet(states)
+	for _, state := range []string{"RUNNING", "SUSPENDED", "PENDING"} {
+		if !listed[state] {
+			states = append(states, state)
+		}
+	}
+	return states
+}
+
+// Execute the squeue command and return the jobColumns of the jobs in the
+// given states, for the allocation and every breakdown of the jobs at
+// once. The squeue is shared with the collectors asking for the same
+// states in the same scrape, see ExecuteShared. An empty output is a
+// cluster without such jobs, a failed squeue is an error.
+func TRESAllocData(states []string) ([]byte, error) {
+	format := make([]string, len(jobColumns))
+	for i, column := range jobColumns {
+		format[i] = column + ":.|"
+	}
+	format[jobTRES] = jobColumns[jobTRES] + ":."
+	args := []string{"--state=" + strings.Join(states, ","), "--noheader", "--Format=" + strings.Join(format, ",")}
+	return ExecuteShared("squeue", args)
+}
+
+// jobFields splits a line of TRESAllocData into its columns. A line of
+// another width, e.g. a CLUSTER header or a name holding the delimiter, is
+// not a job.
+func jobFields(line string) ([]string, bool) {
+	fields := strings.Split(line, "|")
+	if len(fields) != len(jobColumns) {
+		return nil, false
+	}
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	return fields, true
+}
+
+// SelectJobs keeps the lines of TRESAllocData of the jobs in one of the
+// given states, and of one of the given accounts if any
+func SelectJobs(input []byte, states []string, accounts []string) []byte {
+	selected := StateSet(states)
+	charged := make(map[string]bool)
+	for _, account := range accounts {
+		charged[account] = true
+	}
+	jobs := []string{}
+	for _, line := range strings.Split(string(input), "\n") {
+		fields, ok := jobFields(line)
+		if !ok || !selected[fields[jobState]] || (len(charged) > 0 && !charged[fields[jobAccount]]) {
+			continue
+		}
+		jobs = append(jobs, line)
+	}
+	return []byte(strings.Join(jobs, "\n"))
+}
+
+// JobColumns keeps the given columns of the lines of TRESAllocData, in
+// the order given and delimited, e.g. "name|command|tres" for
+// JobColumns(input, jobName, jobCommand, jobTRES)
+func JobColumns(input []byte, columns ...int) []byte {
+	jobs := []string{}
+	for _, line := range strings.Split(string(input), "\n") {
+		fields, ok := jobFields(line)
+		if !ok {
+			continue
+		}
+		kept := make([]string, len(columns))
+		for i, column := range columns {
+			kept[i] = fields[column]
+		}
+		jobs = append(jobs, strings.Join(kept, "|"))
+	}
+	return []byte(strings.Join(jobs, "\n"))
+}
+
+// SelectTRES keeps the TRES of the jobs in one of the given states from
+// the output of TRESAllocData, one TRES line per job, so that it can be
+// parsed like the output of AllocatedGPUsData
+func SelectTRES(input []byte, states []string) []byte {
+	consumed, _ := SelectConsumedTRES(input, states, nil)
+	return consumed
+}
+
+// SelectConsumedTRES is SelectTRES leaving out the GPUs of the types which
+// are no_consume on the first node of the job, see SinfoGPUs:
+// the job doesn't use them up. These GPUs are returned apart, one TRES
+// line per job holding some.
+func SelectConsumedTRES(input []byte, states []string, noConsume map[string]map[string]bool) ([]byte, []byte) {
+	consumed := []string{}
+	held := []string{}
+	for _, line := range strings.Split(string(SelectJobs(input, states, nil)), "\n") {
+		fields, ok := jobFields(line)
+		if !ok {
 			continue
 		}
-		
+		tres := fields[jobTRES]
+		types := map[string]bool{}
+		if nodes := ExpandNodeList(fields[jobNodes]); len(nodes) > 0 && noConsume[nodes[0]] != nil {
+			types = noConsume[nodes[0]]
+		}
+		if len(types) == 0 {
+			consumed = append(consumed, tres)
+			continue
+		}
+		kept := []string{}
+		gpus := []string{}
+		for _, resource := range strings.Split(tres, ",") {
+			name := strings.TrimSpace(strings.SplitN(resource, "=", 2)[0])
+			if strings.HasPrefix(name, "gres/gpu:") && types[strings.TrimPrefix(name, "gres/gpu:")] {
+				gpus = append(gpus, resource)
+			} else {
+				kept = append(kept, resource)
+			}
+		}
+		consumed = append(consumed, strings.Join(kept, ","))
+		if len(gpus) > 0 {
+			held = append(held, strings.Join(gpus, ","))
+		}
+	}
+	return []byte(strings.Join(consumed, "\n")), []byte(strings.Join(held, "\n"))
+}
+
+// ParseTRESAlloc sums every TRES over TRES lines, one job per line, e.g.
+// cpu, mem (in bytes), node, billing and every gres like gres/gpu:a100
+func ParseTRESAlloc(input []byte, pe *ParseErrors) map[string]float64 {
+	alloc := make(map[string]float64)
+	for _, line := range strings.Split(string(input), "\n") {
 		// billing=30,cpu=1,gres/gpu:a100=2,gres/gpu=2,mem=100G,node=1
 		line = strings.Trim(line, "\"")
-		for _, resource := range strings.Split(line, ",") {
-			if strings.HasPrefix(resource, "gres/gpu:") { // Look for specific GPU type, eg "gres/gpu:k80=1"
-				descriptor := strings.TrimPrefix(resource, "gres/gpu:") // k80=1
-				values := strings.Split(descriptor, "=")
-				gpu_type := values[0]
-				count, _ := strconv.ParseFloat(values[1], 64)
-				
-				gpu_map[gpu_type] += count
-			}
+		for resource, count := range ParseTRES(line, pe) {
+			alloc[resource] += count
 		}
 	}
+	return alloc
+}
 
+// GPUsOfTRES returns the GPUs by type of the TRES, e.g. 2 a100 GPUs for
+// gres/gpu:a100=2. The untyped gres/gpu total is left out.
+func GPUsOfTRES(tres map[string]float64) map[string]float64 {
+	gpu_map := make(map[string]float64)
+	for resource, count := range tres {
+		if strings.HasPrefix(resource, "gres/gpu:") {
+			gpu_map[strings.TrimPrefix(resource, "gres/gpu:")] += count
+		}
+	}
 	return gpu_map
 }
 
-func ParseTotalGPUs() map[string]float64 {
+// Bucket of the number of GPUs held by a job
+func GPUJobSize(count float64) string {
+	switch {
+	case count <= 1:
+		return "1"
+	case count <= 4:
+		return "2-4"
+	case count < 8:
+		return "5-7"
+	default:
+		return "8+"
+	}
+}
+
+// ParseGPUJobsBySize counts the jobs by GPU type and by bucket of the
+// number of GPUs each job holds, e.g. ["a100"]["2-4"]
+func ParseGPUJobsBySize(input []byte, pe *ParseErrors) map[string]map[string]float64 {
+	result := make(map[string]map[string]float64)
+
+	for _, line := range strings.Split(string(input), "\n") {
+		line = strings.Trim(line, "\"")
+		for resource, count := range ParseTRES(line, pe) {
+			if !strings.HasPrefix(resource, "gres/gpu:") || count == 0 {
+				continue
+			}
+			gpu_type := strings.TrimPrefix(resource, "gres/gpu:")
+			if result[gpu_type] == nil {
+				result[gpu_type] = make(map[string]float64)
+			}
+			result[gpu_type][GPUJobSize(count)]++
+		}
+	}
+	return result
+}
+
+// Bucket of the time limit of a job, UNLIMITED (or any limit which is not
+// a duration) is "unlimited"
+func TimeLimitBucket(limit string) string {
+	d, ok := ParseSlurmDuration(limit)
+	switch {
+	case !ok:
+		return "unlimited"
+	case d < time.Hour:
+		return "<1h"
+	case d < 24*time.Hour:
+		return "1h-1d"
+	case d < 7*24*time.Hour:
+		return "1d-7d"
+	default:
+		return "7d+"
+	}
+}
+
+// ParseGPUsByTimeLimit sums the allocated GPUs by type and by bucket of
+// the time limit of the jobs holding them, e.g. ["a100"]["1h-1d"]
+func ParseGPUsByTimeLimit(input []byte, pe *ParseErrors) map[string]map[string]float64 {
+	result := make(map[string]map[string]float64)
+	for _, line := range strings.Split(string(input), "\n") {
+		// limit|tres, e.g. 1-00:00:00|billing=30,cpu=16,gres/gpu:a100=2
+		fields := strings.Split(line, "|")
+		if len(fields) < 2 {
+			continue
+		}
+		bucket := TimeLimitBucket(strings.TrimSpace(fields[0]))
+		for gpu_type, count := range GPUsOfTRES(ParseTRES(strings.TrimSpace(fields[1]), pe)) {
+			if result[gpu_type] == nil {
+				result[gpu_type] = make(map[string]float64)
+			}
+			result[gpu_type][bucket] += count
+		}
+	}
+	return result
+}
+
+// OversubscribedGPUs returns the GPUs allocated beyond the total by type,
+// when gang scheduling time-slices the GPUs between running and suspended
+// jobs
+func OversubscribedGPUs(cm map[string]*GPUsMetrics, suspended map[string]float64) map[string]float64 {
+	result := make(map[string]float64)
+	for gpu_type, m := range cm {
+		result[gpu_type] = math.Max(0, m.alloc+suspended[gpu_type]-m.total)
+	}
+	return result
+}
+
+// ParseRequestedGPUs returns the GPUs by type of a TRES or gres request,
+// e.g. 2 a100 GPUs for "gres:gpu:a100:2" or "gres/gpu:a100=2", 1 without
+// a count. GPUs of any type, e.g. "gres:gpu:2" or "gres/gpu=2", are
+// counted as "any".
+func ParseRequestedGPUs(request string) map[string]float64 {
+	gpus := make(map[string]float64)
+	for _, resource := range strings.Split(request, ",") {
+		resource = strings.TrimPrefix(strings.TrimPrefix(resource, "gres:"), "gres/")
+		values := strings.Split(strings.Replace(resource, "=", ":", -1), ":")
+		if len(values) < 2 || values[0] != "gpu" {
+			continue
+		}
+		if count, err := strconv.ParseFloat(values[1], 64); err == nil {
+			gpus[anyGPUType] += count
+			continue
+		}
+		count := float64(1)
+		if len(values) > 2 {
+			var err error
+			if count, err = strconv.ParseFloat(values[2], 64); err != nil {
+				continue
+			}
+		}
+		gpus[values[1]] += count
+	}
+	return gpus
+}
+
+// ParseRequestedGPUTypes returns the GPU types explicitly requested in a
+// TRES or gres request, sorted, e.g. "gres:gpu:a100:2" or
+// "gres/gpu:a100=4". Requests of any type, e.g. "gres:gpu:2", have no type.
+func ParseRequestedGPUTypes(request string) []string {
+	types := []string{}
+	for gpu_type := range ParseRequestedGPUs(request) {
+		if gpu_type != anyGPUType {
+			types = append(types, gpu_type)
+		}
+	}
+	sort.Strings(types)
+	return types
+}
+
+// ParseWrongTypeGPUJobs counts the running jobs which requested a GPU type
+// but got GPUs of another type, by requested and allocated type
+func ParseWrongTypeGPUJobs(input []byte, pe *ParseErrors) map[string]map[string]float64 {
+	result := make(map[string]map[string]float64)
+	for _, line := range strings.Split(string(input), "\n") {
+		// per job|per node|tres, e.g. N/A|gres:gpu:a100:2|gres/gpu:v100=2
+		fields := strings.Split(line, "|")
+		if len(fields) < 3 {
+			continue
+		}
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		requested := make(map[string]bool)
+		for _, gpu_type := range append(ParseRequestedGPUTypes(fields[0]), ParseRequestedGPUTypes(fields[1])...) {
+			requested[gpu_type] = true
+		}
+		allocated := make(map[string]bool)
+		for resource := range ParseTRES(fields[2], pe) {
+			if strings.HasPrefix(resource, "gres/gpu:") {
+				allocated[strings.TrimPrefix(resource, "gres/gpu:")] = true
+			}
+		}
+		for req := range requested {
+			if allocated[req] {
+				continue
+			}
+			for alloc := range allocated {
+				if requested[alloc] {
+					continue
+				}
+				if result[req] == nil {
+					result[req] = make(map[string]float64)
+				}
+				result[req][alloc]++
+			}
+		}
+	}
+	return result
+}
+
+// ParsePendingGPUJobs counts the pending jobs requesting each GPU type,
+// a job requesting several types is counted for each of them. Jobs
+// requesting GPUs of any type are counted as "any".
+func ParsePendingGPUJobs(input []byte) map[string]float64 {
+	result := make(map[string]float64)
+	for _, line := range strings.Split(string(input), "\n") {
+		// per job|per node, e.g. N/A|gres:gpu:a100:1,gres:gpu:v100:1
+		requested := make(map[string]bool)
+		for _, field := range strings.Split(line, "|") {
+			field = strings.TrimSpace(field)
+			types := ParseRequestedGPUTypes(field)
+			for _, gpu_type := range types {
+				requested[gpu_type] = true
+			}
+			if len(types) == 0 && strings.Contains(field, "gpu") {
+				requested[anyGPUType] = true
+			}
+		}
+		for gpu_type := range requested {
+			result[gpu_type]++
+		}
+	}
+	return result
+}
+
+// ParsePlannedGPUs sums the GPUs requested by the pending jobs the
+// backfill scheduler planned to start before now plus the window, by type.
+// GPUs of any type are counted as "any".
+func ParsePlannedGPUs(input []byte, now time.Time, window time.Duration, pe *ParseErrors) map[string]float64 {
+	result := make(map[string]float64)
+	for _, line := range strings.Split(string(input), "\n") {
+		// start|nodes|per job|per node, e.g.
+		// 2026-10-14T10:30:00|2|N/A|gres:gpu:a100:2
+		fields := strings.Split(line, "|")
+		if len(fields) < 4 {
+			continue
+		}
+		start, err := time.ParseInLocation("2006-01-02T15:04:05", strings.TrimSpace(fields[0]), time.Local)
+		if err != nil || start.After(now.Add(window)) {
+			continue
+		}
+		nodes, err := strconv.ParseFloat(strings.TrimSpace(fields[1]), 64)
+		if err != nil {
+			pe.Report("squeue line %q, nodes %q", line, fields[1])
+			continue
+		}
+		for gpu_type, count := range ParseRequestedGPUs(strings.TrimSpace(fields[2])) {
+			result[gpu_type] += count
+		}
+		for gpu_type, count := range ParseRequestedGPUs(strings.TrimSpace(fields[3])) {
+			result[gpu_type] += count * nodes
+		}
+	}
+	return result
+}
+
+// ParseAllocatedGPUsByUser returns map of ["gpu_type"]["user"]allocated GPUs
+func ParseAllocatedGPUsByUser(input []byte, pe *ParseErrors) map[string]map[string]float64 {
+	result := make(map[string]map[string]float64)
+
+	for _, line := range strings.Split(string(input), "\n") {
+		// user|tres, e.g. user01|cpu=1,gres/gpu:a100=1
+		fields := strings.Split(line, "|")
+		if len(fields) < 2 {
+			continue
+		}
+		user := strings.TrimSpace(fields[0])
+		for resource, count := range ParseTRES(strings.TrimSpace(fields[1]), pe) {
+			if strings.HasPrefix(resource, "gres/gpu:") {
+				gpu_type := strings.TrimPrefix(resource, "gres/gpu:")
+				if result[gpu_type] == nil {
+					result[gpu_type] = make(map[string]float64)
+				}
+				result[gpu_type][user] += count
+			}
+		}
+	}
+	return result
+}
+
+// Job names and commands of interactive sessions: salloc and srun --pty
+// usually start a shell, some sites wrap them in an "interactive" script
+var interactiveCommands = map[string]bool{
+	"bash": true, "sh": true, "zsh": true, "csh": true, "tcsh": true,
+	"interactive": true,
+}
+
+// IsInteractiveJob guesses if a job is an interactive session from its
+// name or the base name of its command
+func IsInteractiveJob(name string, command string) bool {
+	base := command[strings.LastIndex(command, "/")+1:]
+	return interactiveCommands[name] || interactiveCommands[base]
+}
+
+// ParseInteractiveGPUs sums the GPUs allocated to interactive sessions by type
+func ParseInteractiveGPUs(input []byte, pe *ParseErrors) map[string]float64 {
 	gpu_map := make(map[string]float64)
 
-	args := []string{"-h", "-o \"%n %G\""}
-	output := string(Execute("sinfo", args))
+	for _, line := range strings.Split(string(input), "\n") {
+		// name|command|tres, e.g. bash|/bin/bash|cpu=8,gres/gpu:a100=2
+		fields := strings.Split(line, "|")
+		if len(fields) < 3 || !IsInteractiveJob(strings.TrimSpace(fields[0]), strings.TrimSpace(fields[1])) {
+			continue
+		}
+		for resource, count := range ParseTRES(strings.TrimSpace(fields[2]), pe) {
+			if strings.HasPrefix(resource, "gres/gpu:") {
+				gpu_map[strings.TrimPrefix(resource, "gres/gpu:")] += count
+			}
+		}
+	}
+	return gpu_map
+}
+
+type GPUsUserAlloc struct {
+	user  string
+	alloc float64
+}
 
-	if len(output) == 0 {
-		return make(map[string]float64)
+// TopGPUsUsers keeps the n users with the most allocated GPUs of each
+// type, sorted by decreasing allocation (then by name for the ties).
+func TopGPUsUsers(by_user map[string]map[string]float64, n int) map[string][]GPUsUserAlloc {
+	top := make(map[string][]GPUsUserAlloc)
+	for gpu_type, users := range by_user {
+		ranking := make([]GPUsUserAlloc, 0, len(users))
+		for user, alloc := range users {
+			ranking = append(ranking, GPUsUserAlloc{user, alloc})
+		}
+		sort.Slice(ranking, func(i, j int) bool {
+			if ranking[i].alloc != ranking[j].alloc {
+				return ranking[i].alloc > ranking[j].alloc
+			}
+			return ranking[i].user < ranking[j].user
+		})
+		if len(ranking) > n {
+			ranking = ranking[:n]
+		}
+		top[gpu_type] = ranking
 	}
+	return top
+}
 
-	for _, line := range strings.Split(output, "\n") {
+// ParseTRES splits a TRES string into a map of resource name to count,
+// e.g. "cpu=1,gres/gpu:a100=2,mem=100G,node=1". Counts with a unit suffix
+// (like mem=100G) are converted to bytes, the index annotations of some
+// versions (like gres/gpu:a100=2(IDX:0-1)) are ignored and values which
+// are not counts are skipped.
+func ParseTRES(tres string, pe *ParseErrors) map[string]float64 {
+	resources := make(map[string]float64)
+	// Index annotations contain commas, e.g. gres/gpu:a100=2(IDX:0,1)
+	for _, resource := range SplitGres(tres) {
+		// Some configurations print spaces around the resources, tokens
+		// without a count (e.g. a bare "gres/gpu") are skipped
+		values := strings.Split(strings.TrimSpace(resource), "=")
+		if len(values) < 2 {
+			continue
+		}
+		if i := strings.Index(values[1], "("); i >= 0 {
+			values[1] = values[1][:i]
+		}
+		count, ok := ParseGresCount(values[1])
+		if !ok {
+			pe.Report("TRES count %q", resource)
+			continue
+		}
+		resources[strings.TrimSpace(values[0])] += count
+	}
+	return resources
+}
+
+// Execute the sinfo command and return the gres of every node, with
+// either the format (-o) or the long format (-O) options
+func TotalGPUsData() ([]byte, error) {
+	if *gpuSource == "sinfo-long" {
+		// The long format is more stable across Slurm versions, its
+		// columns are unbounded (:.) and delimited, as a NodeHost wider
+		// than the 20 characters by default runs into the gres
+		return ExecuteError("sinfo", []string{"-N", "-h", "-O", "NodeHost:.|,Gres:."})
+	}
+	// A fixed delimiter keeps an empty gres column as an empty field
+	args := []string{"-h", "-o", "%n|%G"}
+	return ExecuteError("sinfo", args)
+}
+
+// GPUs of the sinfo output of TotalGPUsData, parsed in one pass so that a
+// malformed line is reported once per scrape
+type SinfoGPUs struct {
+	// Consumable GPUs and nodes having them by type
+	total map[string]float64
+	nodes map[string]float64
+	// GPUs configured as no_consume by type, and their types by node
+	noConsume      map[string]float64
+	noConsumeNodes map[string]map[string]bool
+}
+
+// ParseTotalGPUs sums the consumable GPUs of every node by type
+func ParseTotalGPUs(input []byte, pe *ParseErrors) map[string]float64 {
+	return ParseSinfoGPUs(input, pe).total
+}
+
+// ParseGPUNodes counts the nodes advertising consumable GPUs by type
+func ParseGPUNodes(input []byte, pe *ParseErrors) map[string]float64 {
+	return ParseSinfoGPUs(input, pe).nodes
+}
+
+// ParseNoConsumeGPUs sums the GPUs configured as no_consume: jobs can
+// request them but they are never used up, so they don't count as total
+// or allocated GPUs.
+func ParseNoConsumeGPUs(input []byte, pe *ParseErrors) map[string]float64 {
+	return ParseSinfoGPUs(input, pe).noConsume
+}
+
+// The GPU types of a gres which are no_consume
+func noConsumeTypes(gres string) map[string]bool {
+	types := make(map[string]bool)
+	for _, resource := range SplitGres(gres) {
+		if gpu, ok, err := parseGPUGres(resource); err == nil && ok && gpu.no_consume {
+			types[gpu.gpu_type] = true
+		}
+	}
+	return types
+}
+
+// SplitSinfoFields splits a line of sinfo on the "|" delimiter of the
+// format, or on the spaces of the columns otherwise. Columns like the
+// reason (%E) contain spaces, so only the delimiter keeps the fields
+// after them in place, e.g. "gpu02|Not responding|gpu:a100:4".
+func SplitSinfoFields(line string) []string {
+	if !strings.Contains(line, "|") {
+		return strings.Fields(line)
+	}
+	fields := strings.Split(line, "|")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	return fields
+}
+
+// ParseSinfoGPUs returns the consumable and no_consume GPUs of every type
+// and the nodes having them
+func ParseSinfoGPUs(input []byte, pe *ParseErrors) SinfoGPUs {
+	gpus := SinfoGPUs{
+		total:          make(map[string]float64),
+		nodes:          make(map[string]float64),
+		noConsume:      make(map[string]float64),
+		noConsumeNodes: make(map[string]map[string]bool),
+	}
+	nodes := make(map[string]bool)
+	for _, line := range strings.Split(string(input), "\n") {
 		if len(line) == 0 {
 			continue
 		}
+		parseSinfoGPUsLine(line, gpus, nodes, pe)
+	}
+	return gpus
+}
 
-		line = strings.Trim(line, "\"")
-		gres := strings.Fields(line)[1]
-		// gres column format: comma-delimited list of resources
-		for _, resource := range strings.Split(gres, ",") {
-			if strings.HasPrefix(resource, "gpu:") {
-				// format: gpu:<type>:N(S:<something>), e.g. gpu:RTX2070:2(S:0)
-				descriptor := strings.Split(resource, ":")[2] // 2(S:0)
-				descriptor = strings.Split(descriptor, "(")[0] // 2
-				node_gpus, _ :=  strconv.ParseFloat(descriptor, 64)
+// parseSinfoGPUsLine adds the GPUs of a line of sinfo to the maps of
+// ParseSinfoGPUs. A malformed line (e.g. a truncated output) is skipped
+// as a whole, so that the GPUs of the other nodes are still counted.
+func parseSinfoGPUsLine(line string, gpus SinfoGPUs, nodes map[string]bool, pe *ParseErrors) {
+	defer pe.Recover(line)
 
-				type_gpu := strings.Split(resource, ":")[1] // RTX2070
-				gpu_map[type_gpu] += node_gpus
+	// node|gres, e.g. gpu01|gpu:a100:4(S:0-1), or the columns of
+	// the long format, e.g. "gpu01       gpu:a100:4(S:0-1)"
+	fields := SplitSinfoFields(line)
+	if len(fields) < 2 {
+		pe.Report("sinfo line %q, no gres", line)
+		return
+	}
+	// With -N a node in several partitions has several lines
+	node := strings.TrimSpace(fields[0])
+	if nodes[node] {
+		return
+	}
+	gres := strings.TrimSpace(fields[1])
+	// gres column format: comma-delimited list of resources, heterogeneous
+	// nodes list one resource per GPU type, e.g.
+	// gpu:a100:2(S:0,1),gpu:v100:1(S:1)
+	node_gpus := []GPUGres{}
+	for _, resource := range SplitGres(gres) {
+		gpu, ok, err := parseGPUGres(resource)
+		if err != nil {
+			// Rather than a part of the GPUs of the node
+			pe.Report("sinfo line %q, %v", line, err)
+			return
+		}
+		if ok {
+			node_gpus = append(node_gpus, gpu)
+		}
+	}
+	nodes[node] = true
+	node_types := make(map[string]bool)
+	for _, gpu := range node_gpus {
+		if gpu.no_consume {
+			gpus.noConsume[gpu.gpu_type] += gpu.count
+			if gpus.noConsumeNodes[node] == nil {
+				gpus.noConsumeNodes[node] = make(map[string]bool)
+			}
+			gpus.noConsumeNodes[node][gpu.gpu_type] = true
+			continue
+		}
+		gpus.total[gpu.gpu_type] += gpu.count
+		node_types[gpu.gpu_type] = true
+	}
+	for gpu_type := range node_types {
+		gpus.nodes[gpu_type]++
+	}
+}
+
+// Execute scontrol to get the full node configuration, one node per line.
+// The GPU, tmpdisk, reservation and node collectors of a scrape share the
+// dump, see ExecuteShared.
+func ScontrolNodesData() ([]byte, error) {
+	return ExecuteShared("scontrol", []string{"show", "node", "-o"})
+}
+
+// ParseScontrolFields splits a "scontrol -o" line into its key=value pairs.
+// Values may contain spaces (e.g. OS= or Reason=), so a token without a
+// key is appended to the value of the previous key.
+func ParseScontrolFields(line string) map[string]string {
+	fields := make(map[string]string)
+	key := ""
+	for _, token := range strings.Fields(line) {
+		i := strings.Index(token, "=")
+		if i > 0 && !strings.ContainsAny(token[:i], "()[]/:,") {
+			key = token[:i]
+			fields[key] = token[i+1:]
+		} else if key != "" {
+			fields[key] += " " + token
+		}
+	}
+	return fields
+}
+
+// SplitGres splits a comma-delimited gres list, keeping commas inside
+// parentheses, e.g. "gpu:a100:2(S:0,1),gpu:v100:1(S:1)"
+func SplitGres(gres string) []string {
+	var resources []string
+	depth := 0
+	start := 0
+	for i, c := range gres {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				resources = append(resources, gres[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(resources, gres[start:])
+}
+
+// A GPU resource of a node gres list
+type GPUGres struct {
+	gpu_type   string
+	count      float64
+	no_consume bool
+}
+
+// ParseGPUGres extracts type and count from a gres resource of the
+// format gpu:<type>:N(S:<something>), e.g. gpu:RTX2070:2(S:0), or
+// gpu:<type>:no_consume:N for GPUs which are not consumable. Newer Slurm
+// versions may add more parenthesized groups, e.g. (S:0)(Links=-1,0), and
+// flag fields between the type and the count, which are skipped.
+func ParseGPUGres(resource string, pe *ParseErrors) (GPUGres, bool) {
+	gpu, ok, err := parseGPUGres(resource)
+	if err != nil {
+		pe.Report("%v", err)
+	}
+	return gpu, ok
+}
+
+// parseGPUGres is ParseGPUGres returning the malformed GPU resources as
+// an error instead of reporting them. Resources which are not GPUs or
+// GPUs without a type are no error.
+func parseGPUGres(resource string) (GPUGres, bool, error) {
+	var gpu GPUGres
+	resource = strings.TrimSpace(resource)
+	if !strings.HasPrefix(resource, "gpu:") {
+		return gpu, false, nil
+	}
+	descriptor := strings.Split(resource, "(")[0] // gpu:RTX2070:2
+	values := strings.Split(descriptor, ":")
+	if len(values) < 3 {
+		return gpu, false, nil
+	}
+	for _, value := range values[2:] {
+		if value == "no_consume" {
+			gpu.no_consume = true
+			continue
+		}
+		count, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			continue
+		}
+		// e.g. a NaN or a sign, which strconv parses as counts
+		if count < 0 || math.IsNaN(count) || math.IsInf(count, 0) {
+			return gpu, false, fmt.Errorf("gres %q, invalid GPU count", resource)
+		}
+		gpu.gpu_type = values[1]
+		gpu.count = count
+		return gpu, true, nil
+	}
+	return gpu, false, fmt.Errorf("gres %q, no GPU count", resource)
+}
+
+// ParseConfiguredGPUs sums the GPUs in the Gres= field of every node,
+// whatever the node state, so down nodes are still accounted for.
+func ParseConfiguredGPUs(input []byte, pe *ParseErrors) map[string]float64 {
+	gpu_map := make(map[string]float64)
+
+	for _, line := range strings.Split(string(input), "\n") {
+		gres, ok := ParseScontrolFields(line)["Gres"]
+		if !ok {
+			continue
+		}
+		for _, resource := range SplitGres(gres) {
+			if gpu, ok := ParseGPUGres(resource, pe); ok {
+				gpu_map[gpu.gpu_type] += gpu.count
+			}
+		}
+	}
+
+	return gpu_map
+}
+
+// ParseNodeGPUs returns the GPUs in the Gres= field of every node by type,
+// e.g. ["gpu03"]["v100"]. Non-consumable GPUs are skipped, like in
+// ParseNodeIdleGPUs, so that the idle GPUs never exceed the total.
+func ParseNodeGPUs(input []byte, pe *ParseErrors) map[string]map[string]float64 {
+	nodes := make(map[string]map[string]float64)
+
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := ParseScontrolFields(line)
+		for _, resource := range SplitGres(fields["Gres"]) {
+			gpu, ok := ParseGPUGres(resource, pe)
+			if !ok || gpu.no_consume {
+				continue
+			}
+			if nodes[fields["NodeName"]] == nil {
+				nodes[fields["NodeName"]] = make(map[string]float64)
+			}
+			nodes[fields["NodeName"]][gpu.gpu_type] += gpu.count
+		}
+	}
+
+	return nodes
+}
+
+// ParseNodeIdleGPUs returns the GPUs in the Gres= field of every node
+// which are not part of its AllocTRES= by type, like ParseNodeGPUs.
+// Non-consumable GPUs are never allocated, so they are skipped.
+func ParseNodeIdleGPUs(input []byte, pe *ParseErrors) map[string]map[string]float64 {
+	nodes := make(map[string]map[string]float64)
+
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := ParseScontrolFields(line)
+		alloc := ParseTRES(fields["AllocTRES"], pe)
+		for _, resource := range SplitGres(fields["Gres"]) {
+			gpu, ok := ParseGPUGres(resource, pe)
+			if !ok || gpu.no_consume {
+				continue
+			}
+			if nodes[fields["NodeName"]] == nil {
+				nodes[fields["NodeName"]] = make(map[string]float64)
+			}
+			idle := gpu.count - alloc["gres/gpu:"+gpu.gpu_type]
+			if idle < 0 {
+				idle = 0
+			}
+			nodes[fields["NodeName"]][gpu.gpu_type] += idle
+		}
+	}
+
+	return nodes
+}
+
+// ParseGresMismatch flags the GPU nodes whose AllocTRES= references a GPU
+// type missing from their Gres=, usually a slurm.conf left behind after a
+// hardware swap: 1 for a mismatch, 0 otherwise.
+func ParseGresMismatch(input []byte, pe *ParseErrors) map[string]float64 {
+	nodes := make(map[string]float64)
+
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := ParseScontrolFields(line)
+		node, ok := fields["NodeName"]
+		if !ok {
+			continue
+		}
+		configured := make(map[string]bool)
+		for _, resource := range SplitGres(fields["Gres"]) {
+			if gpu, ok := ParseGPUGres(resource, pe); ok {
+				configured[gpu.gpu_type] = true
+			}
+		}
+		mismatch := false
+		allocated := false
+		for resource := range ParseTRES(fields["AllocTRES"], pe) {
+			if strings.HasPrefix(resource, "gres/gpu:") {
+				allocated = true
+				if !configured[strings.TrimPrefix(resource, "gres/gpu:")] {
+					mismatch = true
+				}
+			}
+		}
+		if len(configured) == 0 && !allocated {
+			continue
+		}
+		nodes[node] = 0
+		if mismatch {
+			nodes[node] = 1
+		}
+	}
+
+	return nodes
+}
+
+// ParseIdleGPUsFromScontrol computes the idle GPUs by type as reported by
+// the controller: on every node the GPUs in Gres= which are not part of
+// AllocTRES=. Non-consumable GPUs are never allocated, so they are skipped.
+func ParseIdleGPUsFromScontrol(input []byte, pe *ParseErrors) map[string]float64 {
+	gpu_map := make(map[string]float64)
+
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := ParseScontrolFields(line)
+		gres, ok := fields["Gres"]
+		if !ok {
+			continue
+		}
+		alloc := ParseTRES(fields["AllocTRES"], pe)
+		for _, resource := range SplitGres(gres) {
+			gpu, ok := ParseGPUGres(resource, pe)
+			if !ok || gpu.no_consume {
+				continue
+			}
+			idle := gpu.count - alloc["gres/gpu:"+gpu.gpu_type]
+			if idle > 0 {
+				gpu_map[gpu.gpu_type] += idle
+			} else if _, ok := gpu_map[gpu.gpu_type]; !ok {
+				gpu_map[gpu.gpu_type] = 0
 			}
 		}
 	}
@@ -105,6 +1036,97 @@ func ParseTotalGPUs() map[string]float64 {
 	return gpu_map
 }
 
+// ParseCPUBlockedGPUs sums by type the idle GPUs of the nodes without
+// idle CPUs: no job can start on them, whatever the free GPUs. The CPUs
+// of a node are its CPUEfctv= (without the CPUs of the specialized
+// cores), or its CPUTot= before Slurm 23.02.
+func ParseCPUBlockedGPUs(input []byte, pe *ParseErrors) map[string]float64 {
+	gpu_map := make(map[string]float64)
+
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := ParseScontrolFields(line)
+		gres, ok := fields["Gres"]
+		if !ok {
+			continue
+		}
+		cpus, ok := fields["CPUEfctv"]
+		if !ok {
+			cpus = fields["CPUTot"]
+		}
+		total, err := strconv.ParseFloat(cpus, 64)
+		if err != nil {
+			continue
+		}
+		alloc_cpus, _ := strconv.ParseFloat(fields["CPUAlloc"], 64)
+		blocked := total-alloc_cpus <= 0
+		alloc := ParseTRES(fields["AllocTRES"], pe)
+		for _, resource := range SplitGres(gres) {
+			gpu, ok := ParseGPUGres(resource, pe)
+			if !ok || gpu.no_consume {
+				continue
+			}
+			idle := gpu.count - alloc["gres/gpu:"+gpu.gpu_type]
+			if blocked && idle > 0 {
+				gpu_map[gpu.gpu_type] += idle
+			} else if _, ok := gpu_map[gpu.gpu_type]; !ok {
+				gpu_map[gpu.gpu_type] = 0
+			}
+		}
+	}
+
+	return gpu_map
+}
+
+// ParseGresTypes returns the gres names of the GresTypes= of the
+// configuration, e.g. [gpu tmpdisk] for GresTypes = gpu,tmpdisk
+func ParseGresTypes(config map[string]string) []string {
+	types := []string{}
+	for _, name := range strings.Split(config["GresTypes"], ",") {
+		if name = strings.TrimSpace(name); name != "" && name != "(null)" {
+			types = append(types, name)
+		}
+	}
+	return types
+}
+
+// SeedGPUTypes returns the GPU types configured on the nodes, sorted, if
+// gpu is one of the GresTypes of the configuration. GresTypes only names
+// the gres, the types come from the Gres= of the nodes, down or not.
+func SeedGPUTypes(config []byte, nodes []byte, pe *ParseErrors) []string {
+	gpu := false
+	for _, name := range ParseGresTypes(ParseSlurmConfig(config)) {
+		gpu = gpu || name == "gpu"
+	}
+	types := []string{}
+	if !gpu {
+		return types
+	}
+	for gpu_type := range ParseConfiguredGPUs(nodes, pe) {
+		types = append(types, gpu_type)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// GPUsUtilization is the ratio of the allocated GPUs, as a percentage
+// with -gpu.utilization-percent, rounded to -gpu.utilization-precision
+func GPUsUtilization(alloc float64, total float64) float64 {
+	utilization := alloc / total
+	if *gpuUtilizationPercent {
+		utilization *= 100
+	}
+	return RoundDecimals(utilization, *gpuUtilizationPrecision)
+}
+
+// RoundDecimals rounds the value to the given number of decimals, a
+// negative number keeps the full precision
+func RoundDecimals(value float64, decimals int) float64 {
+	if decimals < 0 {
+		return value
+	}
+	scale := math.Pow(10, float64(decimals))
+	return math.Round(value*scale) / scale
+}
 
 // slurm_gpus_alloc{type="k80"} 4
 // slurm_gpus_alloc{type="a100"} 20
@@ -117,65 +1139,247 @@ func ParseTotalGPUs() map[string]float64 {
 // ...
 // slurm_gpus_utilization{type="k80"} = 0.16666 (calculated value = alloc/total)
 // slurm_gpus_utilization{type="a100"} = 0.83333
-func ParseGPUsMetrics() map[string]*GPUsMetrics {
+func ParseGPUsMetrics(gpus SinfoGPUs, squeue []byte, pe *ParseErrors) map[string]*GPUsMetrics {
 	types := make(map[string]*GPUsMetrics)
 
-	totals := ParseTotalGPUs()
-	alloc := ParseAllocatedGPUs()
+	totals := gpus.total
+	alloc := ParseAllocatedGPUs(squeue, pe)
 
 	// TODO: Make sure keys in totals and alloc are the same
 
 	for gpu_type := range totals {
-		types[gpu_type] = &GPUsMetrics{0, 0, 0, 0}
+		if !gpuTypeFilter.Allowed(gpu_type) {
+			continue
+		}
+		types[gpu_type] = &GPUsMetrics{0, 0, 0, 0, 0, 0}
 
 		types[gpu_type].alloc = alloc[gpu_type]
 		types[gpu_type].total = totals[gpu_type]
 		types[gpu_type].idle = totals[gpu_type] - alloc[gpu_type]
-		types[gpu_type].utilization = alloc[gpu_type] / totals[gpu_type]
+		// A parsing issue or a race of Slurm, a negative idle count would
+		// show up as a spike on the dashboards
+		if alloc[gpu_type] > totals[gpu_type] {
+			types[gpu_type].idle = 0
+			types[gpu_type].exceeds = 1
+		}
+		types[gpu_type].utilization = GPUsUtilization(alloc[gpu_type], totals[gpu_type])
+	}
+
+	// Jobs holding no_consume GPUs are not using them up, so these
+	// types are left out of the allocated GPUs
+	for gpu_type, count := range gpus.noConsume {
+		if !gpuTypeFilter.Allowed(gpu_type) {
+			continue
+		}
+		if _, ok := types[gpu_type]; !ok {
+			types[gpu_type] = &GPUsMetrics{0, 0, 0, 0, 0, 0}
+		}
+		types[gpu_type].no_consume = count
 	}
 
 	return types
 }
 
-// Execute the sinfo command and return its output
-func Execute(command string, arguments []string) []byte {
-	cmd := exec.Command(command, arguments...)
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
+// GPUsAllocChanges counts the changes of the allocated GPUs of every type
+// between consecutive scrapes, a high rate points at many short jobs.
+type GPUsAllocChanges struct {
+	mu      sync.Mutex
+	last    map[string]float64
+	changes map[string]float64
+}
+
+func NewGPUsAllocChanges() *GPUsAllocChanges {
+	return &GPUsAllocChanges{
+		last:    make(map[string]float64),
+		changes: make(map[string]float64),
 	}
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
+}
+
+// Observe compares the allocated GPUs of every type to the previous
+// scrape and returns a copy of the counts. Types seen for the first time
+// are not counted as a change.
+func (ac *GPUsAllocChanges) Observe(alloc map[string]float64) map[string]float64 {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	for gpu_type, count := range alloc {
+		if previous, ok := ac.last[gpu_type]; ok && previous != count {
+			ac.changes[gpu_type]++
+		} else if _, ok := ac.changes[gpu_type]; !ok {
+			ac.changes[gpu_type] = 0
+		}
+	}
+	ac.last = alloc
+	changes := make(map[string]float64, len(ac.changes))
+	for gpu_type, count := range ac.changes {
+		changes[gpu_type] = count
 	}
-	out, _ := ioutil.ReadAll(stdout)
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
+	return changes
+}
+
+// Upper bound on the samples kept per GPU type, whatever the window and
+// scrape interval are.
+const maxPeakSamples = 4096
+
+type peakSample struct {
+	at    time.Time
+	value float64
+}
+
+// GPUsPeakTracker keeps a sliding window of allocation samples per GPU type,
+// so the peak over the window can be exposed without querying Prometheus.
+type GPUsPeakTracker struct {
+	mu      sync.Mutex
+	window  time.Duration
+	samples map[string][]peakSample
+}
+
+func NewGPUsPeakTracker(window time.Duration) *GPUsPeakTracker {
+	return &GPUsPeakTracker{
+		window:  window,
+		samples: make(map[string][]peakSample),
 	}
-	return out
 }
 
-/*
- * Implement the Prometheus Collector interface and feed the
- * Slurm scheduler metrics into it.
- * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
- */
+// Add records a sample and drops the ones which fell out of the window
+func (pt *GPUsPeakTracker) Add(gpu_type string, value float64, now time.Time) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	samples := append(pt.expire(pt.samples[gpu_type], now), peakSample{now, value})
+	if len(samples) > maxPeakSamples {
+		samples = samples[len(samples)-maxPeakSamples:]
+	}
+	pt.samples[gpu_type] = samples
+}
+
+// Peak returns the highest sample seen within the window
+func (pt *GPUsPeakTracker) Peak(gpu_type string, now time.Time) float64 {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	samples := pt.expire(pt.samples[gpu_type], now)
+	pt.samples[gpu_type] = samples
+	peak := float64(0)
+	for _, s := range samples {
+		if s.value > peak {
+			peak = s.value
+		}
+	}
+	return peak
+}
+
+// Samples are appended in time order, so everything before the first
+// sample still inside the window can be dropped at once.
+func (pt *GPUsPeakTracker) expire(samples []peakSample, now time.Time) []peakSample {
+	start := now.Add(-pt.window)
+	i := 0
+	for i < len(samples) && samples[i].at.Before(start) {
+		i++
+	}
+	return samples[i:]
+}
+
+// FormatWindow renders a duration the way it is usually written in a
+// Prometheus query, e.g. "1h" or "90m" rather than "1h0m0s".
+func FormatWindow(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
 
 func NewGPUsCollector() *GPUsCollector {
 	labels := []string{"type"}
+	utilizationHelp := "Total GPU utilization by type, from 0 to 1"
+	if *gpuUtilizationPercent {
+		utilizationHelp = "Total GPU utilization by type, in percent"
+	}
+	pe := &ParseErrors{}
 
 	return &GPUsCollector{
-		alloc: prometheus.NewDesc("slurm_gpus_alloc", "Allocated GPUs by type", labels, nil),
-		idle:  prometheus.NewDesc("slurm_gpus_idle", "Idle GPUs by type", labels, nil),
-		total: prometheus.NewDesc("slurm_gpus_total", "Total GPUs by type", labels, nil),
-		utilization: prometheus.NewDesc("slurm_gpus_utilization", "Total GPU utilization by type", labels, nil),
+		alloc:            NewDesc("slurm_gpus_alloc", "Allocated GPUs by type", labels, nil),
+		idle:             NewDesc("slurm_gpus_idle", "Idle GPUs by type", labels, nil),
+		total:            NewDesc("slurm_gpus_total", "Total GPUs by type", labels, nil),
+		utilization:      NewDesc("slurm_gpus_utilization", utilizationHelp, labels, nil),
+		allocSuspended:   NewDesc("slurm_gpus_alloc_suspended", "GPUs held by suspended jobs by type", labels, nil),
+		noConsume:        NewDesc("slurm_gpus_no_consume", "Non-consumable (no_consume) GPUs by type, not accounted as allocated", labels, nil),
+		allocNoConsume:   NewDesc("slurm_gpus_alloc_no_consume", "Non-consumable (no_consume) GPUs held by jobs by type, not accounted as allocated", labels, nil),
+		configured:       NewDesc("slurm_gpus_configured", "Configured GPUs by type, including nodes which are down", labels, nil),
+		allocPeak:        NewDesc("slurm_gpus_alloc_peak", "Peak of allocated GPUs by type within the sliding window", []string{"type", "window"}, nil),
+		topUser:          NewDesc("slurm_gpus_alloc_top_user", "Allocated GPUs of the users with the most GPUs by type", []string{"rank", "user", "type"}, nil),
+		allocInteractive: NewDesc("slurm_gpus_alloc_interactive", "GPUs allocated to interactive sessions by type", labels, nil),
+		perNodeAvg:       NewDesc("slurm_gpus_per_node_avg", "Average GPUs per node advertising the type", labels, nil),
+		jobsBySize:       NewDesc("slurm_gpu_jobs_by_size", "Running jobs by GPU type and number of GPUs held", []string{"type", "size"}, nil),
+		gresMismatch:     NewDesc("slurm_node_gres_mismatch", "Whether the node has GPUs allocated of a type missing from its configured Gres", []string{"node"}, nil),
+		types:            NewDesc("slurm_gpu_types_total", "Number of distinct GPU types", nil, nil),
+		allocAll:         NewDesc("slurm_gpus_alloc_all", "Allocated GPUs of all types", nil, nil),
+		idleAll:          NewDesc("slurm_gpus_idle_all", "Idle GPUs of all types", nil, nil),
+		totalAll:         NewDesc("slurm_gpus_total_all", "Total GPUs of all types", nil, nil),
+		oversubscribed:   NewDesc("slurm_gpus_oversubscribed", "GPUs held by running and suspended jobs beyond the total by type, with gang scheduling", labels, nil),
+		jobsWrongType:    NewDesc("slurm_gpu_jobs_wrong_type", "Running jobs which requested a GPU type but got GPUs of another type", []string{"requested", "allocated"}, nil),
+		planned:          NewDesc("slurm_gpus_planned", "GPUs requested by pending jobs planned to start within the window by type", []string{"type", "window"}, nil),
+		allocExceeds:     NewDesc("slurm_gpus_alloc_exceeds_total", "Whether more GPUs of the type are allocated than there are in total", labels, nil),
+		allocByTimeLimit: NewDesc("slurm_gpus_alloc_by_timelimit", "Allocated GPUs by type and time limit of the jobs holding them", []string{"bucket", "type"}, nil),
+		totalByFeature:   NewDesc("slurm_gpus_feature_total", "Total GPUs by type of the nodes having the feature", []string{"feature", "type"}, nil),
+		allocChanges:     NewDesc("slurm_gpus_alloc_changes_total", "Changes of the allocated GPUs by type between consecutive scrapes", labels, nil),
+		idleCPUBlocked:   NewDesc("slurm_gpus_idle_cpu_blocked", "Idle GPUs by type of the nodes without idle CPUs, which can not start a job", labels, nil),
+		pendingJobs:      NewDesc("slurm_gpus_pending_jobs", "Pending jobs requesting GPUs by type", labels, nil),
+		parseErrorsTotal: NewDesc("slurm_gpus_parse_errors_total", "Malformed lines and gres of the Slurm commands skipped by the parsers", nil, nil),
+		parseError:       NewDesc("slurm_exporter_parse_error", "Malformed output of the Slurm commands, only collected with strict parsing", nil, nil),
+		parseErrors:      pe,
+		peak:             NewGPUsPeakTracker(*gpuPeakWindow),
+		topUsers:         *gpuTopUsers,
+		idleSource:       *gpuIdleSource,
+		allocStates:      *gpuAllocStates,
+
+		plannedWindow: *gpuPlannedWindow,
+		changes:       NewGPUsAllocChanges(),
+		seed:          *gpuSeedTypes,
 	}
 }
 
 type GPUsCollector struct {
-	alloc       *prometheus.Desc
-	idle        *prometheus.Desc
-	total       *prometheus.Desc
-	utilization *prometheus.Desc
+	alloc            *prometheus.Desc
+	idle             *prometheus.Desc
+	total            *prometheus.Desc
+	utilization      *prometheus.Desc
+	allocSuspended   *prometheus.Desc
+	noConsume        *prometheus.Desc
+	allocNoConsume   *prometheus.Desc
+	configured       *prometheus.Desc
+	allocPeak        *prometheus.Desc
+	topUser          *prometheus.Desc
+	allocInteractive *prometheus.Desc
+	perNodeAvg       *prometheus.Desc
+	jobsBySize       *prometheus.Desc
+	gresMismatch     *prometheus.Desc
+	types            *prometheus.Desc
+	allocAll         *prometheus.Desc
+	idleAll          *prometheus.Desc
+	totalAll         *prometheus.Desc
+	totalByFeature   *prometheus.Desc
+	oversubscribed   *prometheus.Desc
+	jobsWrongType    *prometheus.Desc
+	planned          *prometheus.Desc
+	allocByTimeLimit *prometheus.Desc
+	allocExceeds     *prometheus.Desc
+	allocChanges     *prometheus.Desc
+	idleCPUBlocked   *prometheus.Desc
+	pendingJobs      *prometheus.Desc
+	parseErrorsTotal *prometheus.Desc
+	parseError       *prometheus.Desc
+	parseErrors      *ParseErrors
+	peak             *GPUsPeakTracker
+	topUsers         int
+	idleSource       string
+	allocStates      string
+	plannedWindow    time.Duration
+	changes          *GPUsAllocChanges
+	seed             bool
+	seedOnce         sync.Once
+	seedTypes        []string
 }
 
 // Send all metric descriptions
@@ -184,117 +1388,430 @@ func (cc *GPUsCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- cc.idle
 	ch <- cc.total
 	ch <- cc.utilization
+	ch <- cc.allocSuspended
+	ch <- cc.noConsume
+	ch <- cc.allocNoConsume
+	ch <- cc.configured
+	ch <- cc.allocPeak
+	ch <- cc.topUser
+	ch <- cc.allocInteractive
+	ch <- cc.perNodeAvg
+	ch <- cc.jobsBySize
+	ch <- cc.gresMismatch
+	ch <- cc.types
+	ch <- cc.allocAll
+	ch <- cc.idleAll
+	ch <- cc.totalAll
+	ch <- cc.totalByFeature
+	ch <- cc.oversubscribed
+	ch <- cc.jobsWrongType
+	ch <- cc.planned
+	ch <- cc.allocByTimeLimit
+	ch <- cc.allocExceeds
+	ch <- cc.allocChanges
+	ch <- cc.idleCPUBlocked
+	ch <- cc.pendingJobs
+	ch <- cc.parseErrorsTotal
+	ch <- cc.parseError
 }
 func (cc *GPUsCollector) Collect(ch chan<- prometheus.Metric) {
-	cm := GPUsGetMetrics()
+	// A single squeue for every breakdown of the jobs: the allocated and
+	// the suspended GPUs, the jobs by size, time limit, name and user, the
+	// requested types and the pending jobs. sinfo for the totals and the
+	// features, scontrol for the nodes.
+	allocStates := strings.Split(cc.allocStates, ",")
+	jobs, err := TRESAllocData(JobStates(cc.allocStates))
+	if err != nil {
+		// Rather than no GPU allocated, which looks like an idle cluster
+		ch <- prometheus.NewInvalidMetric(cc.alloc, err)
+		return
+	}
+	sinfo, err := TotalGPUsData()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(cc.total, err)
+		return
+	}
+	// The jobs holding no_consume GPUs are not using them up
+	gpus := ParseSinfoGPUs(sinfo, cc.parseErrors)
+	noConsume := gpus.noConsumeNodes
+	running, runningNoConsume := SelectConsumedTRES(jobs, allocStates, noConsume)
+	allocated := SelectJobs(jobs, allocStates, nil)
+	pending := SelectJobs(jobs, []string{"PENDING"}, nil)
+	scontrol, err := ScontrolNodesData()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(cc.configured, err)
+		return
+	}
+	// The types are seeded once, from the node dump of the first scrape
+	if cc.seed {
+		cc.seedOnce.Do(func() {
+			cc.seedTypes = SeedGPUTypes(SlurmConfigData(), scontrol, cc.parseErrors)
+			log.Infof("GPU types seeded from the configuration: %s", strings.Join(cc.seedTypes, ", "))
+		})
+	}
+	features, err := FeatureTotalGPUsData()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(cc.totalByFeature, err)
+		return
+	}
+	cm := ParseGPUsMetrics(gpus, running, cc.parseErrors)
+	// The seeded types without any node left are reported with 0 GPUs
+	for _, gpu_type := range cc.seedTypes {
+		if _, ok := cm[gpu_type]; !ok && gpuTypeFilter.Allowed(gpu_type) {
+			cm[gpu_type] = &GPUsMetrics{0, 0, 0, 0, 0, 0}
+		}
+	}
+	if cc.idleSource == "scontrol" {
+		idle := ParseIdleGPUsFromScontrol(scontrol, cc.parseErrors)
+		for gpu_type := range cm {
+			cm[gpu_type].idle = idle[gpu_type]
+		}
+	}
+	// With gang scheduling suspended jobs keep their GPUs
+	suspendedTRES, _ := SelectConsumedTRES(jobs, []string{"SUSPENDED"}, noConsume)
+	suspended := ParseAllocatedGPUs(suspendedTRES, cc.parseErrors)
+	allocNoConsume := ParseAllocatedGPUs(runningNoConsume, cc.parseErrors)
+	now := time.Now()
+	window := FormatWindow(cc.peak.window)
+	// A new type often comes from a gres misconfiguration on a new node
+	ch <- prometheus.MustNewConstMetric(cc.types, prometheus.GaugeValue, float64(len(cm)))
+	var allocAll, idleAll, totalAll float64
 	for gpu_type := range cm {
+		allocAll += cm[gpu_type].alloc
+		idleAll += cm[gpu_type].idle
+		totalAll += cm[gpu_type].total
 		ch <- prometheus.MustNewConstMetric(cc.alloc, prometheus.GaugeValue, float64(cm[gpu_type].alloc), gpu_type)
 		ch <- prometheus.MustNewConstMetric(cc.idle, prometheus.GaugeValue, float64(cm[gpu_type].idle), gpu_type)
 		ch <- prometheus.MustNewConstMetric(cc.total, prometheus.GaugeValue, float64(cm[gpu_type].total), gpu_type)
 		ch <- prometheus.MustNewConstMetric(cc.utilization, prometheus.GaugeValue, float64(cm[gpu_type].utilization), gpu_type)
-	}
-}
-
-func ParsePartitionTotalGPUs() map[string]map[string]float64 {
-	result := make(map[string]map[string]float64)
-
-	args := []string{"-h", "-o", "%R %n %G"}
-	output := string(Execute("sinfo", args))
+		ch <- prometheus.MustNewConstMetric(cc.allocSuspended, prometheus.GaugeValue, suspended[gpu_type], gpu_type)
+		ch <- prometheus.MustNewConstMetric(cc.allocExceeds, prometheus.GaugeValue, cm[gpu_type].exceeds, gpu_type)
+		if cm[gpu_type].no_consume > 0 {
+			ch <- prometheus.MustNewConstMetric(cc.noConsume, prometheus.GaugeValue, cm[gpu_type].no_consume, gpu_type)
+			ch <- prometheus.MustNewConstMetric(cc.allocNoConsume, prometheus.GaugeValue, allocNoConsume[gpu_type], gpu_type)
+		}
 
-	if len(output) == 0 {
-		return result
+		cc.peak.Add(gpu_type, cm[gpu_type].alloc, now)
+		ch <- prometheus.MustNewConstMetric(cc.allocPeak, prometheus.GaugeValue, cc.peak.Peak(gpu_type, now), gpu_type, window)
 	}
-
-	for _, line := range strings.Split(output, "\n") {
-		if len(line) == 0 {
+	alloc := make(map[string]float64, len(cm))
+	for gpu_type := range cm {
+		alloc[gpu_type] = cm[gpu_type].alloc
+	}
+	for gpu_type, count := range cc.changes.Observe(alloc) {
+		ch <- prometheus.MustNewConstMetric(cc.allocChanges, prometheus.CounterValue, count, gpu_type)
+	}
+	// Suspended jobs may already be counted as allocated
+	held := suspended
+	if StateSet(allocStates)["SUSPENDED"] {
+		held = map[string]float64{}
+	}
+	for gpu_type, count := range OversubscribedGPUs(cm, held) {
+		ch <- prometheus.MustNewConstMetric(cc.oversubscribed, prometheus.GaugeValue, count, gpu_type)
+	}
+	ch <- prometheus.MustNewConstMetric(cc.allocAll, prometheus.GaugeValue, allocAll)
+	ch <- prometheus.MustNewConstMetric(cc.idleAll, prometheus.GaugeValue, idleAll)
+	ch <- prometheus.MustNewConstMetric(cc.totalAll, prometheus.GaugeValue, totalAll)
+	for gpu_type, nodes := range gpus.nodes {
+		if gpuTypeFilter.Allowed(gpu_type) {
+			ch <- prometheus.MustNewConstMetric(cc.perNodeAvg, prometheus.GaugeValue, gpus.total[gpu_type]/nodes, gpu_type)
+		}
+	}
+	for gpu_type, sizes := range ParseGPUJobsBySize(running, cc.parseErrors) {
+		if !gpuTypeFilter.Allowed(gpu_type) {
 			continue
 		}
-		fields := strings.Fields(line)
-		if len(fields) < 3 {
+		for size, count := range sizes {
+			ch <- prometheus.MustNewConstMetric(cc.jobsBySize, prometheus.GaugeValue, count, gpu_type, size)
+		}
+	}
+	for gpu_type, buckets := range ParseGPUsByTimeLimit(JobColumns(allocated, jobTimeLimit, jobTRES), cc.parseErrors) {
+		if !gpuTypeFilter.Allowed(gpu_type) {
 			continue
 		}
-		partition := fields[0]
-		gres := fields[2]
-
-		if !strings.HasPrefix(gres, "gpu:") {
+		for bucket, count := range buckets {
+			ch <- prometheus.MustNewConstMetric(cc.allocByTimeLimit, prometheus.GaugeValue, count, bucket, gpu_type)
+		}
+	}
+	plannedWindow := FormatWindow(cc.plannedWindow)
+	// The backfill scheduler sets the expected start time of the pending jobs
+	planned := JobColumns(pending, jobStartTime, jobNumNodes, jobPerJob, jobPerNode)
+	for gpu_type, count := range ParsePlannedGPUs(planned, now, cc.plannedWindow, cc.parseErrors) {
+		if gpuTypeFilter.Allowed(gpu_type) {
+			ch <- prometheus.MustNewConstMetric(cc.planned, prometheus.GaugeValue, count, gpu_type, plannedWindow)
+		}
+	}
+	for gpu_type, count := range ParsePendingGPUJobs(JobColumns(pending, jobPerJob, jobPerNode)) {
+		if gpuTypeFilter.Allowed(gpu_type) {
+			ch <- prometheus.MustNewConstMetric(cc.pendingJobs, prometheus.GaugeValue, count, gpu_type)
+		}
+	}
+	requested := JobColumns(SelectJobs(jobs, []string{"RUNNING"}, nil), jobPerJob, jobPerNode, jobTRES)
+	for request, types := range ParseWrongTypeGPUJobs(requested, cc.parseErrors) {
+		for gpu_type, count := range types {
+			ch <- prometheus.MustNewConstMetric(cc.jobsWrongType, prometheus.GaugeValue, count, request, gpu_type)
+		}
+	}
+	for gpu_type, count := range ParseInteractiveGPUs(JobColumns(allocated, jobName, jobCommand, jobTRES), cc.parseErrors) {
+		if !gpuTypeFilter.Allowed(gpu_type) {
 			continue
 		}
-		// format: gpu:<type>:<count> or gpu:<type>:<count>(S:...)
-		parts := strings.Split(gres, ":")
-		if len(parts) < 3 {
+		ch <- prometheus.MustNewConstMetric(cc.allocInteractive, prometheus.GaugeValue, count, gpu_type)
+	}
+	for feature, gpus := range ParseFeatureTotalGPUs(features, cc.parseErrors) {
+		for gpu_type, count := range gpus {
+			if gpuTypeFilter.Allowed(gpu_type) {
+				ch <- prometheus.MustNewConstMetric(cc.totalByFeature, prometheus.GaugeValue, count, feature, gpu_type)
+			}
+		}
+	}
+	for node, mismatch := range ParseGresMismatch(scontrol, cc.parseErrors) {
+		ch <- prometheus.MustNewConstMetric(cc.gresMismatch, prometheus.GaugeValue, mismatch, node)
+	}
+	for gpu_type, count := range ParseConfiguredGPUs(scontrol, cc.parseErrors) {
+		if !gpuTypeFilter.Allowed(gpu_type) {
 			continue
 		}
-		gpuType := parts[1]
-		countStr := strings.Split(parts[2], "(")[0]
-		count, _ := strconv.ParseFloat(countStr, 64)
-
-		if result[partition] == nil {
-			result[partition] = make(map[string]float64)
+		ch <- prometheus.MustNewConstMetric(cc.configured, prometheus.GaugeValue, count, gpu_type)
+	}
+	for gpu_type, count := range ParseCPUBlockedGPUs(scontrol, cc.parseErrors) {
+		if !gpuTypeFilter.Allowed(gpu_type) {
+			continue
 		}
-		result[partition][gpuType] += count
+		ch <- prometheus.MustNewConstMetric(cc.idleCPUBlocked, prometheus.GaugeValue, count, gpu_type)
 	}
-	return result
+	if cc.topUsers > 0 {
+		// Only the jobs of the given accounts if any
+		var accounts []string
+		if *userAccounts != "" {
+			accounts = strings.Split(*userAccounts, ",")
+		}
+		users := JobColumns(SelectJobs(jobs, allocStates, accounts), jobUser, jobTRES)
+		top := TopGPUsUsers(ParseAllocatedGPUsByUser(users, cc.parseErrors), cc.topUsers)
+		for gpu_type, ranking := range top {
+			if !gpuTypeFilter.Allowed(gpu_type) {
+				continue
+			}
+			for i, u := range ranking {
+				ch <- prometheus.MustNewConstMetric(cc.topUser, prometheus.GaugeValue, u.alloc, strconv.Itoa(i+1), u.user, gpu_type)
+			}
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(cc.parseErrorsTotal, prometheus.CounterValue, cc.parseErrors.Total())
+	// With strict parsing, the errors of all the GPU parsers since the
+	// previous scrape fail the scrape
+	if err := cc.parseErrors.Take(); err != nil {
+		ch <- prometheus.NewInvalidMetric(cc.parseError, err)
+	}
+}
+
+// Execute the sinfo command and return the gres and features of every node
+func FeatureTotalGPUsData() ([]byte, error) {
+	return ExecuteError("sinfo", []string{"-N", "-h", "-o", "%n|%G|%f"})
 }
 
-func ParsePartitionAllocatedGPUs() map[string]map[string]float64 {
+// ParseFeatureTotalGPUs sums the GPUs by node feature and type, a node
+// with several features is counted for every one of them
+func ParseFeatureTotalGPUs(input []byte, pe *ParseErrors) map[string]map[string]float64 {
 	result := make(map[string]map[string]float64)
+	nodes := make(map[string]bool)
+	for _, line := range strings.Split(string(input), "\n") {
+		// node|gres|features, e.g. gpu01|gpu:a100:4(S:0-1)|nvlink,ib
+		fields := SplitSinfoFields(line)
+		if len(fields) < 3 || fields[2] == "(null)" {
+			continue
+		}
+		// With -N a node in several partitions has several lines
+		if nodes[fields[0]] {
+			continue
+		}
+		nodes[fields[0]] = true
+		for _, resource := range SplitGres(fields[1]) {
+			gpu, ok := ParseGPUGres(resource, pe)
+			if !ok || gpu.no_consume {
+				continue
+			}
+			for _, feature := range strings.Split(fields[2], ",") {
+				if result[feature] == nil {
+					result[feature] = make(map[string]float64)
+				}
+				result[feature][gpu.gpu_type] += gpu.count
+			}
+		}
+	}
+	return result
+}
 
-	args := []string{"--state=RUNNING", "--noheader", "--Format=partition,tres-alloc:."}
-	output := string(Execute("squeue", args))
+// Execute the sinfo command and return the gres of every node by partition
+func PartitionTotalGPUsData() ([]byte, error) {
+	args := []string{"-h", "-o", "%R|%n|%G"}
+	return ExecuteError("sinfo", args)
+}
 
-	if len(output) == 0 {
-		return result
-	}
+// Partitions of every node of the output of PartitionTotalGPUsData in the
+// order of sinfo, and its gres
+type PartitionNodes struct {
+	nodes      []string
+	partitions NodePartitions
+	gres       map[string]string
+}
 
-	for _, line := range strings.Split(output, "\n") {
-		if len(line) == 0 {
+func parsePartitionNodes(input []byte) PartitionNodes {
+	pn := PartitionNodes{[]string{}, ParseNodePartitions(input), make(map[string]string)}
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := SplitSinfoFields(line)
+		if len(fields) < 3 {
 			continue
 		}
-		fields := strings.Fields(line)
-		if len(fields) < 2 {
-			continue
+		node := fields[1]
+		if _, ok := pn.gres[node]; !ok {
+			pn.nodes = append(pn.nodes, node)
 		}
-		partition := fields[0]
-		tres := fields[1]
+		pn.gres[node] = fields[2]
+	}
+	return pn
+}
 
-		for _, resource := range strings.Split(tres, ",") {
-			if strings.HasPrefix(resource, "gres/gpu:") {
-				descriptor := strings.TrimPrefix(resource, "gres/gpu:")
-				parts := strings.Split(descriptor, "=")
-				if len(parts) < 2 {
-					continue
-				}
-				gpuType := parts[0]
-				count, _ := strconv.ParseFloat(parts[1], 64)
+// Primary returns the partitions the GPUs of the node are counted in: all
+// of its partitions without precedence, else its primary partition
+func (pn PartitionNodes) Primary(node string, precedence []string) []string {
+	if len(precedence) > 0 && len(pn.partitions[node]) > 0 {
+		return []string{PrimaryPartition(pn.partitions[node], precedence)}
+	}
+	return pn.partitions[node]
+}
 
+// ParsePartitionTotalGPUs sums the GPUs by partition and type. A node in
+// several partitions is counted in every one of them, unless a precedence
+// list of partitions is given: the node is then only counted in its
+// primary partition, see PrimaryPartition.
+func ParsePartitionTotalGPUs(input []byte, precedence []string, pe *ParseErrors) map[string]map[string]float64 {
+	result := make(map[string]map[string]float64)
+	pn := parsePartitionNodes(input)
+	for _, node := range pn.nodes {
+		// format: gpu:<type>:<count> or gpu:<type>:<count>(S:...), a node
+		// with several GPU types lists all of them separated by commas
+		for _, resource := range SplitGres(pn.gres[node]) {
+			gpu, ok := ParseGPUGres(resource, pe)
+			if !ok || gpu.no_consume {
+				continue
+			}
+			for _, partition := range pn.Primary(node, precedence) {
 				if result[partition] == nil {
 					result[partition] = make(map[string]float64)
 				}
-				result[partition][gpuType] += count
+				result[partition][gpu.gpu_type] += gpu.count
 			}
 		}
 	}
 	return result
 }
 
-func ParsePartitionGPUsMetrics() map[string]map[string]*GPUsMetrics {
+// PrimaryPartition returns the first partition of the precedence list the
+// node belongs to, or its first partition if none of them is listed
+func PrimaryPartition(partitions []string, precedence []string) string {
+	for _, p := range precedence {
+		for _, partition := range partitions {
+			if partition == p {
+				return partition
+			}
+		}
+	}
+	return partitions[0]
+}
+
+// Execute the squeue command and return the partition, the nodes and the
+// TRES of the jobs in the given states
+func PartitionTRESData(states string) ([]byte, error) {
+	return ExecuteError("squeue", []string{"--state=" + states, "--noheader", "--Format=partition:.|,nodelist:.|,tres-alloc:."})
+}
+
+// ParsePartitionAllocatedGPUs sums the GPUs of the running jobs by
+// partition and type. With a precedence list of partitions, the GPUs of a
+// job are counted in the primary partition of its first node, like the
+// GPUs of the node in ParsePartitionTotalGPUs, rather than in the
+// partition of the job.
+func ParsePartitionAllocatedGPUs(input []byte, pn PartitionNodes, precedence []string, pe *ParseErrors) map[string]map[string]float64 {
+	result := make(map[string]map[string]float64)
+	for _, line := range strings.Split(string(input), "\n") {
+		// partition|nodes|tres, e.g. gpu|gpu[01-02]|cpu=16,gres/gpu:a100=2
+		fields := strings.Split(line, "|")
+		if len(fields) < 3 {
+			continue
+		}
+		partitions := []string{strings.TrimSpace(fields[0])}
+		nodes := ExpandNodeList(strings.TrimSpace(fields[1]))
+		if len(precedence) > 0 && len(nodes) > 0 && len(pn.partitions[nodes[0]]) > 0 {
+			partitions = pn.Primary(nodes[0], precedence)
+		}
+		// The GPUs of the no_consume types of the node are not used up
+		noConsume := map[string]bool{}
+		if len(nodes) > 0 {
+			noConsume = noConsumeTypes(pn.gres[nodes[0]])
+		}
+		for gpuType, count := range GPUsOfTRES(ParseTRES(strings.TrimSpace(fields[2]), pe)) {
+			if noConsume[gpuType] {
+				continue
+			}
+			if result[partitions[0]] == nil {
+				result[partitions[0]] = make(map[string]float64)
+			}
+			result[partitions[0]][gpuType] += count
+		}
+	}
+	return result
+}
+
+// ParsePartitionNonGPUJobs counts the running jobs holding no GPU in the
+// partitions having GPUs, these jobs take the CPUs of the GPU nodes. The
+// GPU partitions are the ones of ParsePartitionTotalGPUs.
+func ParsePartitionNonGPUJobs(input []byte, gpuPartitions map[string]map[string]float64, pe *ParseErrors) map[string]float64 {
+	result := make(map[string]float64)
+	for partition := range gpuPartitions {
+		result[partition] = 0
+	}
+	for _, line := range strings.Split(string(input), "\n") {
+		// partition|nodes|tres, e.g. gpu|c01|billing=4,cpu=4,mem=16G,node=1
+		fields := strings.Split(line, "|")
+		if len(fields) < 3 {
+			continue
+		}
+		partition := strings.TrimSpace(fields[0])
+		if _, ok := gpuPartitions[partition]; !ok {
+			continue
+		}
+		tres := ParseTRES(strings.TrimSpace(fields[2]), pe)
+		if tres["gres/gpu"] == 0 && len(GPUsOfTRES(tres)) == 0 {
+			result[partition]++
+		}
+	}
+	return result
+}
+
+func ParsePartitionGPUsMetrics(sinfo []byte, squeue []byte, precedence []string, pe *ParseErrors) map[string]map[string]*GPUsMetrics {
 	result := make(map[string]map[string]*GPUsMetrics)
 
-	totals := ParsePartitionTotalGPUs()
-	allocs := ParsePartitionAllocatedGPUs()
+	totals := ParsePartitionTotalGPUs(sinfo, precedence, pe)
+	allocs := ParsePartitionAllocatedGPUs(squeue, parsePartitionNodes(sinfo), precedence, pe)
 
 	for partition, gpuTypes := range totals {
 		result[partition] = make(map[string]*GPUsMetrics)
 		for gpuType, total := range gpuTypes {
+			if !gpuTypeFilter.Allowed(gpuType) {
+				continue
+			}
 			allocated := float64(0)
 			if allocs[partition] != nil {
 				allocated = allocs[partition][gpuType]
 			}
+			// A job on several nodes is counted in the partition of its
+			// first node, and sinfo and squeue do not run at the same
+			// time: more GPUs may seem allocated than there are
 			result[partition][gpuType] = &GPUsMetrics{
 				alloc:       allocated,
-				idle:        total - allocated,
+				idle:        math.Max(0, total-allocated),
 				total:       total,
-				utilization: allocated / total,
+				utilization: GPUsUtilization(allocated, total),
 			}
 		}
 	}
@@ -303,19 +1820,42 @@ func ParsePartitionGPUsMetrics() map[string]map[string]*GPUsMetrics {
 
 func NewPartitionGPUsCollector() *PartitionGPUsCollector {
 	labels := []string{"partition", "type"}
+	utilizationHelp := "GPU utilization by partition and type, from 0 to 1"
+	if *gpuUtilizationPercent {
+		utilizationHelp = "GPU utilization by partition and type, in percent"
+	}
 	return &PartitionGPUsCollector{
-		alloc:       prometheus.NewDesc("slurm_partition_gpus_alloc", "Allocated GPUs by partition and type", labels, nil),
-		idle:        prometheus.NewDesc("slurm_partition_gpus_idle", "Idle GPUs by partition and type", labels, nil),
-		total:       prometheus.NewDesc("slurm_partition_gpus_total", "Total GPUs by partition and type", labels, nil),
-		utilization: prometheus.NewDesc("slurm_partition_gpus_utilization", "GPU utilization by partition and type", labels, nil),
+		parseErrors: &ParseErrors{},
+		alloc:       NewDesc("slurm_partition_gpus_alloc", "Allocated GPUs by partition and type", labels, nil),
+		idle:        NewDesc("slurm_partition_gpus_idle", "Idle GPUs by partition and type", labels, nil),
+		total:       NewDesc("slurm_partition_gpus_total", "Total GPUs by partition and type", labels, nil),
+		utilization: NewDesc("slurm_partition_gpus_utilization", utilizationHelp, labels, nil),
+		nonGPUJobs:  NewDesc("slurm_gpu_partition_nongpu_jobs", "Running jobs holding no GPU in the partitions having GPUs", []string{"partition"}, nil),
+		precedence:  ParsePartitionPrecedence(*gpuPartitionPrecedence),
+		allocStates: *gpuAllocStates,
 	}
 }
 
+// ParsePartitionPrecedence splits the comma-separated list of partitions
+func ParsePartitionPrecedence(list string) []string {
+	precedence := []string{}
+	for _, partition := range strings.Split(list, ",") {
+		if partition = strings.TrimSpace(partition); partition != "" {
+			precedence = append(precedence, partition)
+		}
+	}
+	return precedence
+}
+
 type PartitionGPUsCollector struct {
 	alloc       *prometheus.Desc
 	idle        *prometheus.Desc
 	total       *prometheus.Desc
 	utilization *prometheus.Desc
+	nonGPUJobs  *prometheus.Desc
+	precedence  []string
+	allocStates string
+	parseErrors *ParseErrors
 }
 
 func (c *PartitionGPUsCollector) Describe(ch chan<- *prometheus.Desc) {
@@ -323,10 +1863,25 @@ func (c *PartitionGPUsCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.idle
 	ch <- c.total
 	ch <- c.utilization
+	ch <- c.nonGPUJobs
 }
 
 func (c *PartitionGPUsCollector) Collect(ch chan<- prometheus.Metric) {
-	metrics := ParsePartitionGPUsMetrics()
+	sinfo, err := PartitionTotalGPUsData()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.total, err)
+		return
+	}
+	squeue, err := PartitionTRESData(c.allocStates)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.alloc, err)
+		return
+	}
+	metrics := ParsePartitionGPUsMetrics(sinfo, squeue, c.precedence, c.parseErrors)
+	// A node counts in all its partitions, whatever the precedence
+	for partition, count := range ParsePartitionNonGPUJobs(squeue, ParsePartitionTotalGPUs(sinfo, nil, c.parseErrors), c.parseErrors) {
+		ch <- prometheus.MustNewConstMetric(c.nonGPUJobs, prometheus.GaugeValue, count, partition)
+	}
 	for partition, gpuTypes := range metrics {
 		for gpuType, m := range gpuTypes {
 			ch <- prometheus.MustNewConstMetric(c.alloc, prometheus.GaugeValue, m.alloc, partition, gpuType)
@@ -335,4 +1890,7 @@ func (c *PartitionGPUsCollector) Collect(ch chan<- prometheus.Metric) {
 			ch <- prometheus.MustNewConstMetric(c.utilization, prometheus.GaugeValue, m.utilization, partition, gpuType)
 		}
 	}
+	if err := c.parseErrors.Take(); err != nil {
+		ch <- prometheus.NewInvalidMetric(c.alloc, err)
+	}
 }
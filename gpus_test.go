@@ -0,0 +1,936 @@
+/* Copyright 2020 Joeri Hermans, Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGPUsPeakTracker(t *testing.T) {
+	pt := NewGPUsPeakTracker(time.Hour)
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	pt.Add("a100", 4, start)
+	pt.Add("a100", 16, start.Add(10*time.Minute))
+	pt.Add("a100", 8, start.Add(20*time.Minute))
+	pt.Add("k80", 2, start.Add(20*time.Minute))
+	assert.Equal(t, float64(16), pt.Peak("a100", start.Add(30*time.Minute)))
+	assert.Equal(t, float64(2), pt.Peak("k80", start.Add(30*time.Minute)))
+
+	// The 16 GPUs sample is now older than the window
+	pt.Add("a100", 6, start.Add(75*time.Minute))
+	assert.Equal(t, float64(8), pt.Peak("a100", start.Add(75*time.Minute)))
+	assert.Equal(t, float64(6), pt.Peak("a100", start.Add(90*time.Minute)))
+	assert.Equal(t, float64(0), pt.Peak("v100", start))
+}
+
+func TestGPUsPeakTrackerBounded(t *testing.T) {
+	pt := NewGPUsPeakTracker(24 * time.Hour)
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 2*maxPeakSamples; i++ {
+		pt.Add("a100", float64(i), start.Add(time.Duration(i)*time.Second))
+	}
+	assert.Equal(t, maxPeakSamples, len(pt.samples["a100"]))
+}
+
+func TestFormatWindow(t *testing.T) {
+	assert.Equal(t, "1h", FormatWindow(time.Hour))
+	assert.Equal(t, "1h30m", FormatWindow(90*time.Minute))
+	assert.Equal(t, "5m", FormatWindow(5*time.Minute))
+	assert.Equal(t, "30s", FormatWindow(30*time.Second))
+}
+
+func TestParseConfiguredGPUs(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/scontrol_nodes.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	configured := ParseConfiguredGPUs(data, nil)
+	t.Logf("%+v", configured)
+
+	// gpu02 is DOWN but its GPUs are still configured
+	assert.Equal(t, float64(8), configured["a100"])
+	assert.Equal(t, float64(2), configured["v100"])
+	assert.Equal(t, float64(1), configured["k80"])
+	assert.Equal(t, 3, len(configured))
+}
+
+func TestParseScontrolFields(t *testing.T) {
+	fields := ParseScontrolFields("NodeName=gpu02 OS=Linux 5.14.0 #1 SMP State=DOWN+NOT_RESPONDING AllocTRES= Reason=Not responding [slurm@2023-06-01T08:05:00]")
+	assert.Equal(t, "gpu02", fields["NodeName"])
+	assert.Equal(t, "Linux 5.14.0 #1 SMP", fields["OS"])
+	assert.Equal(t, "DOWN+NOT_RESPONDING", fields["State"])
+	assert.Equal(t, "", fields["AllocTRES"])
+	assert.Equal(t, "Not responding [slurm@2023-06-01T08:05:00]", fields["Reason"])
+}
+
+func TestSplitGres(t *testing.T) {
+	assert.Equal(t, []string{"gpu:a100:2(S:0,1)", "gpu:v100:1(S:1)"}, SplitGres("gpu:a100:2(S:0,1),gpu:v100:1(S:1)"))
+	assert.Equal(t, []string{"(null)"}, SplitGres("(null)"))
+}
+
+func TestGPUsMetrics(t *testing.T) {
+	sinfo, err := ioutil.ReadFile("test_data/sinfo_gpus.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	squeue, err := ioutil.ReadFile("test_data/squeue_gpus.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	gm := ParseGPUsMetrics(ParseSinfoGPUs(sinfo, nil), squeue, nil)
+	t.Logf("%+v", gm)
+
+	assert.Equal(t, float64(6), gm["a100"].alloc)
+	assert.Equal(t, float64(2), gm["a100"].idle)
+	assert.Equal(t, float64(8), gm["a100"].total)
+	assert.Equal(t, 0.75, gm["a100"].utilization)
+	assert.Equal(t, float64(1), gm["v100"].alloc)
+	assert.Equal(t, float64(0), gm["k80"].alloc)
+	assert.Equal(t, float64(8), gm["k80"].idle)
+	assert.Equal(t, 4, len(gm))
+}
+
+func TestGPUsMetricsAllocExceedsTotal(t *testing.T) {
+	sinfo := []byte("gpu01|gpu:k80:2(S:0-1)\ngpu02|gpu:a100:4(S:0-1)\n")
+	squeue := []byte("billing=8,cpu=8,gres/gpu:k80=3,gres/gpu=3,node=1\n" +
+		"billing=8,cpu=8,gres/gpu:a100=1,gres/gpu=1,node=1\n")
+	gm := ParseGPUsMetrics(ParseSinfoGPUs(sinfo, nil), squeue, nil)
+
+	// The idle GPUs are clamped to 0
+	assert.Equal(t, float64(3), gm["k80"].alloc)
+	assert.Equal(t, float64(0), gm["k80"].idle)
+	assert.Equal(t, float64(1), gm["k80"].exceeds)
+	assert.Equal(t, float64(3), gm["a100"].idle)
+	assert.Equal(t, float64(0), gm["a100"].exceeds)
+}
+
+func TestGPUsMetricsUtilizationPrecision(t *testing.T) {
+	defer func(precision int) { *gpuUtilizationPrecision = precision }(*gpuUtilizationPrecision)
+	sinfo := []byte("gpu01|gpu:k80:6(S:0-1)\n")
+	squeue := []byte("billing=8,cpu=8,gres/gpu:k80=1,gres/gpu=1,mem=32G,node=1\n")
+
+	*gpuUtilizationPrecision = -1
+	assert.Equal(t, float64(1)/6, ParseGPUsMetrics(ParseSinfoGPUs(sinfo, nil), squeue, nil)["k80"].utilization)
+
+	*gpuUtilizationPrecision = 3
+	assert.Equal(t, 0.167, ParseGPUsMetrics(ParseSinfoGPUs(sinfo, nil), squeue, nil)["k80"].utilization)
+
+	*gpuUtilizationPrecision = 0
+	assert.Equal(t, float64(0), ParseGPUsMetrics(ParseSinfoGPUs(sinfo, nil), squeue, nil)["k80"].utilization)
+}
+
+func TestGPUsMetricsUtilizationPercent(t *testing.T) {
+	defer func(precision int) { *gpuUtilizationPrecision = precision }(*gpuUtilizationPrecision)
+	defer func(percent bool) { *gpuUtilizationPercent = percent }(*gpuUtilizationPercent)
+	sinfo := []byte("gpu01|gpu:k80:6(S:0-1)\n")
+	squeue := []byte("billing=8,cpu=8,gres/gpu:k80=1,gres/gpu=1,mem=32G,node=1\n")
+
+	*gpuUtilizationPrecision = 4
+	assert.Equal(t, 0.1667, ParseGPUsMetrics(ParseSinfoGPUs(sinfo, nil), squeue, nil)["k80"].utilization)
+
+	// The precision applies to the percentage
+	*gpuUtilizationPercent = true
+	assert.Equal(t, 16.6667, ParseGPUsMetrics(ParseSinfoGPUs(sinfo, nil), squeue, nil)["k80"].utilization)
+	*gpuUtilizationPrecision = 2
+	assert.Equal(t, 16.67, ParseGPUsMetrics(ParseSinfoGPUs(sinfo, nil), squeue, nil)["k80"].utilization)
+	*gpuUtilizationPrecision = -1
+	assert.InDelta(t, 100.0/6, ParseGPUsMetrics(ParseSinfoGPUs(sinfo, nil), squeue, nil)["k80"].utilization, 1e-9)
+
+	// And to the utilization by partition
+	*gpuUtilizationPrecision = 2
+	partitions := ParsePartitionGPUsMetrics([]byte("gpu|gpu01|gpu:k80:6(S:0-1)\n"), []byte("gpu|gpu01|cpu=8,gres/gpu:k80=1\n"), nil, nil)
+	assert.Equal(t, 16.67, partitions["gpu"]["k80"].utilization)
+}
+
+func TestGPUsMetricsNoConsume(t *testing.T) {
+	sinfo, err := ioutil.ReadFile("test_data/sinfo_gpus.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	squeue, err := ioutil.ReadFile("test_data/squeue_gpus.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	assert.Equal(t, map[string]float64{"quadro": 2}, ParseNoConsumeGPUs(sinfo, nil))
+	assert.NotContains(t, ParseTotalGPUs(sinfo, nil), "quadro")
+
+	// The job holding a no_consume GPU is not counted as allocation
+	gm := ParseGPUsMetrics(ParseSinfoGPUs(sinfo, nil), squeue, nil)
+	assert.Equal(t, float64(2), gm["quadro"].no_consume)
+	assert.Equal(t, float64(0), gm["quadro"].alloc)
+	assert.Equal(t, float64(0), gm["quadro"].total)
+}
+
+func TestGresMismatch(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/scontrol_nodes.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	// c01 has no GPUs and is left out
+	assert.Equal(t, map[string]float64{"gpu01": 0, "gpu02": 0, "gpu03": 0}, ParseGresMismatch(data, nil))
+
+	// gpu04 got its a100 replaced by v100 without updating slurm.conf
+	mismatch := ParseGresMismatch([]byte("NodeName=gpu04 Gres=gpu:a100:4(S:0-1) AllocTRES=cpu=8,gres/gpu=2,gres/gpu:v100=2\n"+
+		"NodeName=gpu05 Gres=(null) AllocTRES=cpu=8,gres/gpu=1,gres/gpu:k80=1\n"), nil)
+	assert.Equal(t, map[string]float64{"gpu04": 1, "gpu05": 1}, mismatch)
+}
+
+func TestIdleGPUsFromScontrol(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/scontrol_nodes.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	idle := ParseIdleGPUsFromScontrol(data, nil)
+	t.Logf("%+v", idle)
+
+	// gpu01 has 2 of 4 allocated, gpu02 has none allocated
+	assert.Equal(t, float64(6), idle["a100"])
+	// gpu03 is fully allocated
+	assert.Equal(t, float64(0), idle["v100"])
+	assert.Equal(t, float64(0), idle["k80"])
+	assert.Equal(t, 3, len(idle))
+
+	// Both sources agree as long as the allocations match
+	sinfo := []byte("gpu01|gpu:a100:4(S:0-1)\ngpu03|gpu:v100:2(S:0),gpu:k80:1(S:1)\n")
+	squeue := []byte("cpu=16,gres/gpu:a100=2,gres/gpu=2\ncpu=32,gres/gpu:v100=2,gres/gpu:k80=1,gres/gpu=3\n")
+	scontrol := []byte("NodeName=gpu01 Gres=gpu:a100:4(S:0-1) AllocTRES=cpu=16,gres/gpu=2,gres/gpu:a100=2\n" +
+		"NodeName=gpu03 Gres=gpu:v100:2(S:0),gpu:k80:1(S:1) AllocTRES=cpu=32,gres/gpu=3,gres/gpu:v100=2,gres/gpu:k80=1\n")
+	computed := ParseGPUsMetrics(ParseSinfoGPUs(sinfo, nil), squeue, nil)
+	for gpu_type, count := range ParseIdleGPUsFromScontrol(scontrol, nil) {
+		assert.Equal(t, computed[gpu_type].idle, count, gpu_type)
+	}
+}
+
+func TestCPUBlockedGPUs(t *testing.T) {
+	// gpu04 has all its CPUs allocated to a CPU job and 3 idle GPUs,
+	// gpu05 has idle CPUs and GPUs, gpu06 predates CPUEfctv=
+	scontrol := []byte("NodeName=gpu04 CPUAlloc=64 CPUEfctv=64 CPUTot=64 Gres=gpu:a100:4(S:0-1) AllocTRES=cpu=64,gres/gpu=1,gres/gpu:a100=1\n" +
+		"NodeName=gpu05 CPUAlloc=16 CPUEfctv=64 CPUTot=64 Gres=gpu:a100:4(S:0-1) AllocTRES=cpu=16,gres/gpu=2,gres/gpu:a100=2\n" +
+		"NodeName=gpu06 CPUAlloc=32 CPUTot=32 Gres=gpu:v100:2(S:0) AllocTRES=cpu=32,gres/gpu=1,gres/gpu:v100=1\n" +
+		"NodeName=cpu01 CPUAlloc=32 CPUEfctv=32 CPUTot=32 Gres=(null) AllocTRES=cpu=32\n")
+	assert.Equal(t, map[string]float64{"a100": 3, "v100": 1}, ParseCPUBlockedGPUs(scontrol, nil))
+
+	data, err := ioutil.ReadFile("test_data/scontrol_nodes.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	// gpu03 has no idle CPU but all its GPUs are allocated
+	assert.Equal(t, map[string]float64{"a100": 0, "v100": 0, "k80": 0}, ParseCPUBlockedGPUs(data, nil))
+}
+
+func TestTotalGPUsEmptyGres(t *testing.T) {
+	// c02 has nothing after the delimiter, gpu05 is missing it entirely
+	totals := ParseTotalGPUs([]byte("c02|\ngpu01|gpu:a100:4(S:0-1)\ngpu05\n"), nil)
+	assert.Equal(t, map[string]float64{"a100": 4}, totals)
+}
+
+func TestGPUNodes(t *testing.T) {
+	sinfo := []byte("gpu01|gpu:a100:4(S:0-1)\ngpu02|gpu:a100:8(S:0-1)\ngpu03|gpu:a100:2(S:0),gpu:v100:1(S:1)\nc01|(null)\n")
+	assert.Equal(t, map[string]float64{"a100": 3, "v100": 1}, ParseGPUNodes(sinfo, nil))
+	assert.Equal(t, map[string]float64{"a100": 14, "v100": 1}, ParseTotalGPUs(sinfo, nil))
+
+	// Two nodes with 4 and 8 GPUs
+	sinfo = []byte("gpu01|gpu:a100:4(S:0-1)\ngpu02|gpu:a100:8(S:0-1)\n")
+	assert.Equal(t, float64(6), ParseTotalGPUs(sinfo, nil)["a100"]/ParseGPUNodes(sinfo, nil)["a100"])
+}
+
+func TestTotalGPUsReasonColumn(t *testing.T) {
+	// %n|%G|%E, the reason of gpu02 contains spaces
+	sinfo := []byte("gpu01|gpu:a100:4(S:0-1)|none\n" +
+		"gpu02|gpu:a100:4(S:0-1)|Not responding [slurm@2023-06-01T08:05:00]\n")
+	assert.Equal(t, map[string]float64{"a100": 8}, ParseTotalGPUs(sinfo, nil))
+	assert.Equal(t, map[string]float64{"a100": 2}, ParseGPUNodes(sinfo, nil))
+	assert.Equal(t, []string{"gpu02", "Not responding", "gpu:a100:4"}, SplitSinfoFields("gpu02| Not responding |gpu:a100:4"))
+}
+
+func TestTotalGPUsLongFormat(t *testing.T) {
+	long, err := ioutil.ReadFile("test_data/sinfo_gpus_long.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	sinfo, err := ioutil.ReadFile("test_data/sinfo_gpus.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	// Both formats give the same totals, gpu03 is listed in two partitions
+	assert.Equal(t, ParseTotalGPUs(sinfo, nil), ParseTotalGPUs(long, nil))
+	assert.Equal(t, ParseNoConsumeGPUs(sinfo, nil), ParseNoConsumeGPUs(long, nil))
+	assert.Equal(t, float64(2), ParseTotalGPUs(long, nil)["v100"])
+
+	// A node name longer than the default width of the column
+	long = []byte("gpu-node-with-a-long-name01|gpu:a100:4(S:0-1)\n")
+	assert.Equal(t, map[string]float64{"a100": 4}, ParseTotalGPUs(long, nil))
+}
+
+func TestTotalGPUsMultipleTypes(t *testing.T) {
+	// A single heterogeneous node advertising two GPU types
+	totals := ParseTotalGPUs([]byte("gpu01|gpu:a100:2(S:0,1),gpu:v100:1(S:1)\ngpu02|gpu:a100:4(S:0-1)\n"), nil)
+	assert.Equal(t, map[string]float64{"a100": 6, "v100": 1}, totals)
+
+	partitions := ParsePartitionTotalGPUs([]byte("gpu gpu01 gpu:a100:2(S:0,1),gpu:v100:1(S:1)\ngpu gpu02 gpu:a100:4(S:0-1)\ncpu c01 (null)\n"), nil, nil)
+	assert.Equal(t, map[string]map[string]float64{"gpu": {"a100": 6, "v100": 1}}, partitions)
+}
+
+func TestParseGPUGres(t *testing.T) {
+	gres := map[string]GPUGres{
+		"gpu:a100:4":                     {"a100", 4, false},
+		"gpu:a100:4(S:0-1)":              {"a100", 4, false},
+		"gpu:a100:2(S:0)(Links=-1,0)":    {"a100", 2, false},
+		"gpu:a100:no_consume:2":          {"a100", 2, true},
+		"gpu:a100:shared:2(S:0)":         {"a100", 2, false},
+		"gpu:h100:mps:no_consume:8(S:1)": {"h100", 8, true},
+	}
+	for resource, expected := range gres {
+		gpu, ok := ParseGPUGres(resource, nil)
+		assert.True(t, ok, resource)
+		assert.Equal(t, expected, gpu, resource)
+	}
+	for _, resource := range []string{"gpu:4", "gpu:a100", "gpu:a100:flags", "mps:100", "(null)"} {
+		_, ok := ParseGPUGres(resource, nil)
+		assert.False(t, ok, resource)
+	}
+
+	// Links lists contain commas
+	totals := ParseTotalGPUs([]byte("gpu01|gpu:a100:2(S:0)(Links=-1,0),gpu:a100:2(S:1)(Links=0,-1)\n"), nil)
+	assert.Equal(t, map[string]float64{"a100": 4}, totals)
+}
+
+func TestPartitionTotalGPUsPrecedence(t *testing.T) {
+	sinfo := []byte("gpu gpu01 gpu:a100:4(S:0-1)\n" +
+		"gpu gpu02 gpu:a100:4(S:0-1)\n" +
+		"gpu-shared gpu02 gpu:a100:4(S:0-1)\n" +
+		"gpu-shared gpu03 gpu:v100:2(S:0)\n" +
+		"interactive gpu03 gpu:v100:2(S:0)\n")
+
+	// Without precedence gpu02 and gpu03 are counted twice
+	assert.Equal(t, map[string]map[string]float64{
+		"gpu":         {"a100": 8},
+		"gpu-shared":  {"a100": 4, "v100": 2},
+		"interactive": {"v100": 2},
+	}, ParsePartitionTotalGPUs(sinfo, nil, nil))
+
+	// gpu03 is in none of the listed partitions, its first one is kept
+	assert.Equal(t, map[string]map[string]float64{
+		"gpu":        {"a100": 8},
+		"gpu-shared": {"v100": 2},
+	}, ParsePartitionTotalGPUs(sinfo, []string{"gpu"}, nil))
+	assert.Equal(t, map[string]map[string]float64{
+		"gpu":         {"a100": 8},
+		"interactive": {"v100": 2},
+	}, ParsePartitionTotalGPUs(sinfo, ParsePartitionPrecedence("interactive, gpu"), nil))
+}
+
+func TestPartitionAllocatedGPUsPrecedence(t *testing.T) {
+	sinfo := []byte("gpu gpu01 gpu:a100:4(S:0-1)\n" +
+		"gpu gpu02 gpu:a100:4(S:0-1)\n" +
+		"gpu-shared gpu02 gpu:a100:4(S:0-1)\n" +
+		"gpu-shared gpu03 gpu:v100:2(S:0)\n")
+	squeue := []byte("gpu-shared|gpu02|cpu=4,gres/gpu:a100=3\n" +
+		"gpu-shared|gpu03|cpu=4,gres/gpu:v100=1\n" +
+		"gpu|gpu[01-02]|cpu=8,gres/gpu:a100=5\n")
+
+	// The jobs are counted in the partition of the job
+	metrics := ParsePartitionGPUsMetrics(sinfo, squeue, nil, nil)
+	assert.Equal(t, &GPUsMetrics{alloc: 3, idle: 1, total: 4, utilization: 0.75}, metrics["gpu-shared"]["a100"])
+	assert.Equal(t, float64(5), metrics["gpu"]["a100"].alloc)
+
+	// gpu02 is only counted in gpu, so are the GPUs of its jobs
+	metrics = ParsePartitionGPUsMetrics(sinfo, squeue, []string{"gpu"}, nil)
+	assert.Equal(t, &GPUsMetrics{alloc: 8, idle: 0, total: 8, utilization: 1}, metrics["gpu"]["a100"])
+	assert.Equal(t, &GPUsMetrics{alloc: 1, idle: 1, total: 2, utilization: 0.5}, metrics["gpu-shared"]["v100"])
+	assert.NotContains(t, metrics["gpu-shared"], "a100")
+
+	// The idle GPUs do not go below 0 when squeue saw more jobs than sinfo
+	metrics = ParsePartitionGPUsMetrics(sinfo, append(squeue, "gpu|gpu01|gres/gpu:a100=4\n"...), []string{"gpu"}, nil)
+	assert.Equal(t, float64(12), metrics["gpu"]["a100"].alloc)
+	assert.Equal(t, float64(0), metrics["gpu"]["a100"].idle)
+}
+
+func TestFeatureTotalGPUs(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sinfo_gpus_features.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	// gpu01 is listed twice, gpu03 and cpu01 have no feature or no GPUs
+	assert.Equal(t, map[string]map[string]float64{
+		"nvlink": {"a100": 4, "k80": 8},
+		"ib":     {"a100": 8},
+	}, ParseFeatureTotalGPUs(data, nil))
+}
+
+func TestSuspendedGPUs(t *testing.T) {
+	assert.Equal(t, []string{"--state=SUSPENDED", "--noheader", "--Format=tres-alloc:."}, AllocatedGPUsArgs("SUSPENDED"))
+
+	data, err := ioutil.ReadFile("test_data/squeue_gpus_suspended.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	suspended := ParseAllocatedGPUs(data, nil)
+	assert.Equal(t, map[string]float64{"a100": 5, "v100": 2}, suspended)
+}
+
+func TestOversubscribedGPUs(t *testing.T) {
+	cm := map[string]*GPUsMetrics{
+		"a100": {alloc: 6, total: 8},
+		"v100": {alloc: 1, total: 4},
+	}
+	// 6 running and 5 suspended a100 GPUs time-slice 8 physical ones
+	assert.Equal(t, map[string]float64{"a100": 3, "v100": 0}, OversubscribedGPUs(cm, map[string]float64{"a100": 5, "v100": 1}))
+}
+
+func TestWrongTypeGPUJobs(t *testing.T) {
+	assert.Equal(t, []string{"a100"}, ParseRequestedGPUTypes("gres:gpu:a100:2"))
+	assert.Equal(t, []string{"a100"}, ParseRequestedGPUTypes("gres/gpu:a100=4"))
+	assert.Equal(t, []string{"k80"}, ParseRequestedGPUTypes("gres/gpu:k80"))
+	assert.Empty(t, ParseRequestedGPUTypes("gres:gpu:2"))
+	assert.Empty(t, ParseRequestedGPUTypes("N/A"))
+
+	// The gres and the TRES forms
+	assert.Equal(t, map[string]float64{"a100": 2}, ParseRequestedGPUs("gres:gpu:a100:2"))
+	assert.Equal(t, map[string]float64{"a100": 4}, ParseRequestedGPUs("gres/gpu:a100=4"))
+	assert.Equal(t, map[string]float64{"k80": 1}, ParseRequestedGPUs("gres/gpu:k80"))
+	assert.Equal(t, map[string]float64{"any": 2}, ParseRequestedGPUs("gres:gpu:2"))
+	assert.Equal(t, map[string]float64{"any": 2}, ParseRequestedGPUs("gres/gpu=2"))
+	assert.Equal(t, map[string]float64{"a100": 1, "v100": 2}, ParseRequestedGPUs("gres/gpu:a100=1,gres/gpu:v100=2"))
+	assert.Empty(t, ParseRequestedGPUs("N/A"))
+
+	data, err := ioutil.ReadFile("test_data/squeue_gpus_requested.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	// Jobs requesting any type or getting the requested one are fine
+	assert.Equal(t, map[string]map[string]float64{
+		"a100": {"v100": 2},
+	}, ParseWrongTypeGPUJobs(data, nil))
+
+	// A request of several types, longer than the default width
+	jobs := []byte("N/A|gres:gpu:a100:1,gres:gpu:h100:1|cpu=8,gres/gpu:a100=1,gres/gpu:v100=1\n")
+	assert.Equal(t, map[string]map[string]float64{
+		"h100": {"v100": 1},
+	}, ParseWrongTypeGPUJobs(jobs, nil))
+}
+
+func TestPlannedGPUs(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/squeue_start.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	now := time.Date(2026, 10, 14, 10, 0, 0, 0, time.Local)
+
+	// The jobs planned after the window and the ones without a start time
+	// are left out, the GPUs per job are not multiplied by the nodes
+	assert.Equal(t, map[string]float64{"a100": 18, "v100": 1, "any": 2}, ParsePlannedGPUs(data, now, time.Hour, nil))
+	assert.Equal(t, map[string]float64{"a100": 2, "v100": 1, "any": 2}, ParsePlannedGPUs(data, now, 30*time.Minute, nil))
+	assert.Equal(t, map[string]float64{"a100": 28, "v100": 1, "any": 2}, ParsePlannedGPUs(data, now, 6*time.Hour, nil))
+}
+
+func TestPendingGPUJobs(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/squeue_gpus_pending.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	// Jobs not GPUs, the job requesting a100 and v100 counts for both
+	assert.Equal(t, map[string]float64{"a100": 3, "v100": 2, "any": 1}, ParsePendingGPUJobs(data))
+}
+
+func TestTopGPUsUsers(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/squeue_gpus_users.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	by_user := ParseAllocatedGPUsByUser(data, nil)
+	assert.Equal(t, 20, len(by_user["a100"]))
+	assert.Equal(t, float64(2), by_user["a100"]["user01"])
+
+	top := TopGPUsUsers(by_user, 10)
+	assert.Equal(t, 10, len(top["a100"]))
+	assert.Equal(t, GPUsUserAlloc{"user20", 20}, top["a100"][0])
+	assert.Equal(t, GPUsUserAlloc{"user11", 11}, top["a100"][9])
+	assert.Equal(t, []GPUsUserAlloc{{"user03", 2}}, top["v100"])
+
+	// Ties are ranked by user name
+	top = TopGPUsUsers(map[string]map[string]float64{"k80": {"bob": 2, "alice": 2, "carol": 1}}, 2)
+	assert.Equal(t, []GPUsUserAlloc{{"alice", 2}, {"bob", 2}}, top["k80"])
+
+	// User names longer than the default width
+	long := ParseAllocatedGPUsByUser([]byte("a.very.long.user.name01|cpu=1,gres/gpu:a100=1\n"), nil)
+	assert.Equal(t, float64(1), long["a100"]["a.very.long.user.name01"])
+}
+
+func TestAllocatedGPUsByUserAccounts(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/squeue_tres_states.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	users := JobColumns(SelectJobs(data, []string{"RUNNING"}, nil), jobUser, jobTRES)
+	assert.Equal(t, 3, len(ParseAllocatedGPUsByUser(users, nil)["a100"]))
+
+	users = JobColumns(SelectJobs(data, []string{"RUNNING"}, []string{"physics", "chemistry"}), jobUser, jobTRES)
+	assert.Equal(t, map[string]map[string]float64{
+		"a100":   {"user01": 2, "user02": 1},
+		"v100":   {"user01": 1},
+		"quadro": {"user02": 1},
+	}, ParseAllocatedGPUsByUser(users, nil))
+}
+
+func TestInteractiveGPUs(t *testing.T) {
+	assert.True(t, IsInteractiveJob("bash", "/bin/bash"))
+	assert.True(t, IsInteractiveJob("interactive", "(null)"))
+	assert.True(t, IsInteractiveJob("notebook", "/usr/bin/zsh"))
+	assert.False(t, IsInteractiveJob("train.sh", "/home/user01/train.sh"))
+
+	data, err := ioutil.ReadFile("test_data/squeue_gpus_jobs.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	interactive := ParseInteractiveGPUs(data, nil)
+	assert.Equal(t, map[string]float64{"a100": 3, "v100": 1}, interactive)
+
+	// A name with spaces and a command longer than the default width
+	jobs := []byte("my training run|/home/user01/a/very/long/path/train.sh|cpu=8,gres/gpu:a100=4\n" +
+		"shell session|/usr/local/site/bin/interactive|cpu=8,gres/gpu:a100=2\n")
+	assert.Equal(t, map[string]float64{"a100": 2}, ParseInteractiveGPUs(jobs, nil))
+}
+
+func TestGPUJobsBySize(t *testing.T) {
+	assert.Equal(t, "1", GPUJobSize(1))
+	assert.Equal(t, "2-4", GPUJobSize(2))
+	assert.Equal(t, "2-4", GPUJobSize(4))
+	assert.Equal(t, "5-7", GPUJobSize(6))
+	assert.Equal(t, "8+", GPUJobSize(8))
+	assert.Equal(t, "8+", GPUJobSize(16))
+
+	data, err := ioutil.ReadFile("test_data/squeue_gpus.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	sizes := ParseGPUJobsBySize(data, nil)
+	assert.Equal(t, map[string]float64{"2-4": 2}, sizes["a100"])
+	assert.Equal(t, map[string]float64{"1": 1}, sizes["v100"])
+
+	sizes = ParseGPUJobsBySize([]byte("cpu=1,gres/gpu:a100=1\ncpu=8,gres/gpu:a100=8\ncpu=4,gres/gpu:a100=1\ncpu=4,gres/gpu:a100=6\n"), nil)
+	assert.Equal(t, map[string]float64{"1": 2, "5-7": 1, "8+": 1}, sizes["a100"])
+}
+
+func TestGPUTypeFilter(t *testing.T) {
+	sinfo, err := ioutil.ReadFile("test_data/sinfo_gpus.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	squeue, err := ioutil.ReadFile("test_data/squeue_gpus.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	defer func(f *GPUTypeFilter) { gpuTypeFilter = f }(gpuTypeFilter)
+	types := func(include string, exclude string) []string {
+		filter, err := NewGPUTypeFilter(include, exclude)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gpuTypeFilter = filter
+		names := []string{}
+		for gpu_type := range ParseGPUsMetrics(ParseSinfoGPUs(sinfo, nil), squeue, nil) {
+			names = append(names, gpu_type)
+		}
+		return names
+	}
+
+	assert.ElementsMatch(t, []string{"a100", "v100", "k80", "quadro"}, types("", ""))
+	assert.ElementsMatch(t, []string{"a100", "v100"}, types("a100|v100", ""))
+	assert.ElementsMatch(t, []string{"a100", "v100", "quadro"}, types("", "k80"))
+	assert.ElementsMatch(t, []string{"a100"}, types("a100|v100", "v.*"))
+	// Expressions match the whole type
+	assert.ElementsMatch(t, []string{"a100", "v100", "k80", "quadro"}, types("", "a10"))
+
+	_, err = NewGPUTypeFilter("(", "")
+	assert.Error(t, err)
+}
+
+func TestGPUsCollector(t *testing.T) {
+	defer fakeSlurm(t, map[string][]fakeOutput{
+		"sinfo": {
+			{"*%f*", "test_data/sinfo_gpus_features.txt"},
+			{"*", "test_data/sinfo_gpus.txt"},
+		},
+		"scontrol": {{"*", "test_data/scontrol_nodes.txt"}},
+		"squeue": {
+			{"*state:.*", "test_data/squeue_tres_states.txt"},
+		},
+	})()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewGPUsCollector())
+	metrics := collectMetrics(t, registry)
+
+	assert.Equal(t, float64(6), metrics[`slurm_gpus_alloc{type="a100"}`])
+	assert.Equal(t, float64(2), metrics[`slurm_gpus_idle{type="a100"}`])
+	assert.Equal(t, float64(8), metrics[`slurm_gpus_total{type="a100"}`])
+	assert.Equal(t, float64(5), metrics[`slurm_gpus_alloc_suspended{type="a100"}`])
+	assert.Equal(t, float64(2), metrics[`slurm_gpus_no_consume{type="quadro"}`])
+	assert.Equal(t, float64(1), metrics[`slurm_gpus_alloc_no_consume{type="quadro"}`])
+	assert.NotContains(t, metrics, `slurm_gpu_jobs_by_size{size="1",type="quadro"}`)
+	assert.Equal(t, float64(6), metrics[`slurm_gpus_alloc_peak{type="a100",window="1h"}`])
+	assert.Equal(t, float64(3), metrics[`slurm_gpus_alloc_top_user{rank="1",type="a100",user="user03"}`])
+	// a100, v100, k80 and quadro
+	assert.Equal(t, float64(4), metrics[`slurm_gpu_types_total`])
+	assert.Equal(t, float64(4), metrics[`slurm_gpus_per_node_avg{type="a100"}`])
+	assert.Equal(t, float64(0), metrics[`slurm_node_gres_mismatch{node="gpu03"}`])
+	assert.Equal(t, float64(2), metrics[`slurm_gpu_jobs_by_size{size="2-4",type="a100"}`])
+	assert.Equal(t, float64(3), metrics[`slurm_gpus_alloc_interactive{type="a100"}`])
+	assert.Equal(t, float64(4), metrics[`slurm_gpus_alloc_by_timelimit{bucket="1d-7d",type="a100"}`])
+	assert.Equal(t, float64(0), metrics[`slurm_gpus_idle_cpu_blocked{type="v100"}`])
+	assert.Equal(t, float64(3), metrics[`slurm_gpus_pending_jobs{type="a100"}`])
+	assert.Equal(t, float64(2), metrics[`slurm_gpus_planned{type="a100",window="1h"}`])
+	assert.Equal(t, float64(1), metrics[`slurm_gpu_jobs_wrong_type{allocated="v100",requested="a100"}`])
+
+	// The aggregates are the sums over all types
+	for _, name := range []string{"alloc", "idle", "total"} {
+		sum := float64(0)
+		for _, gpu_type := range []string{"a100", "v100", "k80", "quadro"} {
+			sum += metrics[`slurm_gpus_`+name+`{type="`+gpu_type+`"}`]
+		}
+		assert.Equal(t, sum, metrics[`slurm_gpus_`+name+`_all`], name)
+	}
+	assert.Equal(t, float64(18), metrics[`slurm_gpus_total_all`])
+	assert.Equal(t, float64(0), metrics[`slurm_gpus_oversubscribed{type="k80"}`])
+	assert.Equal(t, float64(8), metrics[`slurm_gpus_feature_total{feature="ib",type="a100"}`])
+}
+
+func TestGPUsCollectorAllocStates(t *testing.T) {
+	defer fakeSlurm(t, map[string][]fakeOutput{
+		"sinfo":    {{"*", "test_data/sinfo_gpus.txt"}},
+		"scontrol": {{"*", "test_data/scontrol_nodes.txt"}},
+		"squeue": {
+			{"*state:.*", "test_data/squeue_tres_states.txt"},
+		},
+	})()
+
+	collector := NewGPUsCollector()
+	collector.allocStates = "RUNNING,SUSPENDED"
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	metrics := collectMetrics(t, registry)
+
+	// 6 running and 5 suspended GPUs out of 8
+	assert.Equal(t, float64(11), metrics[`slurm_gpus_alloc{type="a100"}`])
+	assert.Equal(t, float64(3), metrics[`slurm_gpus_oversubscribed{type="a100"}`])
+	assert.Equal(t, float64(3), metrics[`slurm_gpus_alloc{type="v100"}`])
+	// The breakdowns of the allocation count the same states
+	assert.Equal(t, float64(4), metrics[`slurm_gpus_alloc_top_user{rank="1",type="a100",user="user05"}`])
+}
+
+func TestGPUsCollectorScontrolIdle(t *testing.T) {
+	defer fakeSlurm(t, map[string][]fakeOutput{
+		"sinfo":    {{"*", "test_data/sinfo_gpus.txt"}},
+		"scontrol": {{"*", "test_data/scontrol_nodes.txt"}},
+		"squeue": {
+			{"*state:.*", "test_data/squeue_tres_states.txt"},
+		},
+	})()
+
+	collector := NewGPUsCollector()
+	collector.idleSource = "scontrol"
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	metrics := collectMetrics(t, registry)
+
+	assert.Equal(t, float64(6), metrics[`slurm_gpus_idle{type="a100"}`])
+	assert.Equal(t, float64(0), metrics[`slurm_gpus_idle{type="v100"}`])
+	// Still computed from sinfo and squeue
+	assert.Equal(t, float64(6), metrics[`slurm_gpus_alloc{type="a100"}`])
+}
+
+func TestParseTRESAlloc(t *testing.T) {
+	tres := ParseTRESAlloc([]byte("billing=30,cpu=16,gres/gpu:a100=2,gres/gpu=2,mem=100G,node=1\n"+
+		"billing=4,cpu=4,gres/tmpdisk=10G,mem=512M,node=1\n"), nil)
+	assert.Equal(t, float64(34), tres["billing"])
+	assert.Equal(t, float64(20), tres["cpu"])
+	assert.Equal(t, float64(2), tres["gres/gpu:a100"])
+	assert.Equal(t, float64(2), tres["gres/gpu"])
+	assert.Equal(t, float64(100*1024*1024*1024+512*1024*1024), tres["mem"])
+	assert.Equal(t, float64(10*1024*1024*1024), tres["gres/tmpdisk"])
+	assert.Equal(t, float64(2), tres["node"])
+	assert.Equal(t, map[string]float64{"a100": 2}, GPUsOfTRES(tres))
+}
+
+func TestSelectTRES(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/squeue_tres_states.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	assert.Equal(t, float64(5), ParseAllocatedGPUs(SelectTRES(data, []string{"SUSPENDED"}), nil)["a100"])
+	assert.Equal(t, float64(6), ParseAllocatedGPUs(SelectTRES(data, []string{"RUNNING"}), nil)["a100"])
+	assert.Equal(t, float64(11), ParseAllocatedGPUs(SelectTRES(data, []string{"RUNNING", "SUSPENDED"}), nil)["a100"])
+}
+
+func TestSelectConsumedTRES(t *testing.T) {
+	// The a100 of viz01 are no_consume, the ones of gpu01 are not
+	sinfo := []byte("gpu01|gpu:a100:4(S:0-1)\nviz01|gpu:a100:no_consume:2,gpu:quadro:no_consume:2\n")
+	assert.Equal(t, map[string]map[string]bool{"viz01": {"a100": true, "quadro": true}}, ParseSinfoGPUs(sinfo, nil).noConsumeNodes)
+
+	tres := []byte("RUNNING|gpu01|1:00:00|physics|user01|train|train.sh|N/A|1|N/A|N/A|cpu=16,gres/gpu:a100=2,gres/gpu=2\n" +
+		"RUNNING|viz01|1:00:00|physics|user01|bash|/bin/bash|N/A|1|N/A|N/A|cpu=2,gres/gpu:a100=1,gres/gpu=1\n" +
+		"SUSPENDED|viz01|1:00:00|physics|user02|bash|/bin/bash|N/A|1|N/A|N/A|cpu=2,gres/gpu:quadro=1,gres/gpu=1\n")
+	consumed, held := SelectConsumedTRES(tres, []string{"RUNNING"}, ParseSinfoGPUs(sinfo, nil).noConsumeNodes)
+	assert.Equal(t, map[string]float64{"a100": 2}, ParseAllocatedGPUs(consumed, nil))
+	assert.Equal(t, map[string]float64{"a100": 1}, ParseAllocatedGPUs(held, nil))
+	assert.Equal(t, map[string]map[string]float64{"a100": {"2-4": 1}}, ParseGPUJobsBySize(consumed, nil))
+	assert.Equal(t, float64(18), ParseTRESAlloc(consumed, nil)["cpu"])
+
+	// Without no_consume nodes every GPU is consumed
+	consumed, held = SelectConsumedTRES(tres, []string{"RUNNING"}, nil)
+	assert.Equal(t, map[string]float64{"a100": 3}, ParseAllocatedGPUs(consumed, nil))
+	assert.Empty(t, held)
+
+	// Nor are they allocated in the partition of the node
+	pn := parsePartitionNodes([]byte("gpu|gpu01|gpu:a100:4(S:0-1)\ngpu|viz01|gpu:a100:no_consume:2\n"))
+	squeue := []byte("gpu|gpu01|cpu=16,gres/gpu:a100=2\ngpu|viz01|cpu=2,gres/gpu:a100=1\n")
+	assert.Equal(t, map[string]map[string]float64{"gpu": {"a100": 2}}, ParsePartitionAllocatedGPUs(squeue, pn, nil, nil))
+}
+
+func TestParseAllocatedGPUsMalformed(t *testing.T) {
+	// A token without a count and spaces around the resources
+	data := []byte("billing=30,cpu=16,gres/gpu,gres/gpu:a100=2,node=1\n" +
+		"billing=8, cpu=8 , gres/gpu:a100 = 1,=,gres/gpu:v100=x,node=1\n")
+	assert.Equal(t, map[string]float64{"a100": 3}, ParseAllocatedGPUs(data, nil))
+	assert.Equal(t, float64(24), ParseTRESAlloc(data, nil)["cpu"])
+
+	tres := []byte("RUNNING|gpu01|1:00:00|physics|user01|train|train.sh|N/A|1|N/A|N/A|billing=8, cpu=8, gres/gpu:a100=1\n")
+	assert.Equal(t, map[string]float64{"a100": 1}, ParseAllocatedGPUs(SelectTRES(tres, []string{"RUNNING"}), nil))
+}
+
+func TestGPUsByTimeLimit(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/squeue_gpus_timelimit.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	assert.Equal(t, map[string]map[string]float64{
+		"a100":   {"<1h": 2, "1d-7d": 4, "7d+": 1},
+		"v100":   {"1h-1d": 1},
+		"quadro": {"unlimited": 1},
+	}, ParseGPUsByTimeLimit(data, nil))
+}
+
+func TestPartitionNonGPUJobs(t *testing.T) {
+	squeue, err := ioutil.ReadFile("test_data/squeue_partition_tres.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	sinfo := []byte("gpu gpu01 gpu:a100:4(S:0-1)\n" +
+		"gpu-shared gpu02 gpu:v100:2(S:0)\n" +
+		"cpu c01 (null)\n")
+	gpuPartitions := ParsePartitionTotalGPUs(sinfo, nil, nil)
+
+	// The jobs of the cpu partition are expected to hold no GPU
+	assert.Equal(t, map[string]float64{"gpu": 2, "gpu-shared": 0}, ParsePartitionNonGPUJobs(squeue, gpuPartitions, nil))
+	assert.Equal(t, float64(2), ParsePartitionGPUsMetrics(sinfo, squeue, nil, nil)["gpu"]["a100"].alloc)
+}
+
+func TestParseTRESIndex(t *testing.T) {
+	clean := ParseTRES("cpu=8,mem=64G,gres/gpu=2,gres/gpu:a100=2", nil)
+	assert.Equal(t, float64(2), clean["gres/gpu:a100"])
+	for _, tres := range []string{
+		"cpu=8,mem=64G,gres/gpu=2,gres/gpu:a100=2(IDX:0-1)",
+		"cpu=8,mem=64G,gres/gpu=2(IDX:0,3),gres/gpu:a100=2(IDX:0,3)",
+	} {
+		assert.Equal(t, clean, ParseTRES(tres, nil), tres)
+	}
+
+	// The idle GPUs of the scontrol source
+	scontrol := []byte("NodeName=gpu01 Gres=gpu:a100:4(S:0-1) AllocTRES=cpu=8,gres/gpu=2,gres/gpu:a100=2(IDX:0,3)\n")
+	assert.Equal(t, map[string]float64{"a100": 2}, ParseIdleGPUsFromScontrol(scontrol, nil))
+}
+
+func TestGPUsAllocChanges(t *testing.T) {
+	ac := NewGPUsAllocChanges()
+	// The first scrape has nothing to compare to
+	assert.Equal(t, map[string]float64{"a100": 0, "v100": 0}, ac.Observe(map[string]float64{"a100": 6, "v100": 1}))
+	ac.Observe(map[string]float64{"a100": 4, "v100": 1})
+	ac.Observe(map[string]float64{"a100": 6, "v100": 1, "k80": 2})
+	assert.Equal(t, map[string]float64{"a100": 2, "v100": 0, "k80": 0}, ac.Observe(map[string]float64{"a100": 6, "v100": 1, "k80": 2}))
+	assert.Equal(t, map[string]float64{"a100": 2, "v100": 1, "k80": 0}, ac.Observe(map[string]float64{"a100": 6, "v100": 0, "k80": 2}))
+}
+
+func TestParseStrict(t *testing.T) {
+	defer func(strict bool) { *parseStrict = strict }(*parseStrict)
+	sinfo, err := ioutil.ReadFile("test_data/sinfo_gpus_malformed.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	pe := &ParseErrors{}
+
+	// Lenient, the malformed gres of gpu02 is skipped and logged
+	*parseStrict = false
+	assert.Equal(t, map[string]float64{"a100": 4}, ParseTotalGPUs(sinfo, pe))
+	assert.NoError(t, pe.Take())
+
+	*parseStrict = true
+	assert.Equal(t, map[string]float64{"a100": 4}, ParseTotalGPUs(sinfo, pe))
+	err = pe.Take()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "gpu:a100:four(S:0-1)")
+	assert.NoError(t, pe.Take())
+	ParseTRES("cpu=4,gres/gpu=two", pe)
+	assert.Contains(t, pe.Take().Error(), "gres/gpu=two")
+}
+
+func TestTotalGPUsGarbageLines(t *testing.T) {
+	sinfo, err := ioutil.ReadFile("test_data/sinfo_gpus_garbage.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	pe := &ParseErrors{}
+
+	// The truncated lines and the bad counts are skipped as a whole,
+	// the GPUs of the other nodes are intact
+	assert.Equal(t, map[string]float64{"a100": 8, "v100": 2, "k80": 8}, ParseTotalGPUs(sinfo, pe))
+	assert.Equal(t, float64(5), pe.Total())
+}
+
+func TestGPUsCollectorStrict(t *testing.T) {
+	defer func(strict bool) { *parseStrict = strict }(*parseStrict)
+	defer fakeSlurm(t, map[string][]fakeOutput{
+		"sinfo":    {{"*", "test_data/sinfo_gpus_malformed.txt"}},
+		"scontrol": {{"*", "test_data/scontrol_nodes.txt"}},
+		"squeue": {
+			{"*state:.*", "test_data/squeue_tres_states.txt"},
+		},
+	})()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewGPUsCollector())
+
+	// The sinfo output is parsed once, its malformed line counted once
+	*parseStrict = false
+	assert.Equal(t, float64(1), collectMetrics(t, registry)["slurm_gpus_parse_errors_total"])
+
+	*parseStrict = true
+	_, err := registry.Gather()
+	// The malformed line is reported once
+	if assert.Error(t, err) {
+		assert.True(t, strings.HasSuffix(err.Error(), `: malformed sinfo line "gpu02|gpu:a100:four(S:0-1)", gres "gpu:a100:four(S:0-1)", no GPU count`), err.Error())
+	}
+
+	// The counter of the collector goes on in both modes, by the lines
+	// skipped in its own scrapes
+	*parseStrict = false
+	assert.Equal(t, float64(3), collectMetrics(t, registry)["slurm_gpus_parse_errors_total"])
+}
+
+func TestSeedGPUTypes(t *testing.T) {
+	config, err := ioutil.ReadFile("test_data/scontrol_config.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	nodes, err := ioutil.ReadFile("test_data/scontrol_nodes_seed.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	assert.Equal(t, []string{"gpu", "tmpdisk"}, ParseGresTypes(map[string]string{"GresTypes": "gpu, tmpdisk"}))
+	assert.Equal(t, []string{"a100", "h100", "k80", "v100"}, SeedGPUTypes(config, nodes, nil))
+	// Without gpu in GresTypes there is no GPU type
+	assert.Equal(t, []string{}, SeedGPUTypes([]byte("GresTypes               = tmpdisk\n"), nodes, nil))
+}
+
+func TestGPUsCollectorSeedTypes(t *testing.T) {
+	defer func(seed bool) { *gpuSeedTypes = seed }(*gpuSeedTypes)
+	defer fakeSlurm(t, map[string][]fakeOutput{
+		"sinfo": {{"*", "test_data/sinfo_gpus.txt"}},
+		"scontrol": {
+			{"*config*", "test_data/scontrol_config.txt"},
+			{"*", "test_data/scontrol_nodes_seed.txt"},
+		},
+		"squeue": {
+			{"*state:.*", "test_data/squeue_tres_states.txt"},
+		},
+	})()
+
+	*gpuSeedTypes = true
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewGPUsCollector())
+	metrics := collectMetrics(t, registry)
+	// The h100 nodes are not in sinfo yet
+	assert.Contains(t, metrics, `slurm_gpus_total{type="h100"}`)
+	assert.Contains(t, metrics, `slurm_gpus_utilization{type="h100"}`)
+	assert.Equal(t, float64(0), metrics[`slurm_gpus_total{type="h100"}`])
+	assert.Equal(t, float64(0), metrics[`slurm_gpus_utilization{type="h100"}`])
+	assert.Equal(t, float64(8), metrics[`slurm_gpus_total{type="a100"}`])
+}
+
+func TestGPUsCollectorNoJobs(t *testing.T) {
+	defer fakeSlurm(t, map[string][]fakeOutput{
+		"sinfo":    {{"*", "test_data/sinfo_gpus.txt"}},
+		"scontrol": {{"*", "test_data/scontrol_nodes.txt"}},
+		"squeue":   {{"*", "test_data/squeue_empty.txt"}},
+	})()
+	assert.Equal(t, map[string]float64{}, ParseAllocatedGPUs([]byte(""), nil))
+
+	// An idle cluster has all its GPUs idle
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewGPUsCollector())
+	metrics := collectMetrics(t, registry)
+	assert.Equal(t, float64(0), metrics[`slurm_gpus_alloc{type="a100"}`])
+	assert.Equal(t, float64(8), metrics[`slurm_gpus_idle{type="a100"}`])
+	assert.Equal(t, float64(0), metrics[`slurm_gpus_alloc_all`])
+}
+
+func TestGPUsCollectorSqueueFailure(t *testing.T) {
+	// The fixture is missing, so the fake squeue exits with 1
+	defer fakeSlurm(t, map[string][]fakeOutput{
+		"sinfo":    {{"*", "test_data/sinfo_gpus.txt"}},
+		"scontrol": {{"*", "test_data/scontrol_nodes.txt"}},
+		"squeue":   {{"*", "test_data/missing.txt"}},
+	})()
+	_, err := TRESAllocData([]string{"RUNNING"})
+	assert.Error(t, err)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewGPUsCollector())
+	_, err = registry.Gather()
+	assert.Error(t, err)
+}
+
+func TestGPUsCollectorCommandFailure(t *testing.T) {
+	// Every command of the scrape fails it rather than exiting, here the
+	// sinfo of the features
+	defer fakeSlurm(t, map[string][]fakeOutput{
+		"sinfo": {
+			{"*%f*", "test_data/missing.txt"},
+			{"*", "test_data/sinfo_gpus.txt"},
+		},
+		"scontrol": {{"*", "test_data/scontrol_nodes.txt"}},
+		"squeue": {
+			{"*state:.*", "test_data/squeue_tres_states.txt"},
+			{"*", "test_data/squeue_gpus.txt"},
+		},
+	})()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewGPUsCollector())
+	_, err := registry.Gather()
+	assert.Error(t, err)
+
+	// The partitions do not need that sinfo
+	registry = prometheus.NewRegistry()
+	registry.MustRegister(NewPartitionGPUsCollector())
+	_, err = registry.Gather()
+	assert.NoError(t, err)
+}
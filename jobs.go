@@ -0,0 +1,446 @@
+/* Copyright 2017 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type JobsMetrics struct {
+	// partition -> state -> count
+	jobs NVal
+	// components of heterogeneous jobs
+	hetjob_components float64
+}
+
+// Returns the jobs metrics
+func JobsGetMetrics() *JobsMetrics {
+	return ParseJobsMetrics(JobsData())
+}
+
+// ParseJobsMetrics counts the jobs by (partition,state) pair. Every
+// component of a heterogeneous job has its own line (e.g. 12345+0,
+// 12345+1), the job is only counted once with its leader (+0).
+func ParseJobsMetrics(input []byte) *JobsMetrics {
+	jm := JobsMetrics{
+		jobs: make(NVal),
+	}
+	for _, line := range strings.Split(string(input), "\n") {
+		if strings.Contains(line, "|") {
+			fields := strings.Split(line, "|")
+			if len(fields) < 3 {
+				continue
+			}
+			id := strings.TrimSpace(fields[0])
+			partition := strings.TrimSpace(fields[1])
+			state := strings.TrimSpace(fields[2])
+			if i := strings.Index(id, "+"); i >= 0 {
+				jm.hetjob_components++
+				if id[i+1:] != "0" {
+					continue
+				}
+			}
+			jm.jobs.Incr(partition, state, 1)
+		}
+	}
+	return &jm
+}
+
+// Execute the squeue command and return the id, partition and state of every job
+func JobsData() []byte {
+	return Execute("squeue", []string{"-a", "-r", "-h", "-o", "%i|%P|%T"})
+}
+
+// Execute the squeue command and return the time left of the running jobs
+func JobsTimeLeftData() []byte {
+	return Execute("squeue", []string{"-a", "-r", "-h", "-t", "RUNNING", "-o", "%L"})
+}
+
+// Execute the squeue command and return the number of nodes and the
+// compact state of every job
+func JobsNodesData() []byte {
+	return Execute("squeue", []string{"-a", "-r", "-h", "-o", "%D %t"})
+}
+
+// Compact job states of squeue %t the average job size and the jobs
+// without a time limit are exported for
+var compactJobStates = map[string]string{
+	"R":  "RUNNING",
+	"PD": "PENDING",
+}
+
+// ParseJobsAvgNodes averages the number of nodes of the running and of the
+// pending jobs, big jobs pending behind small running ones point at a
+// fragmented cluster. A state without any job has an average of 0.
+func ParseJobsAvgNodes(input []byte) map[string]float64 {
+	nodes := make(map[string]float64)
+	jobs := make(map[string]float64)
+	for _, line := range strings.Split(string(input), "\n") {
+		// e.g. 4 PD
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		state, ok := compactJobStates[fields[1]]
+		if !ok {
+			continue
+		}
+		count, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			continue
+		}
+		nodes[state] += count
+		jobs[state]++
+	}
+	avg := make(map[string]float64)
+	for _, state := range compactJobStates {
+		avg[state] = 0
+		if jobs[state] > 0 {
+			avg[state] = nodes[state] / jobs[state]
+		}
+	}
+	return avg
+}
+
+// Execute the squeue command and return the time limit and the compact
+// state of every job
+func JobsTimeLimitData() []byte {
+	return Execute("squeue", []string{"-a", "-r", "-h", "-o", "%l %t"})
+}
+
+// ParseJobsNoTimeLimit counts the running and the pending jobs with an
+// UNLIMITED time limit, allowed by the partitions without a MaxTime
+func ParseJobsNoTimeLimit(input []byte) map[string]float64 {
+	jobs := make(map[string]float64)
+	for _, state := range compactJobStates {
+		jobs[state] = 0
+	}
+	for _, line := range strings.Split(string(input), "\n") {
+		// e.g. UNLIMITED R
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != "UNLIMITED" {
+			continue
+		}
+		if state, ok := compactJobStates[fields[1]]; ok {
+			jobs[state]++
+		}
+	}
+	return jobs
+}
+
+// ParseSlurmDuration parses a duration in one of the Slurm time formats:
+// "minutes", "minutes:seconds", "hours:minutes:seconds", "days-hours",
+// "days-hours:minutes" or "days-hours:minutes:seconds". UNLIMITED,
+// NOT_SET and INVALID have no duration and are reported as not ok.
+func ParseSlurmDuration(input string) (time.Duration, bool) {
+	input = strings.TrimSpace(input)
+	days := 0
+	if i := strings.Index(input, "-"); i >= 0 {
+		d, err := strconv.Atoi(input[:i])
+		if err != nil {
+			return 0, false
+		}
+		days = d
+		input = input[i+1:]
+	}
+	var values []int
+	for _, part := range strings.Split(input, ":") {
+		v, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, false
+		}
+		values = append(values, v)
+	}
+	var hours, minutes, seconds int
+	switch {
+	case len(values) == 3:
+		hours, minutes, seconds = values[0], values[1], values[2]
+	case len(values) == 2 && days > 0:
+		hours, minutes = values[0], values[1]
+	case len(values) == 2:
+		minutes, seconds = values[0], values[1]
+	case len(values) == 1 && days > 0:
+		hours = values[0]
+	case len(values) == 1:
+		minutes = values[0]
+	default:
+		return 0, false
+	}
+	d := time.Duration(days)*24*time.Hour +
+		time.Duration(hours)*time.Hour +
+		time.Duration(minutes)*time.Minute +
+		time.Duration(seconds)*time.Second
+	return d, true
+}
+
+// ParseJobsNearTimeLimit counts the jobs with less time left than the
+// threshold, jobs without a time limit are left out
+func ParseJobsNearTimeLimit(input []byte, threshold time.Duration) float64 {
+	count := float64(0)
+	for _, line := range strings.Split(string(input), "\n") {
+		left, ok := ParseSlurmDuration(line)
+		if ok && left < threshold {
+			count++
+		}
+	}
+	return count
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * Slurm jobs metrics into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+func NewJobsCollector() *JobsCollector {
+	return &JobsCollector{
+		// At most one series per partition and job state
+		jobs:          NewDesc("slurm_jobs", "Jobs by partition and state", []string{"partition", "state"}, nil),
+		nearTimeLimit: NewDesc("slurm_jobs_near_timelimit", "Running jobs with less time left than the threshold", nil, nil),
+		hetComponents: NewDesc("slurm_hetjob_components", "Components of the heterogeneous jobs in the queue", nil, nil),
+		avgNodes:      NewDesc("slurm_jobs_avg_nodes", "Average number of nodes of the jobs by state", []string{"state"}, nil),
+		noTimeLimit:   NewDesc("slurm_jobs_no_timelimit", "Jobs with an UNLIMITED time limit by state", []string{"state"}, nil),
+		threshold:     *jobsTimeLimitThreshold,
+	}
+}
+
+type JobsCollector struct {
+	jobs          *prometheus.Desc
+	nearTimeLimit *prometheus.Desc
+	hetComponents *prometheus.Desc
+	avgNodes      *prometheus.Desc
+	noTimeLimit   *prometheus.Desc
+	threshold     time.Duration
+}
+
+func (jc *JobsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- jc.jobs
+	ch <- jc.nearTimeLimit
+	ch <- jc.hetComponents
+	ch <- jc.avgNodes
+	ch <- jc.noTimeLimit
+}
+
+func (jc *JobsCollector) Collect(ch chan<- prometheus.Metric) {
+	jm := JobsGetMetrics()
+	PushMetric(jm.jobs, ch, jc.jobs, "")
+	ch <- prometheus.MustNewConstMetric(jc.hetComponents, prometheus.GaugeValue, jm.hetjob_components)
+	near := ParseJobsNearTimeLimit(JobsTimeLeftData(), jc.threshold)
+	ch <- prometheus.MustNewConstMetric(jc.nearTimeLimit, prometheus.GaugeValue, near)
+	for state, avg := range ParseJobsAvgNodes(JobsNodesData()) {
+		ch <- prometheus.MustNewConstMetric(jc.avgNodes, prometheus.GaugeValue, avg, state)
+	}
+	for state, count := range ParseJobsNoTimeLimit(JobsTimeLimitData()) {
+		ch <- prometheus.MustNewConstMetric(jc.noTimeLimit, prometheus.GaugeValue, count, state)
+	}
+}
+
+// Execute the sacct command and return the submit and start times of the
+// jobs of the window
+func JobsStartDelayData(window time.Duration) []byte {
+	start := fmt.Sprintf("now-%dseconds", int(window.Seconds()))
+	return Execute("sacct", []string{"-a", "-n", "-X", "-S", start, "-o", "JobID,Submit,Start", "--parsable2"})
+}
+
+type JobStart struct {
+	id    string
+	start time.Time
+	delay float64 // seconds
+}
+
+// ParseJobStarts takes the JobID|Submit|Start lines of sacct and returns
+// the jobs which started, with the time they waited in the queue. Pending
+// jobs have an Unknown or None start time.
+func ParseJobStarts(input []byte) []JobStart {
+	starts := []JobStart{}
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) < 3 {
+			continue
+		}
+		submit, err := time.ParseInLocation("2006-01-02T15:04:05", fields[1], time.Local)
+		if err != nil {
+			continue
+		}
+		start, err := time.ParseInLocation("2006-01-02T15:04:05", fields[2], time.Local)
+		if err != nil {
+			continue
+		}
+		delay := start.Sub(submit).Seconds()
+		if delay < 0 {
+			delay = 0
+		}
+		starts = append(starts, JobStart{fields[0], start, delay})
+	}
+	return starts
+}
+
+// Buckets of the queue wait, from a minute to a day
+var startDelayBuckets = []float64{60, 300, 900, 1800, 3600, 7200, 14400, 28800, 86400}
+
+// StartDelayCollector observes the queue wait of every job once, when it
+// shows up as started in the sacct window.
+type StartDelayCollector struct {
+	delay  prometheus.Histogram
+	window time.Duration
+	mu     sync.Mutex
+	seen   map[string]time.Time
+}
+
+func NewStartDelayCollector() *StartDelayCollector {
+	return &StartDelayCollector{
+		delay: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        MetricName("slurm_job_start_delay_seconds"),
+			Help:        "Time the started jobs waited in the queue between their submission and their start",
+			ConstLabels: ConstLabels(),
+			Buckets:     startDelayBuckets,
+		}),
+		window: *jobsStartDelayWindow,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// Observe records the jobs started within the window which were not seen
+// yet, and forgets the ones which left the window
+func (sc *StartDelayCollector) Observe(starts []JobStart, now time.Time) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	oldest := now.Add(-sc.window)
+	for _, s := range starts {
+		if _, ok := sc.seen[s.id]; ok || s.start.Before(oldest) {
+			continue
+		}
+		sc.seen[s.id] = s.start
+		sc.delay.Observe(s.delay)
+	}
+	for id, start := range sc.seen {
+		if start.Before(oldest) {
+			delete(sc.seen, id)
+		}
+	}
+}
+
+func (sc *StartDelayCollector) Describe(ch chan<- *prometheus.Desc) {
+	sc.delay.Describe(ch)
+}
+
+func (sc *StartDelayCollector) Collect(ch chan<- prometheus.Metric) {
+	sc.Observe(ParseJobStarts(JobsStartDelayData(sc.window)), time.Now())
+	sc.delay.Collect(ch)
+}
+
+// Execute the sacct command and return the end time and the CPU usage of
+// the jobs completed within the window
+func JobsCPUEfficiencyData(window time.Duration) []byte {
+	start := fmt.Sprintf("now-%dseconds", int(window.Seconds()))
+	return Execute("sacct", []string{"-a", "-n", "-X", "-s", "CD", "-S", start, "-E", "now", "-o", "JobID,End,TotalCPU,AllocCPUS,Elapsed", "--parsable2"})
+}
+
+type JobEfficiency struct {
+	id         string
+	end        time.Time
+	efficiency float64 // TotalCPU / (AllocCPUS * Elapsed)
+}
+
+// ParseJobEfficiencies takes the JobID|End|TotalCPU|AllocCPUS|Elapsed lines
+// of sacct and returns the CPU efficiency of the jobs. TotalCPU has
+// milliseconds, e.g. 01:02:03.456 or 12:34.567. Jobs without an elapsed
+// time or CPUs are left out.
+func ParseJobEfficiencies(input []byte) []JobEfficiency {
+	efficiencies := []JobEfficiency{}
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) < 5 {
+			continue
+		}
+		end, err := time.ParseInLocation("2006-01-02T15:04:05", fields[1], time.Local)
+		if err != nil {
+			continue
+		}
+		total, ok := ParseSlurmDuration(strings.Split(fields[2], ".")[0])
+		if !ok {
+			continue
+		}
+		cpus, err := strconv.ParseFloat(fields[3], 64)
+		if err != nil || cpus == 0 {
+			continue
+		}
+		elapsed, ok := ParseSlurmDuration(fields[4])
+		if !ok || elapsed == 0 {
+			continue
+		}
+		efficiencies = append(efficiencies, JobEfficiency{fields[0], end, total.Seconds() / (cpus * elapsed.Seconds())})
+	}
+	return efficiencies
+}
+
+// CPUEfficiencyCollector observes the CPU efficiency of every job once,
+// when it shows up as completed in the sacct window, like the
+// StartDelayCollector.
+type CPUEfficiencyCollector struct {
+	efficiency prometheus.Histogram
+	window     time.Duration
+	mu         sync.Mutex
+	seen       map[string]time.Time
+}
+
+func NewCPUEfficiencyCollector() *CPUEfficiencyCollector {
+	return &CPUEfficiencyCollector{
+		efficiency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        MetricName("slurm_jobs_completed_cpu_efficiency"),
+			Help:        "CPU time of the completed jobs over their allocated CPUs times their elapsed time",
+			ConstLabels: ConstLabels(),
+			Buckets:     prometheus.LinearBuckets(0.1, 0.1, 10),
+		}),
+		window: *jobsCPUEfficiencyWindow,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// Observe records the jobs completed within the window which were not
+// seen yet, and forgets the ones which left the window
+func (ec *CPUEfficiencyCollector) Observe(efficiencies []JobEfficiency, now time.Time) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	oldest := now.Add(-ec.window)
+	for _, e := range efficiencies {
+		if _, ok := ec.seen[e.id]; ok || e.end.Before(oldest) {
+			continue
+		}
+		ec.seen[e.id] = e.end
+		ec.efficiency.Observe(e.efficiency)
+	}
+	for id, end := range ec.seen {
+		if end.Before(oldest) {
+			delete(ec.seen, id)
+		}
+	}
+}
+
+func (ec *CPUEfficiencyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ec.efficiency.Describe(ch)
+}
+
+func (ec *CPUEfficiencyCollector) Collect(ch chan<- prometheus.Metric) {
+	ec.Observe(ParseJobEfficiencies(JobsCPUEfficiencyData(ec.window)), time.Now())
+	ec.efficiency.Collect(ch)
+}
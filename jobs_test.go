@@ -0,0 +1,195 @@
+/* Copyright 2017 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobsMetrics(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/squeue_jobs.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	jm := ParseJobsMetrics(data)
+	t.Logf("%+v", jm)
+
+	assert.Equal(t, float64(2), jm.jobs["gpu"]["RUNNING"])
+	assert.Equal(t, float64(3), jm.jobs["gpu"]["PENDING"])
+	assert.Equal(t, float64(1), jm.jobs["gpu"]["SUSPENDED"])
+	assert.Equal(t, float64(1), jm.jobs["cpu"]["RUNNING"])
+	assert.Equal(t, float64(1), jm.jobs["cpu"]["COMPLETING"])
+	assert.Equal(t, float64(1), jm.jobs["debug"]["RUNNING"])
+	assert.NotContains(t, jm.jobs["debug"], "PENDING")
+	assert.Equal(t, float64(0), jm.hetjob_components)
+}
+
+func TestJobsMetricsHetJob(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/squeue_jobs_hetjob.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	jm := ParseJobsMetrics(data)
+	t.Logf("%+v", jm)
+
+	// 2001 has three components, counted once in the partition of its leader
+	assert.Equal(t, float64(3), jm.hetjob_components)
+	assert.Equal(t, float64(2), jm.jobs["gpu"]["RUNNING"])
+	assert.Equal(t, float64(1), jm.jobs["cpu"]["RUNNING"])
+	assert.Equal(t, float64(1), jm.jobs["cpu"]["PENDING"])
+}
+
+func TestParseSlurmDuration(t *testing.T) {
+	durations := map[string]time.Duration{
+		"5":          5 * time.Minute,
+		"05:30":      5*time.Minute + 30*time.Second,
+		"2:05:30":    2*time.Hour + 5*time.Minute + 30*time.Second,
+		"1-02":       26 * time.Hour,
+		"1-02:05":    26*time.Hour + 5*time.Minute,
+		"3-00:00:10": 72*time.Hour + 10*time.Second,
+	}
+	for input, expected := range durations {
+		d, ok := ParseSlurmDuration(input)
+		assert.True(t, ok, input)
+		assert.Equal(t, expected, d, input)
+	}
+	for _, input := range []string{"UNLIMITED", "NOT_SET", "INVALID", ""} {
+		_, ok := ParseSlurmDuration(input)
+		assert.False(t, ok, input)
+	}
+}
+
+func TestJobsNearTimeLimit(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/squeue_timeleft.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	// 12:00, 29:59 and 45 seconds left
+	assert.Equal(t, float64(3), ParseJobsNearTimeLimit(data, 30*time.Minute))
+	// plus 1:30:00
+	assert.Equal(t, float64(4), ParseJobsNearTimeLimit(data, 2*time.Hour))
+	// UNLIMITED is never counted
+	assert.Equal(t, float64(6), ParseJobsNearTimeLimit(data, 1000*time.Hour))
+}
+
+func TestJobStarts(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sacct_starts.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	starts := ParseJobStarts(data)
+
+	// The pending jobs 1003 and 1004 have not started
+	assert.Equal(t, 4, len(starts))
+	assert.Equal(t, "1001", starts[0].id)
+	assert.Equal(t, float64(1800), starts[0].delay)
+	assert.Equal(t, float64(60), starts[1].delay)
+	assert.Equal(t, float64(12*3600), starts[2].delay)
+	assert.Equal(t, float64(0), starts[3].delay)
+}
+
+func TestStartDelayCollector(t *testing.T) {
+	// The scrapes themselves find no new job
+	defer fakeSlurm(t, map[string][]fakeOutput{
+		"sacct": {{"*", "/dev/null"}},
+	})()
+	collector := NewStartDelayCollector()
+	collector.window = time.Hour
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	now := time.Now()
+	starts := []JobStart{
+		{"1001", now.Add(-30 * time.Minute), 1800},
+		{"1002", now.Add(-9 * time.Minute), 60},
+		{"1005", now.Add(-2 * time.Hour), 12 * 3600},
+	}
+
+	// 1005 started before the window
+	collector.Observe(starts, now)
+	metrics := collectMetrics(t, registry)
+	assert.Equal(t, float64(2), metrics["slurm_job_start_delay_seconds_count"])
+	assert.Equal(t, float64(1860), metrics["slurm_job_start_delay_seconds_sum"])
+
+	// The jobs seen by a previous scrape are observed once
+	collector.Observe(append(starts, JobStart{"1007", now, 120}), now)
+	metrics = collectMetrics(t, registry)
+	assert.Equal(t, float64(3), metrics["slurm_job_start_delay_seconds_count"])
+	assert.Equal(t, float64(1980), metrics["slurm_job_start_delay_seconds_sum"])
+}
+
+func TestJobEfficiencies(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sacct_efficiency.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	efficiencies := ParseJobEfficiencies(data)
+
+	// The jobs without CPUs or an end time are left out
+	assert.Equal(t, 3, len(efficiencies))
+	assert.Equal(t, "2001", efficiencies[0].id)
+	assert.Equal(t, float64(1), efficiencies[0].efficiency)
+	// 30 minutes of CPU over 2 CPUs for an hour
+	assert.Equal(t, 0.25, efficiencies[1].efficiency)
+	// 2 days of CPU over 16 CPUs for a day
+	assert.Equal(t, 0.125, efficiencies[2].efficiency)
+}
+
+func TestCPUEfficiencyCollector(t *testing.T) {
+	defer fakeSlurm(t, map[string][]fakeOutput{
+		"sacct": {{"*", "/dev/null"}},
+	})()
+	collector := NewCPUEfficiencyCollector()
+	collector.window = time.Hour
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	now := time.Now()
+	efficiencies := []JobEfficiency{
+		{"2001", now.Add(-30 * time.Minute), 1},
+		{"2002", now.Add(-5 * time.Minute), 0.25},
+		{"2003", now.Add(-2 * time.Hour), 0.125},
+	}
+
+	// 2003 completed before the window, the others are observed once
+	collector.Observe(efficiencies, now)
+	collector.Observe(efficiencies, now)
+	metrics := collectMetrics(t, registry)
+	assert.Equal(t, float64(2), metrics["slurm_jobs_completed_cpu_efficiency_count"])
+	assert.Equal(t, 1.25, metrics["slurm_jobs_completed_cpu_efficiency_sum"])
+}
+
+func TestJobsAvgNodes(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/squeue_nodes.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	assert.Equal(t, map[string]float64{"RUNNING": 2, "PENDING": 25.0 / 3}, ParseJobsAvgNodes(data))
+	assert.Equal(t, map[string]float64{"RUNNING": 0, "PENDING": 0}, ParseJobsAvgNodes(nil))
+}
+
+func TestJobsNoTimeLimit(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/squeue_timelimit.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	// The bounded and the completing jobs are left out
+	assert.Equal(t, map[string]float64{"RUNNING": 2, "PENDING": 1}, ParseJobsNoTimeLimit(data))
+	assert.Equal(t, map[string]float64{"RUNNING": 0, "PENDING": 0}, ParseJobsNoTimeLimit([]byte("1-00:00:00 R\n")))
+}
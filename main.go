@@ -16,49 +16,695 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>. */
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
 	"github.com/prometheus/common/log"
+	"net"
 	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
 )
 
-func init() {
+// RegisterCollectors registers the Slurm collectors to the given registry,
+// the GPUs collectors only if GPUs accounting is enabled, and returns
+// them. Overlapping scrapes share the collect in progress of every
+// collector.
+func RegisterCollectors(registry prometheus.Registerer, gpus bool) []prometheus.Collector {
+	collectors := []prometheus.Collector{
+		NewAccountsCollector(),   // from accounts.go
+		NewClusterCollector(),    // from config.go
+		NewCPUsCollector(),       // from cpus.go
+		NewNodesCollector(),      // from nodes.go
+		NewNodeCollector(),       // from node.go
+		NewPartitionsCollector(), // from partitions.go
+		NewQueueCollector(),      // from queue.go
+		NewSchedulerCollector(),  // from scheduler.go
+		NewFairShareCollector(),  // from sshare.go
+		NewJobsCollector(),       // from jobs.go
+		NewUsersCollector(),      // from users.go
+		NewTmpDiskCollector(),    // from tmpdisk.go
+	}
+
+	if gpus {
+		collectors = append(collectors,
+			NewGPUsCollector(),          // from gpus.go
+			NewPartitionGPUsCollector(), // from gpus.go
+			NewQOSCollector(),           // from qos.go
+			NewAssociationsCollector(),  // from associations.go
+			NewReservationsCollector(),  // from reservations.go
+		)
+	}
+
+	// sprio only works with the priority/multifactor plugin
+	if *priorityEnable {
+		collectors = append(collectors, NewPriorityCollector()) // from priority.go
+	}
+	if *jobsStartDelay {
+		collectors = append(collectors, NewStartDelayCollector()) // from jobs.go
+	}
+	if *jobsCPUEfficiency {
+		collectors = append(collectors, NewCPUEfficiencyCollector()) // from jobs.go
+	}
+
+	if *topologyEnable {
+		collectors = append(collectors, NewTopologyCollector()) // from topology.go
+	}
+	if *tresEnable {
+		collectors = append(collectors, NewTRESCollector(*tresInclude)) // from tres.go
+	}
+
+	// sstat queries the nodes of the jobs, only sampled jobs on demand
+	if *sstatEnable {
+		collectors = append(collectors, NewSstatCollector()) // from sstat.go
+	}
+
 	// Metrics have to be registered to be exposed
-	prometheus.MustRegister(NewAccountsCollector())       // from accounts.go
-	prometheus.MustRegister(NewCPUsCollector())           // from cpus.go
-	prometheus.MustRegister(NewNodesCollector())          // from nodes.go
-	prometheus.MustRegister(NewNodeCollector())           // from node.go
-	prometheus.MustRegister(NewPartitionsCollector())     // from partitions.go
-	prometheus.MustRegister(NewQueueCollector())          // from queue.go
-	prometheus.MustRegister(NewSchedulerCollector())      // from scheduler.go
-	prometheus.MustRegister(NewFairShareCollector())      // from sshare.go
-	prometheus.MustRegister(NewUsersCollector())          // from users.go
+	registered := []prometheus.Collector{}
+	for _, collector := range collectors {
+		locked := NewScrapeLockCollector(collector)
+		registry.MustRegister(locked)
+		registered = append(registered, locked)
+	}
+	return registered
 }
 
 var listenAddress = flag.String(
 	"listen-address",
 	":8080",
-	"The address to listen on for HTTP requests.")
+	"The address to listen on for HTTP requests, e.g. \":8080\", \"[::1]:8080\" or \"unix:/run/slurm_exporter.sock\".")
 
 var gpuAcct = flag.Bool(
 	"gpus-acct",
 	false,
 	"Enable GPUs accounting")
 
+var metricsPrefix = flag.String(
+	"metrics.prefix",
+	"slurm",
+	"Prefix of the names of all the metrics, replacing \"slurm\" (e.g. \"slurmgpu\" for slurmgpu_gpus_alloc) to namespace several exporters")
+
+var labelInstance = flag.String(
+	"label.instance",
+	"",
+	"Value of an instance label added to all the metrics, to tell the exporters apart without relabeling in Prometheus")
+
+var metricLabels = NewLabelsFlag(
+	"label",
+	"Constant label added to all the metrics as key=value, e.g. \"site=north\", can be repeated")
+
+var slurmClusterName = flag.String(
+	"slurm.cluster-name",
+	"",
+	"Query this cluster of a federation/multi-cluster setup, passed with -M to every Slurm command but sacctmgr and sstat")
+
+var slurmNoConvert = flag.Bool(
+	"slurm.noconvert",
+	false,
+	"Pass --noconvert to the Slurm commands which humanize the memory values (sacct and sstat), to get the raw byte counts")
+
+var nodesCompoundStates = flag.String(
+	"nodes.compound-states",
+	"primary",
+	"How the nodes in a compound state like \"idle+drain\" are counted: \"primary\" in the first state only, \"all\" in every state")
+
+var gpuPeakWindow = flag.Duration(
+	"gpu.peak-window",
+	time.Hour,
+	"Sliding window used to compute the peak of allocated GPUs")
+
+var gpuPlannedWindow = flag.Duration(
+	"gpu.planned-window",
+	time.Hour,
+	"Pending jobs planned by the backfill scheduler to start within this window are counted as planned GPUs")
+
+var usersPendingTop = flag.Int(
+	"users.pending-top",
+	0,
+	"Number of users with the oldest pending jobs the per-user pending wait is exported for, 0 for all the users")
+
+var gpuTopUsers = flag.Int(
+	"gpu.top-users",
+	10,
+	"Number of users with the most allocated GPUs exported per GPU type, 0 to disable")
+
+var gpuTypeInclude = flag.String(
+	"gpu.type-include",
+	"",
+	"Regular expression of the GPU types to export, all types when empty")
+
+var gpuTypeExclude = flag.String(
+	"gpu.type-exclude",
+	"",
+	"Regular expression of the GPU types to leave out, e.g. \"test|dev\"")
+
+var gpuIdleSource = flag.String(
+	"gpu.idle-source",
+	"computed",
+	"Source of the idle GPUs: \"computed\" as total minus allocated, or \"scontrol\" from the Gres and AllocTRES of every node")
+
+var gpuSeedTypes = flag.Bool(
+	"gpu.seed-types",
+	false,
+	"Read the GPU types configured on the nodes once, at the first collect, with GresTypes from scontrol show config, so their metrics stay at 0 rather than disappearing when all their nodes are gone from sinfo")
+
+var gpuAllocStates = flag.String(
+	"gpu.alloc-states",
+	"RUNNING",
+	"Comma-separated job states counted as allocated GPUs by the GPU collectors, e.g. \"RUNNING,SUSPENDED\" (or \"R,S\") with gang scheduling, the other collectors count the running jobs")
+
+var jobsTimeLimitThreshold = flag.Duration(
+	"jobs.timelimit-threshold",
+	30*time.Minute,
+	"Running jobs with less time left than this threshold are counted as near their time limit")
+
+var jobsStartDelay = flag.Bool(
+	"jobs.start-delay",
+	false,
+	"Export the time the started jobs waited in the queue, from sacct (requires the accounting database)")
+
+var jobsStartDelayWindow = flag.Duration(
+	"jobs.start-delay-window",
+	time.Hour,
+	"Window of the sacct query for the started jobs, longer than the scrape interval")
+
+var jobsCPUEfficiency = flag.Bool(
+	"jobs.cpu-efficiency",
+	false,
+	"Export the CPU efficiency of the completed jobs, from sacct (requires the accounting database)")
+
+var jobsCPUEfficiencyWindow = flag.Duration(
+	"jobs.cpu-efficiency-window",
+	time.Hour,
+	"Window of the sacct query for the completed jobs, longer than the scrape interval")
+
+var nodesCompletingThreshold = flag.Duration(
+	"nodes.completing-threshold",
+	10*time.Minute,
+	"Nodes completing for this long or longer are counted as stuck, e.g. with a hanging epilog")
+
+var nodesGPUOnly = flag.Bool(
+	"nodes.gpu-only",
+	false,
+	"Restrict the per node metrics and the node utilization to the nodes with GPUs in their gres, the CPU nodes being monitored elsewhere")
+
+var webOpenMetrics = flag.Bool(
+	"web.enable-openmetrics",
+	false,
+	"Expose the metrics in the OpenMetrics format to the scrapers asking for it")
+
+var cachePrewarm = flag.Bool(
+	"cache.prewarm",
+	false,
+	"Collect the metrics once at startup and serve them to the first scrape instead of running the Slurm commands cold")
+
+var webMaxRequests = flag.Int(
+	"web.max-requests",
+	0,
+	"Maximum number of concurrent scrapes, the scrapes beyond it get a 429 response, 0 for no limit")
+
+var webScrapeTimeout = flag.Duration(
+	"web.scrape-timeout",
+	0,
+	"Deadline of a scrape, a scrape still collecting past it (e.g. a deadlocked collector) gets a 503 response, 0 for no deadline")
+
+var pushGateway = flag.String(
+	"push.gateway",
+	"",
+	"URL of a Pushgateway, e.g. \"http://pushgateway:9091\": collect the metrics once, push them and exit instead of serving them, to run the exporter as a cron job")
+
+var pushJob = flag.String(
+	"push.job",
+	"slurm_exporter",
+	"Job label of the metrics pushed to the Pushgateway")
+
+var pushInstance = flag.String(
+	"push.instance",
+	"",
+	"Instance label of the metrics pushed to the Pushgateway, the host name if empty")
+
+var topologyEnable = flag.Bool(
+	"topology.enable",
+	false,
+	"Export the switches of the network tree from scontrol show topology (requires the topology/tree plugin)")
+
+var tresEnable = flag.Bool(
+	"tres.enable",
+	false,
+	"Export every TRES allocated to the running jobs (slurm_tres_alloc), including the resource types without a dedicated metric")
+
+var tresInclude = flag.String(
+	"tres.include",
+	"",
+	"Anchored regular expression of the TRES exported with -tres.enable to cap the cardinality, e.g. \"cpu|mem|gres/gpu:.*\", all of them if empty")
+
+var priorityEnable = flag.Bool(
+	"priority.enable",
+	false,
+	"Export the priority factors of the pending jobs from sprio (requires the priority/multifactor plugin)")
+
+var sstatEnable = flag.Bool(
+	"sstat.enable",
+	false,
+	"Export the memory and CPU usage of the running jobs from sstat, expensive on large clusters")
+
+var sstatMaxJobs = flag.Int(
+	"sstat.max-jobs",
+	20,
+	"Number of the longest running jobs sstat is run for")
+
+var parseStrict = flag.Bool(
+	"parse.strict",
+	false,
+	"Fail the scrape on the output lines the parsers can not read (e.g. a malformed gres or count) instead of skipping and logging them, to catch the format changes of a Slurm upgrade")
+
+var gpuSource = flag.String(
+	"gpu.source",
+	"sinfo",
+	"Command output the total GPUs are read from: \"sinfo\" with the format option (-o %G), or \"sinfo-long\" with the long format option (-O Gres)")
+
+var gpuPartitionPrecedence = flag.String(
+	"gpu.partition-precedence",
+	"",
+	"Comma-separated list of partitions, a node in several partitions only counts in the first listed one for the partition GPU totals, e.g. \"gpu,gpu-shared\"")
+
+var userAccounts = flag.String(
+	"accounts",
+	"",
+	"Comma-separated list of accounts the per-user GPU metrics are restricted to, e.g. \"physics,chemistry\", all accounts when empty")
+
+var gpuUtilizationPrecision = flag.Int(
+	"gpu.utilization-precision",
+	-1,
+	"Number of decimals the GPU utilization is rounded to, full precision when negative")
+
+var gpuUtilizationPercent = flag.Bool(
+	"gpu.utilization-percent",
+	false,
+	"Report the GPU utilization as a percentage from 0 to 100 rather than a ratio from 0 to 1, before the rounding of -gpu.utilization-precision")
+
+// Space-separated arguments appended to every invocation of a Slurm
+// command, set with -<command>.extra-args (e.g. -squeue.extra-args="--federation")
+var slurmExtraArgs = map[string]*string{}
+
+func init() {
+	for _, command := range []string{"sacct", "sacctmgr", "scontrol", "sdiag", "sinfo", "sprio", "squeue", "sshare", "sstat"} {
+		slurmExtraArgs[command] = flag.String(
+			command+".extra-args",
+			"",
+			fmt.Sprintf("Space-separated arguments appended to every %s command", command))
+	}
+}
+
+// Permissions of the Unix socket, readable and writable by the group
+// so that a sidecar proxy can connect to it
+const unixSocketMode = 0660
+
+// Listen opens the listener for the given address, either a TCP address
+// (IPv6 hosts have to be enclosed in brackets) or a Unix socket path
+// prefixed by "unix:".
+func Listen(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, "unix:") {
+		path := strings.TrimPrefix(address, "unix:")
+		if path == "" {
+			return nil, fmt.Errorf("missing socket path in listen address %q", address)
+		}
+		// Remove a stale socket left behind by a previous instance
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(path, unixSocketMode); err != nil {
+			listener.Close()
+			return nil, err
+		}
+		return listener, nil
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("invalid listen address %q: %v", address, err)
+	}
+	return net.Listen("tcp", address)
+}
+
+// Duration flags, given as Go durations (e.g. "90s", "5m" or "1h")
+var durationFlags = map[string]*time.Duration{
+	"gpu.peak-window":            gpuPeakWindow,
+	"gpu.planned-window":         gpuPlannedWindow,
+	"jobs.timelimit-threshold":   jobsTimeLimitThreshold,
+	"jobs.start-delay-window":    jobsStartDelayWindow,
+	"jobs.cpu-efficiency-window": jobsCPUEfficiencyWindow,
+	"nodes.completing-threshold": nodesCompletingThreshold,
+}
+
+// ValidateFlags checks the values of the command line options which the
+// flag package can not check by itself
+func ValidateFlags() error {
+	for name, d := range durationFlags {
+		if *d <= 0 {
+			return fmt.Errorf("invalid duration %s for -%s, expected a positive duration like \"90s\" or \"5m\"", *d, name)
+		}
+	}
+	if *gpuSource != "sinfo" && *gpuSource != "sinfo-long" {
+		return fmt.Errorf("invalid GPU source %q, expected \"sinfo\" or \"sinfo-long\"", *gpuSource)
+	}
+	if *gpuIdleSource != "computed" && *gpuIdleSource != "scontrol" {
+		return fmt.Errorf("invalid GPU idle source %q, expected \"computed\" or \"scontrol\"", *gpuIdleSource)
+	}
+	if *nodesCompoundStates != "primary" && *nodesCompoundStates != "all" {
+		return fmt.Errorf("invalid compound node states %q, expected \"primary\" or \"all\"", *nodesCompoundStates)
+	}
+	// The states are compared as squeue prints them, e.g. "r" or "R" is
+	// RUNNING
+	states, err := NormalizeJobStates(*gpuAllocStates)
+	if err != nil {
+		return fmt.Errorf("invalid -gpu.alloc-states %q: %v", *gpuAllocStates, err)
+	}
+	*gpuAllocStates = strings.Join(states, ",")
+	if _, err := regexp.Compile(*tresInclude); err != nil {
+		return fmt.Errorf("invalid TRES include expression %q: %v", *tresInclude, err)
+	}
+	labels, err := ParseConstLabels(*labelInstance, *metricLabels)
+	if err != nil {
+		return err
+	}
+	// The Pushgateway groups the metrics by instance, it refuses the
+	// metrics with an instance label
+	if _, ok := labels["instance"]; ok && *pushGateway != "" {
+		return fmt.Errorf("-label.instance can not be used with -push.gateway, the instance is set with -push.instance")
+	}
+	if !metricPrefixPattern.MatchString(*metricsPrefix) {
+		return fmt.Errorf("invalid metrics prefix %q, expected letters, digits and underscores", *metricsPrefix)
+	}
+	return nil
+}
+
+var metricPrefixPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// MetricName replaces the "slurm" prefix of a metric name with the prefix
+// set with -metrics.prefix
+func MetricName(name string) string {
+	return *metricsPrefix + strings.TrimPrefix(name, "slurm")
+}
+
+// LabelsFlag collects the key=value pairs of a repeated flag
+type LabelsFlag []string
+
+// NewLabelsFlag defines a repeated flag on the command line like the flag
+// functions define the other ones
+func NewLabelsFlag(name, usage string) *LabelsFlag {
+	var labels LabelsFlag
+	flag.Var(&labels, name, usage)
+	return &labels
+}
+
+func (l *LabelsFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *LabelsFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Variable labels of the metrics of the collectors, a constant label of
+// the same name would make the registration of the collector fail
+var collectorLabels = map[string]bool{
+	"account": true, "active_feature_set": true, "allocated": true, "bucket": true,
+	"caller": true, "command": true, "factor": true, "feature": true, "hold": true,
+	"host": true, "index": true, "job": true, "name": true, "node": true,
+	"operation": true, "partition": true, "qos": true, "rank": true, "reason": true,
+	"requested": true, "role": true, "size": true, "state": true, "status": true,
+	"switch": true, "to": true, "tres": true, "type": true, "user": true,
+	"version": true, "window": true,
+}
+
+// ParseConstLabels returns the labels of -label.instance and -label, a
+// label name reserved by Prometheus (leading "__") or used by the metrics,
+// an empty value or a label given twice is an error
+func ParseConstLabels(instance string, pairs []string) (prometheus.Labels, error) {
+	labels := prometheus.Labels{}
+	if instance != "" {
+		labels["instance"] = instance
+	}
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || !labelNamePattern.MatchString(kv[0]) || strings.HasPrefix(kv[0], "__") || kv[1] == "" {
+			return nil, fmt.Errorf("invalid label %q, expected key=value with a key of letters, digits and underscores", pair)
+		}
+		if collectorLabels[kv[0]] {
+			return nil, fmt.Errorf("invalid label %q, %s is a label of the metrics", pair, kv[0])
+		}
+		if _, ok := labels[kv[0]]; ok {
+			return nil, fmt.Errorf("label %q given twice", kv[0])
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return labels, nil
+}
+
+// ConstLabels returns the labels added to all the metrics, the flags are
+// checked by ValidateFlags
+func ConstLabels() prometheus.Labels {
+	labels, err := ParseConstLabels(*labelInstance, *metricLabels)
+	if err != nil {
+		return nil
+	}
+	return labels
+}
+
+// NewDesc is prometheus.NewDesc with the metrics prefix applied to the
+// name and the constant labels of the flags added, all the collectors
+// build their descriptions with it
+func NewDesc(name, help string, labels []string, constLabels prometheus.Labels) *prometheus.Desc {
+	merged := ConstLabels()
+	for key, value := range constLabels {
+		merged[key] = value
+	}
+	return prometheus.NewDesc(MetricName(name), help, labels, merged)
+}
+
+// MetricsHandler serves the metrics of the gatherer, in the OpenMetrics
+// format if enabled and negotiated by the scraper. The requests to the
+// handler are instrumented on the registerer.
+func MetricsHandler(registry prometheus.Registerer, gatherer prometheus.Gatherer, openMetrics bool) http.Handler {
+	return promhttp.InstrumentMetricHandler(registry, promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{
+		EnableOpenMetrics: openMetrics,
+	}))
+}
+
+// PushMetrics collects the metrics of the gatherer once and pushes them
+// to the Pushgateway, replacing the metrics previously pushed with the
+// same job and instance labels.
+func PushMetrics(gatherer prometheus.Gatherer, url, job, instance string) error {
+	return push.New(url, job).Gatherer(gatherer).Grouping("instance", instance).Push()
+}
+
+// LimitRequests serves at most max requests concurrently with the handler
+// and rejects the other ones with 429 Too Many Requests, so that several
+// scrapers do not multiply the load on the Slurm controller. A max of 0
+// or less does not limit the requests.
+func LimitRequests(handler http.Handler, max int) http.Handler {
+	if max <= 0 {
+		return handler
+	}
+	inFlight := make(chan struct{}, max)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case inFlight <- struct{}{}:
+			defer func() { <-inFlight }()
+			handler.ServeHTTP(w, r)
+		default:
+			http.Error(w, "Too many concurrent scrapes", http.StatusTooManyRequests)
+		}
+	})
+}
+
+// Records the status code sent by the wrapped handler
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// ScrapeTimeout answers 503 Service Unavailable to the scrapes which are
+// not served within the timeout, rather than hanging until the scraper
+// gives up, and counts them. A timeout of 0 or less sets no deadline.
+func ScrapeTimeout(handler http.Handler, timeout time.Duration, timeouts prometheus.Counter) http.Handler {
+	if timeout <= 0 {
+		return handler
+	}
+	handler = http.TimeoutHandler(handler, timeout, "Scrape timed out")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(sw, r)
+		if sw.status == http.StatusServiceUnavailable {
+			timeouts.Inc()
+		}
+	})
+}
+
+// Flags whose value is redacted on the /config endpoint
+var secretFlagPattern = regexp.MustCompile(`(?i)(key|token|password|secret)`)
+
+// The effective configuration of the exporter, served on /config
+type ExporterConfig struct {
+	Flags      map[string]string `json:"flags"`
+	Commands   map[string]string `json:"commands"`
+	Collectors []string          `json:"collectors"`
+}
+
+// CollectorName names a collector after its type, e.g. "gpus" for the
+// GPUsCollector, wrapped in a ScrapeLockCollector or not
+func CollectorName(collector prometheus.Collector) string {
+	if locked, ok := collector.(*ScrapeLockCollector); ok {
+		collector = locked.collector
+	}
+	name := strings.TrimPrefix(fmt.Sprintf("%T", collector), "*main.")
+	return strings.ToLower(strings.TrimSuffix(name, "Collector"))
+}
+
+// NewExporterConfig resolves the flags, the paths of the Slurm commands
+// and the names of the registered collectors
+func NewExporterConfig(collectors []prometheus.Collector, binaries []string) *ExporterConfig {
+	config := &ExporterConfig{
+		Flags:      make(map[string]string),
+		Commands:   make(map[string]string),
+		Collectors: []string{},
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if secretFlagPattern.MatchString(f.Name) && value != "" {
+			value = "<redacted>"
+		}
+		config.Flags[f.Name] = value
+	})
+	for _, binary := range binaries {
+		path, err := exec.LookPath(binary)
+		if err != nil {
+			path = ""
+		}
+		config.Commands[binary] = path
+	}
+	for _, collector := range collectors {
+		config.Collectors = append(config.Collectors, CollectorName(collector))
+	}
+	return config
+}
+
+func (config *ExporterConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(config); err != nil {
+		log.Errorf("Can not encode the configuration: %v", err)
+	}
+}
+
 func main() {
 	flag.Parse()
+	// Before any description is built with the prefix and the labels
+	if err := ValidateFlags(); err != nil {
+		log.Fatal(err)
+	}
 
-	// Turn on GPUs accounting only if the corresponding command line option is set to true.
+	// Fail at startup rather than on the first scrape if Slurm is not installed
+	binariesAvailable := NewSlurmBinariesAvailable()
+	prometheus.MustRegister(binariesAvailable)
+	commandOutputLines = NewCommandOutputLines()
+	prometheus.MustRegister(commandOutputLines)
+	commandsInFlight = NewCommandsInFlight()
+	prometheus.MustRegister(commandsInFlight)
+	scrapeTimeouts := prometheus.NewCounter(prometheus.CounterOpts{
+		Name:        MetricName("slurm_exporter_scrape_timeouts_total"),
+		Help:        "Scrapes answered with a 503 as they were not served within the scrape timeout",
+		ConstLabels: ConstLabels(),
+	})
+	prometheus.MustRegister(scrapeTimeouts)
+	binaries := append([]string{}, slurmBinaries...)
 	if *gpuAcct {
-		prometheus.MustRegister(NewGPUsCollector())            // from gpus.go
-		prometheus.MustRegister(NewPartitionGPUsCollector())   // from gpus.go
+		binaries = append(binaries, gpuBinaries...)
+	}
+	if *sstatEnable {
+		binaries = append(binaries, "sstat")
+	}
+	if *priorityEnable {
+		binaries = append(binaries, "sprio")
+	}
+	if *jobsStartDelay || *jobsCPUEfficiency {
+		binaries = append(binaries, "sacct")
+	}
+	missing := ProbeRequiredBinaries(binaries, binariesAvailable)
+	if len(missing) > 0 {
+		log.Fatalf("Slurm commands not found in PATH: %s", strings.Join(missing, ", "))
+	}
+	for _, binary := range ProbeSlurmBinaries(binaries) {
+		log.Warnf("Slurm command not found in PATH: %s, its metrics are skipped", binary)
+	}
+
+	filter, err := NewGPUTypeFilter(*gpuTypeInclude, *gpuTypeExclude)
+	if err != nil {
+		log.Fatal(err)
+	}
+	gpuTypeFilter = filter
+
+	// Turn on GPUs accounting only if the corresponding command line option is set to true.
+	collectors := RegisterCollectors(prometheus.DefaultRegisterer, *gpuAcct)
+	if *pushGateway != "" {
+		instance := *pushInstance
+		if instance == "" {
+			if instance, err = os.Hostname(); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := PushMetrics(prometheus.DefaultGatherer, *pushGateway, *pushJob, instance); err != nil {
+			log.Fatalf("Can not push the metrics to %s: %v", *pushGateway, err)
+		}
+		log.Infof("Pushed the metrics to %s", *pushGateway)
+		return
+	}
+	if *cachePrewarm {
+		go Prewarm(collectors)
 	}
 
 	// The Handler function provides a default handler to expose metrics
 	// via an HTTP server. "/metrics" is the usual endpoint for that.
 	log.Infof("Starting Server: %s", *listenAddress)
 	log.Infof("GPUs Accounting: %t", *gpuAcct)
-	http.Handle("/metrics", promhttp.Handler())
-	log.Fatal(http.ListenAndServe(*listenAddress, nil))
+	http.Handle("/debug/commands", commandLog)
+	http.Handle("/config", NewExporterConfig(collectors, binaries))
+	metrics := ScrapeTimeout(MetricsHandler(prometheus.DefaultRegisterer, prometheus.DefaultGatherer, *webOpenMetrics), *webScrapeTimeout, scrapeTimeouts)
+	http.Handle("/metrics", LimitRequests(metrics, *webMaxRequests))
+	listener, err := Listen(*listenAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := &http.Server{}
+
+	// Closing the server closes the listener, which removes the Unix socket
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Infof("Shutting down server")
+		server.Close()
+	}()
+
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
 }
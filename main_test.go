@@ -0,0 +1,462 @@
+/* Copyright 2017-2020 Victor Penso, Matteo Dessalvi, Joeri Hermans
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+// A fake Slurm command prints the fixture of the first case whose shell
+// pattern matches its arguments
+type fakeOutput struct {
+	args    string
+	fixture string
+}
+
+// fakeSlurm puts fake Slurm commands in front of the PATH, so that the
+// collectors can run without Slurm. The returned function restores the PATH.
+func fakeSlurm(t *testing.T, commands map[string][]fakeOutput) func() {
+	dir, err := ioutil.TempDir("", "fake_slurm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for command, outputs := range commands {
+		script := "#!/bin/sh\ncase \"$*\" in\n"
+		for _, output := range outputs {
+			fixture, err := filepath.Abs(output.fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			script += fmt.Sprintf("%s) cat '%s' ;;\n", output.args, fixture)
+		}
+		script += "esac\n"
+		if err := ioutil.WriteFile(filepath.Join(dir, command), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	return func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	}
+}
+
+// collectMetrics gathers all the metrics of a registry into a map of
+// 'name{label="value",...}' to value, for assertions
+func collectMetrics(t *testing.T, registry prometheus.Gatherer) map[string]float64 {
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Can not gather metrics: %v", err)
+	}
+	metrics := make(map[string]float64)
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			labels := []string{}
+			for _, label := range m.GetLabel() {
+				labels = append(labels, fmt.Sprintf("%s=%q", label.GetName(), label.GetValue()))
+			}
+			sort.Strings(labels)
+			name := family.GetName()
+			if len(labels) > 0 {
+				name += "{" + strings.Join(labels, ",") + "}"
+			}
+			switch {
+			case m.GetGauge() != nil:
+				metrics[name] = m.GetGauge().GetValue()
+			case m.GetCounter() != nil:
+				metrics[name] = m.GetCounter().GetValue()
+			case m.GetUntyped() != nil:
+				metrics[name] = m.GetUntyped().GetValue()
+			case m.GetHistogram() != nil:
+				metrics[family.GetName()+"_count"] = float64(m.GetHistogram().GetSampleCount())
+				metrics[family.GetName()+"_sum"] = m.GetHistogram().GetSampleSum()
+			}
+		}
+	}
+	return metrics
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slurm_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "exporter.sock")
+
+	listener, err := Listen("unix:" + path)
+	if err != nil {
+		t.Fatalf("Can not listen on socket: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(unixSocketMode), info.Mode().Perm())
+
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "slurm_test_gauge", Help: "Test gauge"})
+	gauge.Set(42)
+	registry.MustRegister(gauge)
+	server := &http.Server{Handler: promhttp.HandlerFor(registry, promhttp.HandlerOpts{})}
+	go server.Serve(listener)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	}}
+	resp, err := client.Get("http://unix/metrics")
+	if err != nil {
+		t.Fatalf("Request over socket failed: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Contains(t, string(body), "slurm_test_gauge 42")
+
+	// Shutting down removes the socket
+	server.Close()
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestListenAddress(t *testing.T) {
+	listener, err := Listen("[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+	listener.Close()
+
+	_, err = Listen("::1:8080")
+	assert.Error(t, err)
+	_, err = Listen("unix:")
+	assert.Error(t, err)
+}
+
+func TestRegisterCollectors(t *testing.T) {
+	// Every registry gets its own set of collectors
+	for i := 0; i < 2; i++ {
+		assert.NotPanics(t, func() { RegisterCollectors(prometheus.NewRegistry(), true) })
+	}
+}
+
+func TestMetricsHandlerOpenMetrics(t *testing.T) {
+	scrape := func(openMetrics bool) *http.Response {
+		registry := prometheus.NewRegistry()
+		gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "slurm_test", Help: "Test metric"})
+		registry.MustRegister(gauge)
+		request := httptest.NewRequest("GET", "/metrics", nil)
+		request.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+		recorder := httptest.NewRecorder()
+		MetricsHandler(registry, registry, openMetrics).ServeHTTP(recorder, request)
+		return recorder.Result()
+	}
+
+	response := scrape(true)
+	body, _ := ioutil.ReadAll(response.Body)
+	assert.Contains(t, response.Header.Get("Content-Type"), "application/openmetrics-text")
+	assert.Contains(t, string(body), "# TYPE slurm_test gauge")
+	assert.True(t, strings.HasSuffix(string(body), "# EOF\n"))
+
+	// Without the flag the text format is served whatever the scraper asks
+	response = scrape(false)
+	body, _ = ioutil.ReadAll(response.Body)
+	assert.Contains(t, response.Header.Get("Content-Type"), "text/plain")
+	assert.NotContains(t, string(body), "# EOF")
+}
+
+func TestLimitRequests(t *testing.T) {
+	started := make(chan bool)
+	release := make(chan bool)
+	blocking := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-release
+	})
+	handler := LimitRequests(blocking, 2)
+
+	done := make(chan int)
+	for i := 0; i < 2; i++ {
+		go func() {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+			done <- recorder.Code
+		}()
+		<-started
+	}
+
+	// The third concurrent scrape is rejected
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-done)
+	assert.Equal(t, http.StatusOK, <-done)
+
+	// Once the scrapes are over a new one is served
+	go func() { <-started }()
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+}
+
+// A collector blocking until released, like a deadlocked one
+type blockingCollector struct {
+	desc    *prometheus.Desc
+	release chan bool
+}
+
+func (bc *blockingCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- bc.desc
+}
+
+func (bc *blockingCollector) Collect(ch chan<- prometheus.Metric) {
+	<-bc.release
+	ch <- prometheus.MustNewConstMetric(bc.desc, prometheus.GaugeValue, 1)
+}
+
+func TestScrapeTimeout(t *testing.T) {
+	collector := &blockingCollector{
+		desc:    prometheus.NewDesc("slurm_test", "Test metric", nil, nil),
+		release: make(chan bool),
+	}
+	defer close(collector.release)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	timeouts := prometheus.NewCounter(prometheus.CounterOpts{Name: "slurm_test_timeouts_total", Help: "Test counter"})
+	handler := ScrapeTimeout(MetricsHandler(registry, registry, false), 50*time.Millisecond, timeouts)
+
+	start := time.Now()
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.True(t, time.Since(start) < 5*time.Second)
+
+	counters := prometheus.NewRegistry()
+	counters.MustRegister(timeouts)
+	assert.Equal(t, float64(1), collectMetrics(t, counters)["slurm_test_timeouts_total"])
+
+	// A scrape within the deadline is served
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "slurm_test", Help: "Test metric"})
+	served := prometheus.NewRegistry()
+	served.MustRegister(gauge)
+	recorder = httptest.NewRecorder()
+	ScrapeTimeout(MetricsHandler(served, served, false), time.Second, timeouts).ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, float64(1), collectMetrics(t, counters)["slurm_test_timeouts_total"])
+}
+
+func TestDurationFlags(t *testing.T) {
+	defer func(window time.Duration, threshold time.Duration) {
+		*gpuPeakWindow = window
+		*jobsTimeLimitThreshold = threshold
+	}(*gpuPeakWindow, *jobsTimeLimitThreshold)
+
+	for name := range durationFlags {
+		assert.NoError(t, flag.CommandLine.Set(name, "90s"), name)
+		assert.Equal(t, 90*time.Second, *durationFlags[name], name)
+	}
+	assert.NoError(t, ValidateFlags())
+
+	for name := range durationFlags {
+		// Bare integers are not durations
+		assert.Error(t, flag.CommandLine.Set(name, "90"), name)
+		assert.Error(t, flag.CommandLine.Set(name, "ninety seconds"), name)
+		assert.NoError(t, flag.CommandLine.Set(name, "90s"), name)
+	}
+
+	assert.NoError(t, flag.CommandLine.Set("gpu.peak-window", "0s"))
+	assert.Error(t, ValidateFlags())
+	assert.NoError(t, flag.CommandLine.Set("gpu.peak-window", "-5m"))
+	assert.Error(t, ValidateFlags())
+}
+
+func TestGPUAllocStates(t *testing.T) {
+	defer func(states string) { *gpuAllocStates = states }(*gpuAllocStates)
+
+	// Short names and any case, each state once
+	*gpuAllocStates = "r, s,Running"
+	assert.NoError(t, ValidateFlags())
+	assert.Equal(t, "RUNNING,SUSPENDED", *gpuAllocStates)
+	*gpuAllocStates = "PD,cg"
+	assert.NoError(t, ValidateFlags())
+	assert.Equal(t, "PENDING,COMPLETING", *gpuAllocStates)
+
+	*gpuAllocStates = "RUNNING,SUSPEND"
+	assert.EqualError(t, ValidateFlags(), `invalid -gpu.alloc-states "RUNNING,SUSPEND": invalid job state "SUSPEND"`)
+	*gpuAllocStates = ""
+	assert.Error(t, ValidateFlags())
+}
+
+func TestMetricsPrefix(t *testing.T) {
+	defer func(prefix string) { *metricsPrefix = prefix }(*metricsPrefix)
+	defer fakeSlurm(t, map[string][]fakeOutput{
+		"sdiag": {{"*", "test_data/sdiag.txt"}},
+	})()
+
+	assert.Equal(t, "slurm_gpus_alloc", MetricName("slurm_gpus_alloc"))
+	*metricsPrefix = "slurmgpu"
+	assert.Equal(t, "slurmgpu_gpus_alloc", MetricName("slurm_gpus_alloc"))
+	assert.NoError(t, ValidateFlags())
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewSchedulerCollector())
+	metrics := collectMetrics(t, registry)
+	assert.Contains(t, metrics, "slurmgpu_scheduler_threads")
+	assert.NotContains(t, metrics, "slurm_scheduler_threads")
+
+	*metricsPrefix = "slurm-gpu"
+	assert.Error(t, ValidateFlags())
+}
+
+func TestConstLabels(t *testing.T) {
+	defer func(instance string, labels LabelsFlag) {
+		*labelInstance = instance
+		*metricLabels = labels
+	}(*labelInstance, *metricLabels)
+	defer fakeSlurm(t, map[string][]fakeOutput{
+		"sinfo":    {{"*", "test_data/sinfo_gpus.txt"}},
+		"scontrol": {{"*", "test_data/scontrol_nodes.txt"}},
+		"squeue":   {{"*", "test_data/squeue_empty.txt"}},
+	})()
+
+	assert.NoError(t, flag.CommandLine.Set("label.instance", "gpu-exporter-1"))
+	assert.NoError(t, flag.CommandLine.Set("label", "site=north"))
+	assert.NoError(t, flag.CommandLine.Set("label", "env=prod"))
+	assert.NoError(t, ValidateFlags())
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewGPUsCollector())
+	metrics := collectMetrics(t, registry)
+	assert.Equal(t, float64(8), metrics[`slurm_gpus_idle{env="prod",instance="gpu-exporter-1",site="north",type="a100"}`])
+	assert.Contains(t, metrics, `slurm_gpus_alloc_all{env="prod",instance="gpu-exporter-1",site="north"}`)
+	assert.NotContains(t, metrics, `slurm_gpus_idle{type="a100"}`)
+
+	for _, label := range []string{"site", "site=", "=north", "1site=north", "__name__=x", "instance=other", "node=x", "partition=gpu"} {
+		*metricLabels = LabelsFlag{label}
+		assert.Error(t, ValidateFlags(), label)
+	}
+
+	// The Pushgateway sets the instance
+	*metricLabels = LabelsFlag{}
+	assert.NoError(t, flag.CommandLine.Set("push.gateway", "http://pushgateway:9091"))
+	defer func() { *pushGateway = "" }()
+	assert.Error(t, ValidateFlags())
+	*labelInstance = ""
+	assert.NoError(t, ValidateFlags())
+}
+
+func TestCollectorLabels(t *testing.T) {
+	defer func(flags []*bool, values []bool) {
+		for i, f := range flags {
+			*f = values[i]
+		}
+	}([]*bool{jobsStartDelay, jobsCPUEfficiency, sstatEnable, priorityEnable, topologyEnable, tresEnable},
+		[]bool{*jobsStartDelay, *jobsCPUEfficiency, *sstatEnable, *priorityEnable, *topologyEnable, *tresEnable})
+	*jobsStartDelay, *jobsCPUEfficiency, *sstatEnable = true, true, true
+	*priorityEnable, *topologyEnable, *tresEnable = true, true, true
+
+	// Every variable label of every collector is refused as a constant label
+	descs := make(chan *prometheus.Desc, 1000)
+	for _, collector := range RegisterCollectors(prometheus.NewRegistry(), true) {
+		collector.Describe(descs)
+	}
+	close(descs)
+	variableLabels := regexp.MustCompile(`variableLabels: \[([^\]]*)\]`)
+	for desc := range descs {
+		for _, label := range strings.Fields(variableLabels.FindStringSubmatch(desc.String())[1]) {
+			assert.True(t, collectorLabels[label], "%s of %s", label, desc)
+		}
+	}
+}
+
+func TestExporterConfig(t *testing.T) {
+	collectors := RegisterCollectors(prometheus.NewRegistry(), true)
+	config := NewExporterConfig(collectors, []string{"sh", "/nonexistent/bin/sinfo"})
+
+	recorder := httptest.NewRecorder()
+	config.ServeHTTP(recorder, httptest.NewRequest("GET", "/config", nil))
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	var served ExporterConfig
+	if err := json.NewDecoder(recorder.Body).Decode(&served); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, served.Collectors, "gpus")
+	assert.Contains(t, served.Collectors, "scheduler")
+	assert.NotEmpty(t, served.Commands["sh"])
+	assert.Equal(t, "", served.Commands["/nonexistent/bin/sinfo"])
+	assert.Equal(t, "slurm", served.Flags["metrics.prefix"])
+}
+
+func TestExporterConfigRedacted(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	defer func(commandLine *flag.FlagSet) { flag.CommandLine = commandLine }(flag.CommandLine)
+	flag.CommandLine = flags
+	flags.String("ssh.key-file", "/home/slurm/.ssh/id_rsa", "")
+	flags.String("api.token", "", "")
+	flags.String("listen-address", ":8080", "")
+
+	config := NewExporterConfig(nil, nil)
+	assert.Equal(t, "<redacted>", config.Flags["ssh.key-file"])
+	assert.Equal(t, "", config.Flags["api.token"])
+	assert.Equal(t, ":8080", config.Flags["listen-address"])
+}
+
+func TestPushMetrics(t *testing.T) {
+	defer fakeSlurm(t, map[string][]fakeOutput{
+		"sdiag": {{"*", "test_data/sdiag.txt"}},
+	})()
+	var method, path string
+	var body []byte
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewSchedulerCollector())
+	assert.NoError(t, PushMetrics(registry, gateway.URL, "slurm_exporter", "cluster1"))
+	assert.Equal(t, http.MethodPut, method)
+	assert.Equal(t, "/metrics/job/slurm_exporter/instance/cluster1", path)
+	assert.Contains(t, string(body), "slurm_scheduler_threads")
+
+	// A Pushgateway refusing the metrics is an error
+	gateway.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	assert.Error(t, PushMetrics(registry, gateway.URL, "slurm_exporter", "cluster1"))
+}
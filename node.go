@@ -16,11 +16,11 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>. */
 package main
 
 import (
-	"log"
-	"os/exec"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -141,12 +141,189 @@ func ParseNodeMetrics(input []byte) map[string]*NodeMetrics {
 // NodeData executes the sinfo command to get data for each node
 // It returns the output of the sinfo command
 func NodeData() []byte {
-	cmd := exec.Command("sinfo", "-h", "-N", "-O", "NodeList,AllocMem,Memory,CPUsState,StateLong,Gres,GresUsed:.")
-	out, err := cmd.Output()
-	if err != nil {
-		log.Fatal(err)
+	return Execute("sinfo", []string{"-h", "-N", "-O", "NodeList,AllocMem,Memory,CPUsState,StateLong,Gres,GresUsed:."})
+}
+
+// NodeCapacity stores the scheduling capacity of each node
+type NodeCapacity struct {
+	cpus   float64
+	weight float64
+}
+
+// ParseNodeCapacity takes the output of sinfo with the CPUs and the
+// scheduling weight of each node. Nodes with a lower weight are
+// allocated first.
+func ParseNodeCapacity(input []byte) map[string]*NodeCapacity {
+	nodes := make(map[string]*NodeCapacity)
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		cpus, _ := strconv.ParseFloat(fields[1], 64)
+		weight, _ := strconv.ParseFloat(fields[2], 64)
+		nodes[fields[0]] = &NodeCapacity{cpus, weight}
+	}
+	return nodes
+}
+
+// NodeCapacityData executes the sinfo command to get the CPUs and
+// weight of each node
+func NodeCapacityData() []byte {
+	return Execute("sinfo", []string{"-N", "-h", "-o", "%n %c %w"})
+}
+
+// ParseSlurmdVersions returns the Version= of the slurmd of every node in
+// scontrol show node -o. Nodes whose slurmd never registered have no
+// version and are left out.
+func ParseSlurmdVersions(input []byte) map[string]string {
+	versions := make(map[string]string)
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := ParseScontrolFields(line)
+		node, ok := fields["NodeName"]
+		if !ok {
+			continue
+		}
+		switch version := fields["Version"]; version {
+		case "", "(null)", "N/A":
+		default:
+			versions[node] = version
+		}
+	}
+	return versions
+}
+
+// NodeJobsData executes squeue to get the nodes of every running job
+func NodeJobsData() []byte {
+	return Execute("squeue", []string{"--state=RUNNING", "-h", "-o", "%N"})
+}
+
+// ParseNodeJobs counts the running jobs on every node, a job counts once
+// on each of its nodes, e.g. c[01-02] for c01 and c02
+func ParseNodeJobs(input []byte) map[string]float64 {
+	jobs := make(map[string]float64)
+	for _, line := range strings.Split(string(input), "\n") {
+		for _, node := range RemoveDuplicates(ExpandNodeList(strings.TrimSpace(line))) {
+			jobs[node]++
+		}
+	}
+	return jobs
+}
+
+// GPUNodes keeps the nodes advertising GPUs in their gres
+func GPUNodes(nodes map[string]*NodeMetrics) map[string]*NodeMetrics {
+	gpu_nodes := make(map[string]*NodeMetrics)
+	for node, metrics := range nodes {
+		if metrics.hasGPU {
+			gpu_nodes[node] = metrics
+		}
+	}
+	return gpu_nodes
+}
+
+// NodeStateChanges counts the state changes of every node between
+// consecutive scrapes, to catch the flapping nodes a gauge misses.
+type NodeStateChanges struct {
+	mu      sync.Mutex
+	last    map[string]string
+	changes map[string]map[string]float64 // node -> new state -> count
+}
+
+func NewNodeStateChanges() *NodeStateChanges {
+	return &NodeStateChanges{
+		last:    make(map[string]string),
+		changes: make(map[string]map[string]float64),
+	}
+}
+
+// Observe compares the state of every node to the previous scrape,
+// nodes seen for the first time are not counted as a change.
+func (sc *NodeStateChanges) Observe(states map[string]string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for node, state := range states {
+		if previous, ok := sc.last[node]; ok && previous != state {
+			if sc.changes[node] == nil {
+				sc.changes[node] = make(map[string]float64)
+			}
+			sc.changes[node][state]++
+		}
+	}
+	sc.last = states
+}
+
+// Changes returns a copy of the counts by node and new state
+func (sc *NodeStateChanges) Changes() map[string]map[string]float64 {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	changes := make(map[string]map[string]float64, len(sc.changes))
+	for node, counts := range sc.changes {
+		changes[node] = make(map[string]float64, len(counts))
+		for state, count := range counts {
+			changes[node][state] = count
+		}
 	}
-	return out
+	return changes
+}
+
+// NodeCompletingTracker remembers since when every node is completing, to
+// count the nodes stuck completing (e.g. with a hanging epilog) across
+// scrapes.
+type NodeCompletingTracker struct {
+	mu        sync.Mutex
+	threshold time.Duration
+	since     map[string]time.Time
+}
+
+func NewNodeCompletingTracker(threshold time.Duration) *NodeCompletingTracker {
+	return &NodeCompletingTracker{
+		threshold: threshold,
+		since:     make(map[string]time.Time),
+	}
+}
+
+// Stuck records the completing nodes and returns how many of them have
+// been completing for the threshold or longer
+func (ct *NodeCompletingTracker) Stuck(states map[string]string, now time.Time) float64 {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	since := make(map[string]time.Time)
+	stuck := float64(0)
+	for node, state := range states {
+		if !strings.HasPrefix(state, "comp") {
+			continue
+		}
+		start, ok := ct.since[node]
+		if !ok {
+			start = now
+		}
+		since[node] = start
+		if now.Sub(start) >= ct.threshold {
+			stuck++
+		}
+	}
+	ct.since = since
+	return stuck
+}
+
+// NodesUtilization returns the fraction of the usable nodes (neither down,
+// drained nor failed) which hold jobs, allocated, mixed or completing.
+// It is 0 when no node is usable.
+func NodesUtilization(states map[string]string) float64 {
+	usable, allocated := float64(0), float64(0)
+	for _, state := range states {
+		switch {
+		case strings.HasPrefix(state, "down"), strings.HasPrefix(state, "drain"), strings.HasPrefix(state, "fail"):
+			continue
+		case strings.HasPrefix(state, "alloc"), strings.HasPrefix(state, "mix"), strings.HasPrefix(state, "comp"):
+			allocated++
+		}
+		usable++
+	}
+	if usable == 0 {
+		return 0
+	}
+	return allocated / usable
 }
 
 type NodeCollector struct {
@@ -159,6 +336,21 @@ type NodeCollector struct {
 	memTotal *prometheus.Desc
 
 	gpuAlloc *prometheus.Desc
+
+	cpusTotal *prometheus.Desc
+	weight    *prometheus.Desc
+
+	stateChanges *prometheus.Desc
+	states       *NodeStateChanges
+
+	completingStuck *prometheus.Desc
+	completing      *NodeCompletingTracker
+
+	utilization *prometheus.Desc
+
+	slurmdVersion *prometheus.Desc
+
+	jobs *prometheus.Desc
 }
 
 // NewNodeCollector creates a Prometheus collector to keep all our stats in
@@ -168,15 +360,30 @@ func NewNodeCollector() *NodeCollector {
 	labels_gpu := []string{"node","type","index"}
 
 	return &NodeCollector{
-		cpuAlloc: prometheus.NewDesc("slurm_node_cpu_alloc", "Allocated CPUs per node", labels_cpu, nil),
-		cpuIdle:  prometheus.NewDesc("slurm_node_cpu_idle", "Idle CPUs per node", labels_cpu, nil),
-		cpuOther: prometheus.NewDesc("slurm_node_cpu_other", "Other CPUs per node", labels_cpu, nil),
-		cpuTotal: prometheus.NewDesc("slurm_node_cpu_total", "Total CPUs per node", labels_cpu, nil),
+		cpuAlloc: NewDesc("slurm_node_cpu_alloc", "Allocated CPUs per node", labels_cpu, nil),
+		cpuIdle:  NewDesc("slurm_node_cpu_idle", "Idle CPUs per node", labels_cpu, nil),
+		cpuOther: NewDesc("slurm_node_cpu_other", "Other CPUs per node", labels_cpu, nil),
+		cpuTotal: NewDesc("slurm_node_cpu_total", "Total CPUs per node", labels_cpu, nil),
 		
-		memAlloc: prometheus.NewDesc("slurm_node_mem_alloc", "Allocated memory per node", labels_cpu, nil),
-		memTotal: prometheus.NewDesc("slurm_node_mem_total", "Total memory per node", labels_cpu, nil),
+		memAlloc: NewDesc("slurm_node_mem_alloc", "Allocated memory per node", labels_cpu, nil),
+		memTotal: NewDesc("slurm_node_mem_total", "Total memory per node", labels_cpu, nil),
+
+		gpuAlloc: NewDesc("slurm_node_gpu_alloc", "Allocated GPUs per node", labels_gpu, nil),
+
+		cpusTotal: NewDesc("slurm_node_cpus_total", "Configured CPUs per node", []string{"node"}, nil),
+		weight:    NewDesc("slurm_node_weight", "Scheduling weight per node, lower weights are allocated first", []string{"node"}, nil),
+
+		stateChanges: NewDesc("slurm_node_state_changes_total", "State changes per node between consecutive scrapes, by new state", []string{"node", "to"}, nil),
+		states:       NewNodeStateChanges(),
+
+		completingStuck: NewDesc("slurm_nodes_completing_stuck", "Nodes completing for longer than the threshold", nil, nil),
+		completing:      NewNodeCompletingTracker(*nodesCompletingThreshold),
+
+		utilization: NewDesc("slurm_nodes_utilization", "Fraction of the usable nodes (not down, drained or failed) holding jobs", nil, nil),
+
+		slurmdVersion: NewDesc("slurm_node_slurmd_version_info", "Version of the slurmd of the node, always 1", []string{"node", "version"}, nil),
 
-		gpuAlloc: prometheus.NewDesc("slurm_node_gpu_alloc", "Allocated GPUs per node", labels_gpu, nil),
+		jobs: NewDesc("slurm_node_jobs", "Running jobs per node, a job running on several nodes counts on each", []string{"node"}, nil),
 	}
 }
 
@@ -191,11 +398,29 @@ func (nc *NodeCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- nc.memTotal
 
 	ch <- nc.gpuAlloc
+
+	ch <- nc.cpusTotal
+	ch <- nc.weight
+
+	ch <- nc.stateChanges
+
+	ch <- nc.completingStuck
+
+	ch <- nc.utilization
+
+	ch <- nc.slurmdVersion
+
+	ch <- nc.jobs
 }
 
 func (nc *NodeCollector) Collect(ch chan<- prometheus.Metric) {
 	nodes := NodeGetMetrics()
+	if *nodesGPUOnly {
+		nodes = GPUNodes(nodes)
+	}
+	states := make(map[string]string, len(nodes))
 	for node := range nodes {
+		states[node] = nodes[node].nodeStatus
 		ch <- prometheus.MustNewConstMetric(nc.cpuAlloc, prometheus.GaugeValue, float64(nodes[node].cpuAlloc), node, nodes[node].nodeStatus)
 		ch <- prometheus.MustNewConstMetric(nc.cpuIdle,  prometheus.GaugeValue, float64(nodes[node].cpuIdle),  node, nodes[node].nodeStatus)
 		ch <- prometheus.MustNewConstMetric(nc.cpuOther, prometheus.GaugeValue, float64(nodes[node].cpuOther), node, nodes[node].nodeStatus)
@@ -210,4 +435,40 @@ func (nc *NodeCollector) Collect(ch chan<- prometheus.Metric) {
 			}
 		}
 	}
+
+	nc.states.Observe(states)
+	ch <- prometheus.MustNewConstMetric(nc.completingStuck, prometheus.GaugeValue, nc.completing.Stuck(states, time.Now()))
+	ch <- prometheus.MustNewConstMetric(nc.utilization, prometheus.GaugeValue, NodesUtilization(states))
+	for node, counts := range nc.states.Changes() {
+		for state, count := range counts {
+			ch <- prometheus.MustNewConstMetric(nc.stateChanges, prometheus.CounterValue, count, node, state)
+		}
+	}
+
+	for node, capacity := range ParseNodeCapacity(NodeCapacityData()) {
+		if _, ok := nodes[node]; !ok && *nodesGPUOnly {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(nc.cpusTotal, prometheus.GaugeValue, capacity.cpus, node)
+		ch <- prometheus.MustNewConstMetric(nc.weight, prometheus.GaugeValue, capacity.weight, node)
+	}
+
+	// Every node, so that the nodes without jobs report 0
+	jobs := ParseNodeJobs(NodeJobsData())
+	for node := range nodes {
+		ch <- prometheus.MustNewConstMetric(nc.jobs, prometheus.GaugeValue, jobs[node], node)
+	}
+
+	// A partial upgrade leaves nodes with an older slurmd
+	scontrol, err := ScontrolNodesData()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(nc.slurmdVersion, err)
+		return
+	}
+	for node, version := range ParseSlurmdVersions(scontrol) {
+		if _, ok := nodes[node]; !ok && *nodesGPUOnly {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(nc.slurmdVersion, prometheus.GaugeValue, 1, node, version)
+	}
 }
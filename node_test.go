@@ -18,7 +18,9 @@ package main
 import (
 	"io/ioutil"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -55,3 +57,119 @@ func TestNodeMetrics(t *testing.T) {
 	assert.Equal(t, uint64(0), metrics["b001"].cpuOther)
 	assert.Equal(t, uint64(32), metrics["b001"].cpuTotal)
 }
+
+func TestNodeCapacity(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sinfo_capacity.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	nodes := ParseNodeCapacity(data)
+
+	assert.Equal(t, 4, len(nodes))
+	assert.Equal(t, float64(16), nodes["a048"].cpus)
+	assert.Equal(t, float64(1), nodes["a048"].weight)
+	assert.Equal(t, float64(32), nodes["b001"].cpus)
+	assert.Equal(t, float64(10), nodes["b001"].weight)
+	assert.Equal(t, float64(64), nodes["gpu01"].cpus)
+	assert.Equal(t, float64(100), nodes["gpu01"].weight)
+}
+
+func TestNodeStateChanges(t *testing.T) {
+	sc := NewNodeStateChanges()
+	sc.Observe(map[string]string{"a048": "idle", "a049": "mixed"})
+	assert.Empty(t, sc.Changes())
+
+	sc.Observe(map[string]string{"a048": "down*", "a049": "mixed", "a050": "idle"})
+	sc.Observe(map[string]string{"a048": "idle", "a049": "mixed", "a050": "idle"})
+	sc.Observe(map[string]string{"a048": "down*", "a049": "mixed", "a050": "idle"})
+	changes := sc.Changes()
+	assert.Equal(t, map[string]float64{"down*": 2, "idle": 1}, changes["a048"])
+	assert.NotContains(t, changes, "a049")
+	assert.NotContains(t, changes, "a050")
+}
+
+func TestNodeCompletingTracker(t *testing.T) {
+	ct := NewNodeCompletingTracker(10 * time.Minute)
+	now := time.Date(2026, 10, 14, 10, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, float64(0), ct.Stuck(map[string]string{"a048": "completing", "a049": "idle"}, now))
+	assert.Equal(t, float64(0), ct.Stuck(map[string]string{"a048": "completing", "a049": "completing"}, now.Add(5*time.Minute)))
+	// a048 is stuck, a049 started completing 5 minutes ago
+	assert.Equal(t, float64(1), ct.Stuck(map[string]string{"a048": "completing", "a049": "completing"}, now.Add(10*time.Minute)))
+	assert.Equal(t, float64(2), ct.Stuck(map[string]string{"a048": "completing+drain", "a049": "completing"}, now.Add(15*time.Minute)))
+
+	// A node completing again starts over
+	assert.Equal(t, float64(1), ct.Stuck(map[string]string{"a048": "idle", "a049": "completing"}, now.Add(20*time.Minute)))
+	assert.Equal(t, float64(1), ct.Stuck(map[string]string{"a048": "completing", "a049": "completing"}, now.Add(25*time.Minute)))
+}
+
+func TestNodesUtilization(t *testing.T) {
+	assert.Equal(t, float64(0), NodesUtilization(map[string]string{"a048": "idle", "a049": "idle"}))
+	assert.Equal(t, float64(1), NodesUtilization(map[string]string{"a048": "allocated", "a049": "mixed", "a050": "down*"}))
+	// No usable node
+	assert.Equal(t, float64(0), NodesUtilization(map[string]string{"a048": "down*", "a049": "drained", "a050": "fail"}))
+	assert.Equal(t, float64(0), NodesUtilization(map[string]string{}))
+	assert.Equal(t, 0.5, NodesUtilization(map[string]string{"a048": "completing", "a049": "idle", "a050": "draining"}))
+}
+
+func TestNodeCollectorGPUOnly(t *testing.T) {
+	defer fakeSlurm(t, map[string][]fakeOutput{
+		"sinfo": {
+			{"*%w*", "test_data/sinfo_capacity_gpus.txt"},
+			{"*", "test_data/sinfo_nodes_gpus.txt"},
+		},
+		"scontrol": {{"*", "test_data/scontrol_nodes_versions.txt"}},
+		"squeue":   {{"*", "test_data/squeue_node_jobs.txt"}},
+	})()
+	defer func(gpuOnly bool) { *nodesGPUOnly = gpuOnly }(*nodesGPUOnly)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewNodeCollector())
+	metrics := collectMetrics(t, registry)
+	assert.Contains(t, metrics, `slurm_node_cpu_total{node="b001",status="allocated"}`)
+	assert.Equal(t, float64(2)/3, metrics["slurm_nodes_utilization"])
+
+	*nodesGPUOnly = true
+	registry = prometheus.NewRegistry()
+	registry.MustRegister(NewNodeCollector())
+	metrics = collectMetrics(t, registry)
+	// The CPU-only node b001 produces no series
+	for name := range metrics {
+		assert.NotContains(t, name, `node="b001"`)
+	}
+	assert.Equal(t, float64(64), metrics[`slurm_node_cpu_total{node="gpu01",status="mixed"}`])
+	assert.Equal(t, float64(1), metrics[`slurm_node_gpu_alloc{index="1",node="gpu01",type="a100"}`])
+	assert.Equal(t, float64(64), metrics[`slurm_node_cpus_total{node="gpu02"}`])
+	assert.Equal(t, float64(1)/2, metrics["slurm_nodes_utilization"])
+	assert.Equal(t, float64(1), metrics[`slurm_node_slurmd_version_info{node="gpu01",version="23.02.7"}`])
+	assert.Equal(t, float64(3), metrics[`slurm_node_jobs{node="gpu01"}`])
+}
+
+func TestNodeJobs(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/squeue_node_jobs.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	// The multi-node jobs count once on each of their nodes
+	assert.Equal(t, map[string]float64{
+		"gpu01": 3,
+		"gpu02": 2,
+		"b001":  2,
+		"b002":  1,
+		"b003":  1,
+	}, ParseNodeJobs(data))
+}
+
+func TestSlurmdVersions(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/scontrol_nodes_versions.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	// gpu01 still runs the slurmd of before a partial upgrade, b002 never
+	// registered
+	assert.Equal(t, map[string]string{
+		"b001":  "23.11.4",
+		"gpu01": "23.02.7",
+		"gpu02": "23.11.4",
+	}, ParseSlurmdVersions(data))
+}
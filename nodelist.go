@@ -0,0 +1,100 @@
+/* Copyright 2017 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ExpandNodeList expands a Slurm host list into node names, e.g.
+// "gpu[01-03,05],c01" into gpu01, gpu02, gpu03, gpu05 and c01. Ranges
+// keep the zero padding of their first number, several bracket groups
+// in one name (e.g. "r[1-2]n[1-2]") are expanded as well.
+func ExpandNodeList(nodelist string) []string {
+	nodes := []string{}
+	for _, name := range splitNodeList(nodelist) {
+		nodes = append(nodes, expandNodeName(name)...)
+	}
+	return nodes
+}
+
+// Split a host list on the commas outside of brackets
+func splitNodeList(nodelist string) []string {
+	var names []string
+	depth := 0
+	start := 0
+	for i, c := range nodelist {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ',':
+			if depth == 0 {
+				names = append(names, nodelist[start:i])
+				start = i + 1
+			}
+		}
+	}
+	names = append(names, nodelist[start:])
+
+	kept := names[:0]
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" && name != "(null)" {
+			kept = append(kept, name)
+		}
+	}
+	return kept
+}
+
+func expandNodeName(name string) []string {
+	open := strings.Index(name, "[")
+	if open < 0 {
+		return []string{name}
+	}
+	end := strings.Index(name[open:], "]")
+	if end < 0 {
+		return []string{name}
+	}
+	end += open
+	prefix := name[:open]
+	// The suffix may hold more bracket groups
+	suffixes := expandNodeName(name[end+1:])
+
+	var nodes []string
+	for _, r := range strings.Split(name[open+1:end], ",") {
+		bounds := strings.SplitN(r, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			continue
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil {
+				continue
+			}
+		}
+		width := len(bounds[0])
+		for i := first; i <= last; i++ {
+			for _, suffix := range suffixes {
+				nodes = append(nodes, fmt.Sprintf("%s%0*d%s", prefix, width, i, suffix))
+			}
+		}
+	}
+	return nodes
+}
@@ -0,0 +1,32 @@
+/* Copyright 2017 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandNodeList(t *testing.T) {
+	assert.Equal(t, []string{"c01"}, ExpandNodeList("c01"))
+	assert.Equal(t, []string{"gpu01", "gpu02", "gpu03", "gpu05", "c01"}, ExpandNodeList("gpu[01-03,05],c01"))
+	assert.Equal(t, []string{"node9", "node10"}, ExpandNodeList("node[9-10]"))
+	assert.Equal(t, []string{"r1n1", "r1n2", "r2n1", "r2n2"}, ExpandNodeList("r[1-2]n[1-2]"))
+	assert.Equal(t, []string{"gpu01-ib", "gpu02-ib"}, ExpandNodeList("gpu[01-02]-ib"))
+	assert.Equal(t, []string{}, ExpandNodeList("(null)"))
+	assert.Equal(t, []string{}, ExpandNodeList(""))
+}
@@ -16,15 +16,11 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>. */
 package main
 
 import (
-	"io/ioutil"
-	"os/exec"
-	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/log"
 )
 
 type NodesMetrics struct {
@@ -116,101 +112,101 @@ func ParseNodesMetrics(input []byte) *NodesMetrics {
 				feature_set = "null"
 			}
 			InitFeatureSet(&nm, feature_set)
-			alloc := regexp.MustCompile(`^alloc`)
-			comp := regexp.MustCompile(`^comp`)
-			down := regexp.MustCompile(`^down`)
-			drain := regexp.MustCompile(`^drain`)
-			fail := regexp.MustCompile(`^fail`)
-			err := regexp.MustCompile(`^err`)
-			idle := regexp.MustCompile(`^idle`)
-			maint := regexp.MustCompile(`^maint`)
-			mix := regexp.MustCompile(`^mix`)
-			resv := regexp.MustCompile(`^res`)
-			planned := regexp.MustCompile(`^planned`)
-			switch {
-			case alloc.MatchString(state):
-				nm.alloc[feature_set] += count
-			case comp.MatchString(state):
-				nm.comp[feature_set] += count
-			case down.MatchString(state):
-				nm.down[feature_set] += count
-			case drain.MatchString(state):
-				nm.drain[feature_set] += count
-			case fail.MatchString(state):
-				nm.fail[feature_set] += count
-			case err.MatchString(state):
-				nm.err[feature_set] += count
-			case idle.MatchString(state):
-				nm.idle[feature_set] += count
-			case maint.MatchString(state):
-				nm.maint[feature_set] += count
-			case mix.MatchString(state):
-				nm.mix[feature_set] += count
-			case resv.MatchString(state):
-				nm.resv[feature_set] += count
-			case planned.MatchString(state):
-				nm.planned[feature_set] += count
-			default:
-				nm.other[feature_set] += count
+			for _, base := range NormalizeNodeState(state, *nodesCompoundStates == "all") {
+				nm.counter(base)[feature_set] += count
 			}
 		}
 	}
 	return &nm
 }
 
-// Execute the sinfo command and return its output
-func NodesData(part string) []byte {
-	cmd := exec.Command("sinfo", "-h", "-o %D|%T|%b", "-p", part, "| sort", "| uniq")
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
-	}
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
+// NormalizeNodeState splits a compound node state into its base states,
+// e.g. "IDLE+DRAIN" or "allocated+completing", without the suffixes
+// flagging e.g. a node not responding ("down*") or powered down
+// ("idle~"). Only the first base state, the one Slurm prints first, is
+// returned unless all is set.
+func NormalizeNodeState(state string, all bool) []string {
+	bases := []string{}
+	for _, base := range strings.Split(strings.ToLower(strings.TrimSpace(state)), "+") {
+		base = strings.TrimRight(base, "*~#!%$@^-")
+		if base == "" {
+			continue
+		}
+		duplicate := false
+		for _, seen := range bases {
+			duplicate = duplicate || seen == base
+		}
+		if !duplicate {
+			bases = append(bases, base)
+		}
 	}
-	out, _ := ioutil.ReadAll(stdout)
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
+	switch {
+	case len(bases) == 0:
+		// Counted as other
+		return []string{state}
+	case !all:
+		return bases[:1]
 	}
-	return out
+	return bases
 }
 
-func SlurmGetTotal() float64 {
-	cmd := exec.Command("bash", "-c", "scontrol show nodes -o | grep -c NodeName=[a-z]*[0-9]*")
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
+// counter returns the counter of the base node state, by prefix so that
+// e.g. drained and draining are both drain
+func (nm *NodesMetrics) counter(base string) map[string]float64 {
+	switch {
+	case strings.HasPrefix(base, "alloc"):
+		return nm.alloc
+	case strings.HasPrefix(base, "comp"):
+		return nm.comp
+	case strings.HasPrefix(base, "down"):
+		return nm.down
+	case strings.HasPrefix(base, "drain"):
+		return nm.drain
+	case strings.HasPrefix(base, "fail"):
+		return nm.fail
+	case strings.HasPrefix(base, "err"):
+		return nm.err
+	case strings.HasPrefix(base, "idle"):
+		return nm.idle
+	case strings.HasPrefix(base, "maint"):
+		return nm.maint
+	case strings.HasPrefix(base, "mix"):
+		return nm.mix
+	case strings.HasPrefix(base, "res"):
+		return nm.resv
+	case strings.HasPrefix(base, "planned"):
+		return nm.planned
+	default:
+		return nm.other
 	}
-	stderr, err := cmd.StderrPipe()
+}
+
+// Execute the sinfo command and return its output
+func NodesData(part string) []byte {
+	return Execute("sinfo", []string{"-h", "-o %D|%T|%b", "-p", part, "| sort", "| uniq"})
+}
+
+// Count the nodes known by scontrol, one node per line
+func SlurmGetTotal() (float64, error) {
+	scontrol, err := ScontrolNodesData()
 	if err != nil {
-		log.Fatal(err)
-	}
-	if err := cmd.Start(); err != nil {
-		log.Fatalf("cmd.Start: %v", err)
+		return 0, err
 	}
-	out, _ := ioutil.ReadAll(stdout)
-	err_out, _ := ioutil.ReadAll(stderr)
-	if err := cmd.Wait(); err != nil {
-		log.Fatalf("cmd.Wait: %v %s %s", err, out, err_out)
+	return ParseNodesTotal(scontrol), nil
+}
+
+func ParseNodesTotal(input []byte) float64 {
+	total := float64(0)
+	for _, line := range strings.Split(string(input), "\n") {
+		if strings.HasPrefix(line, "NodeName=") {
+			total++
+		}
 	}
-	data := strings.Split(string(out), "\n")
-	total, _ := strconv.ParseFloat(data[0], 64)
 	return total
 }
 
 func SlurmGetPartitions() []string {
-	cmd := exec.Command("sinfo", "-h", "-o %R", "| sort", "| uniq")
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
-	}
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
-	}
-	out, _ := ioutil.ReadAll(stdout)
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
-	}
+	out := Execute("sinfo", []string{"-h", "-o %R", "| sort", "| uniq"})
 	partitions := strings.Split(string(out), "\n")
 	return partitions
 }
@@ -226,19 +222,19 @@ func NewNodesCollector() *NodesCollector {
 	labelnames = append(labelnames, "partition")
 	labelnames = append(labelnames, "active_feature_set")
 	return &NodesCollector{
-		alloc:   prometheus.NewDesc("slurm_nodes_alloc", "Allocated nodes", labelnames, nil),
-		comp:    prometheus.NewDesc("slurm_nodes_comp", "Completing nodes", labelnames, nil),
-		down:    prometheus.NewDesc("slurm_nodes_down", "Down nodes", labelnames, nil),
-		drain:   prometheus.NewDesc("slurm_nodes_drain", "Drain nodes", labelnames, nil),
-		err:     prometheus.NewDesc("slurm_nodes_err", "Error nodes", labelnames, nil),
-		fail:    prometheus.NewDesc("slurm_nodes_fail", "Fail nodes", labelnames, nil),
-		idle:    prometheus.NewDesc("slurm_nodes_idle", "Idle nodes", labelnames, nil),
-		maint:   prometheus.NewDesc("slurm_nodes_maint", "Maint nodes", labelnames, nil),
-		mix:     prometheus.NewDesc("slurm_nodes_mix", "Mix nodes", labelnames, nil),
-		resv:    prometheus.NewDesc("slurm_nodes_resv", "Reserved nodes", labelnames, nil),
-		other:   prometheus.NewDesc("slurm_nodes_other", "Nodes reported with an unknown state", labelnames, nil),
-		planned: prometheus.NewDesc("slurm_nodes_planned", "Planned nodes", labelnames, nil),
-		total:   prometheus.NewDesc("slurm_nodes_total", "Total number of nodes", nil, nil),
+		alloc:   NewDesc("slurm_nodes_alloc", "Allocated nodes", labelnames, nil),
+		comp:    NewDesc("slurm_nodes_comp", "Completing nodes", labelnames, nil),
+		down:    NewDesc("slurm_nodes_down", "Down nodes", labelnames, nil),
+		drain:   NewDesc("slurm_nodes_drain", "Drain nodes", labelnames, nil),
+		err:     NewDesc("slurm_nodes_err", "Error nodes", labelnames, nil),
+		fail:    NewDesc("slurm_nodes_fail", "Fail nodes", labelnames, nil),
+		idle:    NewDesc("slurm_nodes_idle", "Idle nodes", labelnames, nil),
+		maint:   NewDesc("slurm_nodes_maint", "Maint nodes", labelnames, nil),
+		mix:     NewDesc("slurm_nodes_mix", "Mix nodes", labelnames, nil),
+		resv:    NewDesc("slurm_nodes_resv", "Reserved nodes", labelnames, nil),
+		other:   NewDesc("slurm_nodes_other", "Nodes reported with an unknown state", labelnames, nil),
+		planned: NewDesc("slurm_nodes_planned", "Planned nodes", labelnames, nil),
+		total:   NewDesc("slurm_nodes_total", "Total number of nodes", nil, nil),
 	}
 }
 
@@ -302,6 +298,10 @@ func (nc *NodesCollector) Collect(ch chan<- prometheus.Metric) {
 		SendFeatureSetMetric(ch, nc.other, prometheus.GaugeValue, nm.other, part)
 		SendFeatureSetMetric(ch, nc.planned, prometheus.GaugeValue, nm.planned, part)
 	}
-	total := SlurmGetTotal()
+	total, err := SlurmGetTotal()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(nc.total, err)
+		return
+	}
 	ch <- prometheus.MustNewConstMetric(nc.total, prometheus.GaugeValue, total)
 }
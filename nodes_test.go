@@ -41,3 +41,42 @@ func TestNodesMetrics(t *testing.T) {
 	assert.Equal(t, 3, int(nm.planned["feature_a"]))
 	assert.Equal(t, 5, int(nm.planned["feature_b"]))
 }
+
+func TestNormalizeNodeState(t *testing.T) {
+	assert.Equal(t, []string{"idle"}, NormalizeNodeState("IDLE+DRAIN", false))
+	assert.Equal(t, []string{"idle", "drain"}, NormalizeNodeState("IDLE+DRAIN", true))
+	assert.Equal(t, []string{"allocated", "completing"}, NormalizeNodeState("allocated+completing", true))
+	assert.Equal(t, []string{"mixed", "drain"}, NormalizeNodeState("mixed+drain*", true))
+	assert.Equal(t, []string{"down"}, NormalizeNodeState("down*", true))
+	assert.Equal(t, []string{"idle"}, NormalizeNodeState("idle~", false))
+	assert.Equal(t, []string{"idle"}, NormalizeNodeState("IDLE+IDLE", true))
+	assert.Equal(t, []string{""}, NormalizeNodeState("", true))
+}
+
+func TestNodesMetricsCompoundStates(t *testing.T) {
+	defer func(mode string) { *nodesCompoundStates = mode }(*nodesCompoundStates)
+	data := []byte("4|idle+drain|(null)\n2|allocated+completing|(null)\n1|mixed|(null)\n")
+
+	*nodesCompoundStates = "primary"
+	nm := ParseNodesMetrics(data)
+	assert.Equal(t, float64(4), nm.idle["null"])
+	assert.Equal(t, float64(0), nm.drain["null"])
+	assert.Equal(t, float64(2), nm.alloc["null"])
+	assert.Equal(t, float64(0), nm.comp["null"])
+
+	*nodesCompoundStates = "all"
+	nm = ParseNodesMetrics(data)
+	assert.Equal(t, float64(4), nm.idle["null"])
+	assert.Equal(t, float64(4), nm.drain["null"])
+	assert.Equal(t, float64(2), nm.alloc["null"])
+	assert.Equal(t, float64(2), nm.comp["null"])
+	assert.Equal(t, float64(1), nm.mix["null"])
+}
+
+func TestNodesTotal(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/scontrol_nodes.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	assert.Equal(t, float64(4), ParseNodesTotal(data))
+}
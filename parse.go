@@ -0,0 +1,88 @@
+/* Copyright 2017-2020 Victor Penso, Matteo Dessalvi, Joeri Hermans
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/common/log"
+)
+
+// ParseErrors collects what the parsers could not read in the output of
+// the Slurm commands. Malformed input is skipped and logged, unless the
+// parsing is strict: the collectors then fail the scrape with the errors
+// collected since the previous scrape. Each collector has its own, a
+// nil ParseErrors only logs what is skipped.
+type ParseErrors struct {
+	mu     sync.Mutex
+	errors []string
+	total  float64
+}
+
+// Report records a malformed input, skipped by the parser
+func (pe *ParseErrors) Report(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if pe == nil {
+		log.Warnf("Skipped the malformed %s", message)
+		return
+	}
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	pe.total++
+	if !*parseStrict {
+		log.Warnf("Skipped the malformed %s", message)
+		return
+	}
+	pe.errors = append(pe.errors, message)
+}
+
+// Recover reports the panic of a parser on a line of output as a
+// malformed line, the parser goes on with the next line. It has to be
+// deferred by the function parsing the line.
+func (pe *ParseErrors) Recover(line string) {
+	if r := recover(); r != nil {
+		pe.Report("line %q, %v", line, r)
+	}
+}
+
+// Total returns the number of malformed inputs reported since the start,
+// in lenient and in strict mode
+func (pe *ParseErrors) Total() float64 {
+	if pe == nil {
+		return 0
+	}
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	return pe.total
+}
+
+// Take returns the errors reported since the last call, or nil
+func (pe *ParseErrors) Take() error {
+	if pe == nil {
+		return nil
+	}
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	if len(pe.errors) == 0 {
+		return nil
+	}
+	err := errors.New("malformed " + strings.Join(pe.errors, ", "))
+	pe.errors = nil
+	return err
+}
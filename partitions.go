@@ -16,44 +16,184 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>. */
 package main
 
 import (
-        "io/ioutil"
-        "os/exec"
-        "log"
+        "math"
+        "sort"
         "strings"
         "strconv"
         "github.com/prometheus/client_golang/prometheus"
 )
 
 func PartitionsData() []byte {
-        cmd := exec.Command("sinfo", "-h", "-o%R,%C")
-        stdout, err := cmd.StdoutPipe()
-        if err != nil {
-                log.Fatal(err)
+        return Execute("sinfo", []string{"-h", "-o%R,%C"})
+}
+
+func PartitionsPendingJobsData() []byte {
+        return Execute("squeue", []string{"-a", "-r", "-h", "-o%P", "--states=PENDING"})
+}
+
+// Execute the sinfo command and return the availability of every
+// partition, the default partition with a "*" suffix (%P, unlike %R)
+func PartitionsAvailData() []byte {
+        return Execute("sinfo", []string{"-h", "-o", "%P %a"})
+}
+
+// ParsePartitionsUp maps the availability of every partition to 1 when
+// it is up, 0 when it is down, drained or inactive
+func ParsePartitionsUp(input []byte) map[string]float64 {
+        partitions := make(map[string]float64)
+        for _, line := range strings.Split(string(input), "\n") {
+                fields := strings.Fields(line)
+                if len(fields) < 2 {
+                        continue
+                }
+                up := float64(0)
+                if strings.ToLower(fields[1]) == "up" {
+                        up = 1
+                }
+                partitions[strings.TrimSuffix(fields[0], "*")] = up
         }
-        if err := cmd.Start(); err != nil {
-                log.Fatal(err)
+        return partitions
+}
+
+// ParsePartitionsDefault maps every partition to 1 when it is the default
+// partition of the jobs submitted without -p, marked with a "*", 0 otherwise
+func ParsePartitionsDefault(input []byte) map[string]float64 {
+        partitions := make(map[string]float64)
+        for _, line := range strings.Split(string(input), "\n") {
+                fields := strings.Fields(line)
+                if len(fields) < 2 {
+                        continue
+                }
+                name := strings.TrimSuffix(fields[0], "*")
+                if name != fields[0] {
+                        partitions[name] = 1
+                } else if _, ok := partitions[name]; !ok {
+                        partitions[name] = 0
+                }
         }
-        out, _ := ioutil.ReadAll(stdout)
-        if err := cmd.Wait(); err != nil {
-                log.Fatal(err)
+        return partitions
+}
+
+func PartitionsConfigData() []byte {
+        return Execute("scontrol", []string{"show", "partition", "-o"})
+}
+
+// Execute the sinfo command and return the partitions of every node, one
+// line per partition and node
+func InventoryData() []byte {
+        return Execute("sinfo", []string{"-N", "-h", "-o", "%R %n"})
+}
+
+// NodePartitions maps every node to the partitions it belongs to in the
+// order of sinfo, for the collectors which count the nodes or their
+// resources by partition (e.g. the GPUs by partition)
+type NodePartitions map[string][]string
+
+// ParseNodePartitions takes the "partition node" lines of InventoryData,
+// or the lines of sinfo starting with %R|%n, a node in several partitions
+// is listed once per partition
+func ParseNodePartitions(input []byte) NodePartitions {
+        np := make(NodePartitions)
+        for _, line := range strings.Split(string(input), "\n") {
+                fields := SplitSinfoFields(line)
+                if len(fields) < 2 {
+                        continue
+                }
+                np[fields[1]] = append(np[fields[1]], fields[0])
+        }
+        for node, partitions := range np {
+                np[node] = RemoveDuplicates(partitions)
         }
-        return out
+        return np
 }
 
-func PartitionsPendingJobsData() []byte {
-        cmd := exec.Command("squeue","-a","-r","-h","-o%P","--states=PENDING")
-        stdout, err := cmd.StdoutPipe()
-        if err != nil {
-                log.Fatal(err)
+// Partitions returns the sorted distinct partitions of the nodes
+func (np NodePartitions) Partitions() []string {
+        seen := make(map[string]bool)
+        partitions := []string{}
+        for _, node_partitions := range np {
+                for _, partition := range node_partitions {
+                        if !seen[partition] {
+                                seen[partition] = true
+                                partitions = append(partitions, partition)
+                        }
+                }
         }
-        if err := cmd.Start(); err != nil {
-                log.Fatal(err)
+        sort.Strings(partitions)
+        return partitions
+}
+
+// ParseInventory counts the distinct partitions and nodes
+func ParseInventory(input []byte) (float64, float64) {
+        np := ParseNodePartitions(input)
+        return float64(len(np.Partitions())), float64(len(np))
+}
+
+// Execute the sinfo command and return the number of nodes of every
+// partition by state
+func PartitionNodesData() []byte {
+        return Execute("sinfo", []string{"-h", "-o", "%R %t %D"})
+}
+
+// ParsePartitionNodes takes the "partition state nodes" lines of sinfo and
+// sums the nodes by partition and base state, e.g. ["gpu"]["idle"]. sinfo
+// prints a line per state, or several when the nodes of a state differ
+// in another way (e.g. their features), which are added up. A node in
+// several partitions is counted in each of them.
+func ParsePartitionNodes(input []byte) map[string]map[string]float64 {
+        partitions := make(map[string]map[string]float64)
+        for _, line := range strings.Split(string(input), "\n") {
+                fields := strings.Fields(line)
+                if len(fields) < 3 {
+                        continue
+                }
+                count, err := strconv.ParseFloat(fields[2], 64)
+                if err != nil {
+                        continue
+                }
+                if partitions[fields[0]] == nil {
+                        partitions[fields[0]] = make(map[string]float64)
+                }
+                for _, state := range NormalizeNodeState(fields[1], *nodesCompoundStates == "all") {
+                        partitions[fields[0]][state] += count
+                }
+        }
+        return partitions
+}
+
+type PartitionTimes struct {
+        max_time float64
+        default_time float64
+}
+
+// ParsePartitionTimes returns the limits on the wall time of the jobs of
+// every partition in seconds: UNLIMITED is +Inf, a time which is not set
+// (e.g. DefaultTime=NONE) is NaN.
+func ParsePartitionTimes(input []byte) map[string]*PartitionTimes {
+        partitions := make(map[string]*PartitionTimes)
+        for _, line := range strings.Split(string(input), "\n") {
+                fields := ParseScontrolFields(line)
+                name, ok := fields["PartitionName"]
+                if !ok {
+                        continue
+                }
+                partitions[name] = &PartitionTimes{
+                        max_time: PartitionTimeSeconds(fields["MaxTime"]),
+                        default_time: PartitionTimeSeconds(fields["DefaultTime"]),
+                }
+        }
+        return partitions
+}
+
+func PartitionTimeSeconds(value string) float64 {
+        if value == "UNLIMITED" {
+                return math.Inf(1)
         }
-        out, _ := ioutil.ReadAll(stdout)
-        if err := cmd.Wait(); err != nil {
-                log.Fatal(err)
+        d, ok := ParseSlurmDuration(value)
+        if !ok {
+                return math.NaN()
         }
-        return out
+        return d.Seconds()
 }
 
 type PartitionMetrics struct {
@@ -106,16 +246,30 @@ type PartitionsCollector struct {
         other *prometheus.Desc
         pending *prometheus.Desc
         total *prometheus.Desc
+        up *prometheus.Desc
+        is_default *prometheus.Desc
+        max_time *prometheus.Desc
+        default_time *prometheus.Desc
+        partitions *prometheus.Desc
+        nodes *prometheus.Desc
+        partition_nodes *prometheus.Desc
 }
 
 func NewPartitionsCollector() *PartitionsCollector {
         labels := []string{"partition"}
         return &PartitionsCollector{
-                allocated: prometheus.NewDesc("slurm_partition_cpus_allocated", "Allocated CPUs for partition", labels,nil),
-		idle: prometheus.NewDesc("slurm_partition_cpus_idle", "Idle CPUs for partition", labels,nil),
-		other: prometheus.NewDesc("slurm_partition_cpus_other", "Other CPUs for partition", labels,nil),
-		pending: prometheus.NewDesc("slurm_partition_jobs_pending", "Pending jobs for partition", labels,nil),
-		total: prometheus.NewDesc("slurm_partition_cpus_total", "Total CPUs for partition", labels,nil),
+                allocated: NewDesc("slurm_partition_cpus_allocated", "Allocated CPUs for partition", labels,nil),
+		idle: NewDesc("slurm_partition_cpus_idle", "Idle CPUs for partition", labels,nil),
+		other: NewDesc("slurm_partition_cpus_other", "Other CPUs for partition", labels,nil),
+		pending: NewDesc("slurm_partition_jobs_pending", "Pending jobs for partition", labels,nil),
+		total: NewDesc("slurm_partition_cpus_total", "Total CPUs for partition", labels,nil),
+		up: NewDesc("slurm_partition_up", "Whether the partition is up (1) or down, drained or inactive (0)", labels, nil),
+		is_default: NewDesc("slurm_partition_default", "Whether the partition is the default partition of the jobs submitted without a partition", labels, nil),
+		max_time: NewDesc("slurm_partition_max_time_seconds", "Maximum wall time of the jobs of the partition, +Inf when unlimited", labels, nil),
+		default_time: NewDesc("slurm_partition_default_time_seconds", "Default wall time of the jobs of the partition", labels, nil),
+		partitions: NewDesc("slurm_partitions_total", "Number of partitions", nil, nil),
+		nodes: NewDesc("slurm_nodes_configured_total", "Number of nodes in the partitions", nil, nil),
+		partition_nodes: NewDesc("slurm_partition_nodes", "Nodes of the partition by state, a node in several partitions is counted in each", []string{"partition", "state"}, nil),
         }
 }
 
@@ -125,6 +279,13 @@ func (pc *PartitionsCollector) Describe(ch chan<- *prometheus.Desc) {
         ch <- pc.other
         ch <- pc.pending
         ch <- pc.total
+        ch <- pc.up
+        ch <- pc.is_default
+        ch <- pc.max_time
+        ch <- pc.default_time
+        ch <- pc.partitions
+        ch <- pc.nodes
+        ch <- pc.partition_nodes
 }
 
 func (pc *PartitionsCollector) Collect(ch chan<- prometheus.Metric) {
@@ -146,4 +307,28 @@ func (pc *PartitionsCollector) Collect(ch chan<- prometheus.Metric) {
                         ch <- prometheus.MustNewConstMetric(pc.total, prometheus.GaugeValue, pm[p].total, p)
                 }
         }
+        avail := PartitionsAvailData()
+        for p, up := range ParsePartitionsUp(avail) {
+                ch <- prometheus.MustNewConstMetric(pc.up, prometheus.GaugeValue, up, p)
+        }
+        for p, is_default := range ParsePartitionsDefault(avail) {
+                ch <- prometheus.MustNewConstMetric(pc.is_default, prometheus.GaugeValue, is_default, p)
+        }
+        partitions, nodes := ParseInventory(InventoryData())
+        ch <- prometheus.MustNewConstMetric(pc.partitions, prometheus.GaugeValue, partitions)
+        ch <- prometheus.MustNewConstMetric(pc.nodes, prometheus.GaugeValue, nodes)
+        for p, states := range ParsePartitionNodes(PartitionNodesData()) {
+                for state, count := range states {
+                        ch <- prometheus.MustNewConstMetric(pc.partition_nodes, prometheus.GaugeValue, count, p, state)
+                }
+        }
+        // Partitions without a default time take the maximum time
+        for p, times := range ParsePartitionTimes(PartitionsConfigData()) {
+                if !math.IsNaN(times.max_time) {
+                        ch <- prometheus.MustNewConstMetric(pc.max_time, prometheus.GaugeValue, times.max_time, p)
+                }
+                if !math.IsNaN(times.default_time) {
+                        ch <- prometheus.MustNewConstMetric(pc.default_time, prometheus.GaugeValue, times.default_time, p)
+                }
+        }
 }
@@ -0,0 +1,114 @@
+/* Copyright 2020 Victor Penso
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartitionsUp(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sinfo_partitions_avail.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	up := ParsePartitionsUp(data)
+	t.Logf("%+v", up)
+
+	assert.Equal(t, map[string]float64{
+		"cpu":   1,
+		"gpu":   1,
+		"debug": 0,
+		"maint": 0,
+		"old":   0,
+	}, up)
+}
+
+func TestPartitionsDefault(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sinfo_partitions_default.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	// Only cpu is marked with a "*"
+	assert.Equal(t, map[string]float64{
+		"cpu":   1,
+		"gpu":   0,
+		"debug": 0,
+		"maint": 0,
+		"old":   0,
+	}, ParsePartitionsDefault(data))
+	// The marker is not part of the name of the partition
+	assert.Equal(t, float64(1), ParsePartitionsUp(data)["cpu"])
+}
+
+func TestPartitionTimes(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/scontrol_partitions.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	times := ParsePartitionTimes(data)
+
+	assert.Equal(t, 3, len(times))
+	assert.Equal(t, float64(7*24*3600), times["cpu"].max_time)
+	assert.Equal(t, float64(3600), times["cpu"].default_time)
+	assert.Equal(t, float64(2*24*3600), times["gpu"].max_time)
+	assert.True(t, math.IsNaN(times["gpu"].default_time))
+	assert.True(t, math.IsInf(times["debug"].max_time, 1))
+	assert.Equal(t, float64(30*60), times["debug"].default_time)
+}
+
+func TestInventory(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sinfo_inventory.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	// a048 and gpu02 are in two partitions
+	partitions, nodes := ParseInventory(data)
+	assert.Equal(t, float64(4), partitions)
+	assert.Equal(t, float64(6), nodes)
+}
+
+func TestNodePartitions(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sinfo_inventory.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	np := ParseNodePartitions(data)
+	assert.Equal(t, []string{"cpu", "debug"}, np["a048"])
+	assert.Equal(t, []string{"cpu"}, np["a049"])
+	assert.Equal(t, []string{"gpu", "gpu-shared"}, np["gpu02"])
+	assert.Equal(t, []string{"gpu-shared"}, np["gpu03"])
+	assert.Equal(t, []string{"cpu", "debug", "gpu", "gpu-shared"}, np.Partitions())
+
+	// The delimited lines of the GPUs by partition, in the order of sinfo
+	np = ParseNodePartitions([]byte("shared|gpu01|gpu:a100:4\ngpu|gpu01|gpu:a100:4\nshared|gpu01|gpu:a100:4\n"))
+	assert.Equal(t, []string{"shared", "gpu"}, np["gpu01"])
+}
+
+func TestPartitionNodes(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sinfo_partition_nodes.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	nodes := ParsePartitionNodes(data)
+	assert.Equal(t, map[string]float64{"mix": 12, "alloc": 30, "idle": 4, "drain": 1}, nodes["cpu"])
+	// The idle nodes of gpu are on two lines
+	assert.Equal(t, map[string]float64{"mix": 2, "idle": 3, "down": 1}, nodes["gpu"])
+	assert.Equal(t, map[string]float64{"idle": 2}, nodes["debug"])
+}
@@ -0,0 +1,110 @@
+/* Copyright 2017 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Priority factors in the order of the sprio output format
+var priorityFactors = []string{"age", "fairshare", "jobsize", "partition", "qos"}
+
+// Execute sprio to get the priority factors of every pending job. sprio
+// fails with the priority/basic plugin, which has no factors.
+func PriorityData() ([]byte, error) {
+	return ExecuteError("sprio", []string{"-h", "-o", "%i %Y %A %F %J %P %Q"})
+}
+
+type PriorityMetrics struct {
+	jobs   float64
+	factor map[string]float64 // sum over the jobs
+	max    map[string]float64
+}
+
+// ParsePriorityMetrics sums the priority factors of the pending jobs. A job
+// eligible in several partitions is listed once per partition, only its
+// first line is counted.
+func ParsePriorityMetrics(input []byte) *PriorityMetrics {
+	pm := PriorityMetrics{
+		factor: make(map[string]float64),
+		max:    make(map[string]float64),
+	}
+	jobs := make(map[string]bool)
+	for _, line := range strings.Split(string(input), "\n") {
+		// job priority age fairshare jobsize partition qos
+		fields := strings.Fields(line)
+		if len(fields) < 2+len(priorityFactors) || jobs[fields[0]] {
+			continue
+		}
+		jobs[fields[0]] = true
+		pm.jobs++
+		for i, factor := range priorityFactors {
+			value, _ := strconv.ParseFloat(fields[2+i], 64)
+			pm.factor[factor] += value
+			if value > pm.max[factor] {
+				pm.max[factor] = value
+			}
+		}
+	}
+	return &pm
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * Slurm priority factors into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+func NewPriorityCollector() *PriorityCollector {
+	labels := []string{"factor"}
+	return &PriorityCollector{
+		jobs:      NewDesc("slurm_job_priority_jobs", "Pending jobs listed by sprio", nil, nil),
+		factor:    NewDesc("slurm_job_priority_factor", "Average weighted priority factor of the pending jobs", labels, nil),
+		factorMax: NewDesc("slurm_job_priority_factor_max", "Highest weighted priority factor of the pending jobs", labels, nil),
+	}
+}
+
+type PriorityCollector struct {
+	jobs      *prometheus.Desc
+	factor    *prometheus.Desc
+	factorMax *prometheus.Desc
+}
+
+func (pc *PriorityCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pc.jobs
+	ch <- pc.factor
+	ch <- pc.factorMax
+}
+
+func (pc *PriorityCollector) Collect(ch chan<- prometheus.Metric) {
+	data, err := PriorityData()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(pc.jobs, err)
+		return
+	}
+	pm := ParsePriorityMetrics(data)
+	ch <- prometheus.MustNewConstMetric(pc.jobs, prometheus.GaugeValue, pm.jobs)
+	if pm.jobs == 0 {
+		return
+	}
+	for _, factor := range priorityFactors {
+		ch <- prometheus.MustNewConstMetric(pc.factor, prometheus.GaugeValue, pm.factor[factor]/pm.jobs, factor)
+		ch <- prometheus.MustNewConstMetric(pc.factorMax, prometheus.GaugeValue, pm.max[factor], factor)
+	}
+}
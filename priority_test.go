@@ -0,0 +1,57 @@
+/* Copyright 2017 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPriorityMetrics(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sprio.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	pm := ParsePriorityMetrics(data)
+
+	// Job 1001 is eligible in two partitions, only its first line counts
+	assert.Equal(t, float64(4), pm.jobs)
+	assert.Equal(t, map[string]float64{
+		"age":       3300,
+		"fairshare": 26000,
+		"jobsize":   1600,
+		"partition": 4000,
+		"qos":       3000,
+	}, pm.factor)
+	assert.Equal(t, float64(16000), pm.max["fairshare"])
+	assert.Equal(t, float64(1000), pm.max["jobsize"])
+}
+
+func TestPriorityCollectorBasic(t *testing.T) {
+	// The fixture is missing, so the fake sprio exits with 1 like with
+	// priority/basic
+	defer fakeSlurm(t, map[string][]fakeOutput{
+		"sprio": {{"*", "test_data/missing.txt"}},
+	})()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewPriorityCollector())
+	_, err := registry.Gather()
+	assert.Error(t, err)
+}
@@ -0,0 +1,212 @@
+/* Copyright 2020 Joeri Hermans, Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Limits on GPUs of any type (gres/gpu=N) get this type label
+const anyGPUType = "any"
+
+// GPU limits of a QOS by type, for the whole QOS and per user
+type QOSGPULimits struct {
+	group    map[string]float64
+	per_user map[string]float64
+}
+
+// Execute sacctmgr to get the TRES limits and the preemption settings of
+// every QOS
+func QOSLimitsData() []byte {
+	return Execute("sacctmgr", []string{"-n", "-P", "show", "qos", "format=Name,GrpTRES,MaxTRESPU,Preempt,PreemptMode"})
+}
+
+// ParseGPUTRES keeps the GPUs of a TRES string by type, untyped
+// gres/gpu=N entries are reported with the "any" type
+func ParseGPUTRES(tres string, pe *ParseErrors) map[string]float64 {
+	gpus := make(map[string]float64)
+	for resource, count := range ParseTRES(tres, pe) {
+		switch {
+		case resource == "gres/gpu":
+			gpus[anyGPUType] += count
+		case strings.HasPrefix(resource, "gres/gpu:"):
+			gpus[strings.TrimPrefix(resource, "gres/gpu:")] += count
+		}
+	}
+	return gpus
+}
+
+// ParseQOSGPULimits takes the name|GrpTRES|MaxTRESPU lines of sacctmgr,
+// e.g. high|gres/gpu:a100=8|gres/gpu:a100=2, and returns the GPU limits
+// of the QOS which have at least one.
+func ParseQOSGPULimits(input []byte, pe *ParseErrors) map[string]*QOSGPULimits {
+	limits := make(map[string]*QOSGPULimits)
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) < 3 {
+			continue
+		}
+		group := ParseGPUTRES(fields[1], pe)
+		per_user := ParseGPUTRES(fields[2], pe)
+		if len(group) == 0 && len(per_user) == 0 {
+			continue
+		}
+		limits[fields[0]] = &QOSGPULimits{group, per_user}
+	}
+	return limits
+}
+
+// ParsePreemptibleQOS takes the name|GrpTRES|MaxTRESPU|Preempt|PreemptMode
+// lines of sacctmgr and returns the QOS which can be preempted: the QOS
+// listed in the Preempt of another QOS, unless their PreemptMode is off.
+func ParsePreemptibleQOS(input []byte) map[string]bool {
+	preempted := make(map[string]bool)
+	off := make(map[string]bool)
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) < 5 {
+			continue
+		}
+		for _, qos := range strings.Split(fields[3], ",") {
+			if qos != "" {
+				preempted[qos] = true
+			}
+		}
+		if strings.EqualFold(fields[4], "off") {
+			off[fields[0]] = true
+		}
+	}
+	preemptible := make(map[string]bool)
+	for qos := range preempted {
+		if !off[qos] {
+			preemptible[qos] = true
+		}
+	}
+	return preemptible
+}
+
+// Execute the squeue command and return the QOS and TRES of running jobs.
+// The columns are unbounded and delimited, the QOS names may be long.
+func AllocatedGPUsByQOSData() []byte {
+	args := []string{"--state=RUNNING", "--noheader", "--Format=qos:.|,tres-alloc:."}
+	return Execute("squeue", args)
+}
+
+// ParseAllocatedGPUsByQOS returns map of ["qos"]["gpu_type"]allocated GPUs,
+// all the GPUs of a job being also counted with the "any" type
+func ParseAllocatedGPUsByQOS(input []byte, pe *ParseErrors) map[string]map[string]float64 {
+	result := make(map[string]map[string]float64)
+
+	for _, line := range strings.Split(string(input), "\n") {
+		// qos|tres, e.g. normal|cpu=8,gres/gpu:a100=2
+		fields := strings.Split(line, "|")
+		if len(fields) < 2 {
+			continue
+		}
+		qos := strings.TrimSpace(fields[0])
+		for gpu_type, count := range ParseGPUTRES(strings.TrimSpace(fields[1]), pe) {
+			if result[qos] == nil {
+				result[qos] = make(map[string]float64)
+			}
+			result[qos][gpu_type] += count
+		}
+	}
+	return result
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * Slurm QOS GPU metrics into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+func NewQOSCollector() *QOSCollector {
+	labels := []string{"qos", "type"}
+	return &QOSCollector{
+		parseErrors:  &ParseErrors{},
+		limit:        NewDesc("slurm_qos_gpu_limit", "GPUs limit of the QOS (GrpTRES) by type", labels, nil),
+		limitPerUser: NewDesc("slurm_qos_gpu_limit_per_user", "GPUs limit per user of the QOS (MaxTRESPU) by type", labels, nil),
+		used:         NewDesc("slurm_qos_gpu_used", "GPUs allocated to running jobs of the QOS by type", labels, nil),
+		preemptible:  NewDesc("slurm_gpus_alloc_preemptible", "GPUs allocated to running jobs of a preemptible QOS by type", []string{"type"}, nil),
+		protected:    NewDesc("slurm_gpus_alloc_non_preemptible", "GPUs allocated to running jobs of a QOS which can not be preempted by type", []string{"type"}, nil),
+	}
+}
+
+type QOSCollector struct {
+	limit        *prometheus.Desc
+	limitPerUser *prometheus.Desc
+	used         *prometheus.Desc
+	preemptible  *prometheus.Desc
+	protected    *prometheus.Desc
+	parseErrors  *ParseErrors
+}
+
+func (qc *QOSCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- qc.limit
+	ch <- qc.limitPerUser
+	ch <- qc.used
+	ch <- qc.preemptible
+	ch <- qc.protected
+}
+
+func (qc *QOSCollector) Collect(ch chan<- prometheus.Metric) {
+	sacctmgr := QOSLimitsData()
+	limits := ParseQOSGPULimits(sacctmgr, qc.parseErrors)
+	used := ParseAllocatedGPUsByQOS(AllocatedGPUsByQOSData(), qc.parseErrors)
+	allowed := func(gpu_type string) bool {
+		return gpu_type == anyGPUType || gpuTypeFilter.Allowed(gpu_type)
+	}
+	for qos, l := range limits {
+		// Usage is only exported next to a limit, to see how close it is
+		types := make(map[string]bool)
+		for gpu_type, count := range l.group {
+			if allowed(gpu_type) {
+				ch <- prometheus.MustNewConstMetric(qc.limit, prometheus.GaugeValue, count, qos, gpu_type)
+				types[gpu_type] = true
+			}
+		}
+		for gpu_type, count := range l.per_user {
+			if allowed(gpu_type) {
+				ch <- prometheus.MustNewConstMetric(qc.limitPerUser, prometheus.GaugeValue, count, qos, gpu_type)
+				types[gpu_type] = true
+			}
+		}
+		for gpu_type := range types {
+			ch <- prometheus.MustNewConstMetric(qc.used, prometheus.GaugeValue, used[qos][gpu_type], qos, gpu_type)
+		}
+	}
+	// Preemptible QOS from the same sacctmgr output as the limits
+	preemptible := ParsePreemptibleQOS(sacctmgr)
+	alloc := map[bool]map[string]float64{true: {}, false: {}}
+	for qos, gpus := range used {
+		for gpu_type, count := range gpus {
+			if gpu_type != anyGPUType && gpuTypeFilter.Allowed(gpu_type) {
+				alloc[preemptible[qos]][gpu_type] += count
+			}
+		}
+	}
+	for gpu_type, count := range alloc[true] {
+		ch <- prometheus.MustNewConstMetric(qc.preemptible, prometheus.GaugeValue, count, gpu_type)
+	}
+	for gpu_type, count := range alloc[false] {
+		ch <- prometheus.MustNewConstMetric(qc.protected, prometheus.GaugeValue, count, gpu_type)
+	}
+	if err := qc.parseErrors.Take(); err != nil {
+		ch <- prometheus.NewInvalidMetric(qc.limit, err)
+	}
+}
@@ -0,0 +1,91 @@
+/* Copyright 2020 Joeri Hermans, Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQOSGPULimits(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sacctmgr_qos.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	limits := ParseQOSGPULimits(data, nil)
+	t.Logf("%+v", limits)
+
+	// high caps a100 usage for the QOS and per user
+	assert.Equal(t, map[string]float64{"a100": 8}, limits["high"].group)
+	assert.Equal(t, map[string]float64{"a100": 2}, limits["high"].per_user)
+	assert.Equal(t, map[string]float64{"any": 4}, limits["long"].group)
+	// QOS without GPU limits are left out
+	assert.NotContains(t, limits, "normal")
+	assert.NotContains(t, limits, "debug")
+}
+
+func TestPreemptibleQOS(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sacctmgr_qos.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	// high preempts normal, debug and scavenger, but debug has
+	// PreemptMode=off
+	assert.Equal(t, map[string]bool{"normal": true, "scavenger": true}, ParsePreemptibleQOS(data))
+}
+
+func TestAllocatedGPUsByQOS(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/squeue_gpus_qos.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	used := ParseAllocatedGPUsByQOS(data, nil)
+	assert.Equal(t, map[string]float64{"a100": 6, "any": 6}, used["high"])
+	assert.Equal(t, map[string]float64{"v100": 1, "any": 1}, used["long"])
+	assert.Equal(t, map[string]float64{"a100": 1, "any": 1}, used["normal"])
+
+	// A QOS name longer than the default width
+	used = ParseAllocatedGPUsByQOS([]byte("gpu-interactive-priority|cpu=2,gres/gpu:a100=1\n"), nil)
+	assert.Equal(t, float64(1), used["gpu-interactive-priority"]["a100"])
+}
+
+func TestQOSCollector(t *testing.T) {
+	defer fakeSlurm(t, map[string][]fakeOutput{
+		"sacctmgr": {{"*", "test_data/sacctmgr_qos.txt"}},
+		"squeue":   {{"*", "test_data/squeue_gpus_qos.txt"}},
+	})()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewQOSCollector())
+	metrics := collectMetrics(t, registry)
+
+	assert.Equal(t, float64(8), metrics[`slurm_qos_gpu_limit{qos="high",type="a100"}`])
+	assert.Equal(t, float64(2), metrics[`slurm_qos_gpu_limit_per_user{qos="high",type="a100"}`])
+	assert.Equal(t, float64(6), metrics[`slurm_qos_gpu_used{qos="high",type="a100"}`])
+	assert.Equal(t, float64(4), metrics[`slurm_qos_gpu_limit{qos="long",type="any"}`])
+	assert.Equal(t, float64(1), metrics[`slurm_qos_gpu_used{qos="long",type="any"}`])
+	assert.NotContains(t, metrics, `slurm_qos_gpu_used{qos="normal",type="a100"}`)
+	// The a100 job of normal can be preempted by high, high and long are
+	// protected
+	assert.Equal(t, float64(1), metrics[`slurm_gpus_alloc_preemptible{type="a100"}`])
+	assert.Equal(t, float64(6), metrics[`slurm_gpus_alloc_non_preemptible{type="a100"}`])
+	assert.Equal(t, float64(1), metrics[`slurm_gpus_alloc_non_preemptible{type="v100"}`])
+	assert.NotContains(t, metrics, `slurm_gpus_alloc_preemptible{type="v100"}`)
+	assert.NotContains(t, metrics, `slurm_gpus_alloc_preemptible{type="any"}`)
+}
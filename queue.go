@@ -16,9 +16,6 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>. */
 package main
 
 import (
-	"io/ioutil"
-	"log"
-	"os/exec"
 	"strconv"
 	"strings"
 
@@ -158,21 +155,65 @@ func ParseQueueMetrics(input []byte) *QueueMetrics {
 	return &qm
 }
 
-// Execute the squeue command and return its output
-func QueueData() []byte {
-	cmd := exec.Command("squeue", "-h", "-o %P,%T,%C,%r,%u")
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
+// Pending reasons of held jobs by who holds them
+var holdReasons = map[string]string{
+	"JobHeldAdmin": "admin",
+	"JobHeldUser":  "user",
+}
+
+// HeldJobs counts the pending jobs held by an administrator or by their
+// user, these jobs are not waiting for resources
+func HeldJobs(qm *QueueMetrics) map[string]float64 {
+	held := map[string]float64{"admin": 0, "user": 0}
+	for reason, users := range qm.pending {
+		hold, ok := holdReasons[reason]
+		if !ok {
+			continue
+		}
+		for _, partitions := range users {
+			for _, count := range partitions {
+				held[hold] += count
+			}
+		}
 	}
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
+	return held
+}
+
+// LimitedReason returns whether the pending reason is a limit of the QOS
+// (e.g. QOSMaxGRESPerUser, QOSGrpCpuLimit) or of the association (e.g.
+// AssocMaxJobsLimit, AssociationResourceLimit), or "" for other reasons.
+// QOSNotAllowed is a wrong submission rather than a limit.
+func LimitedReason(reason string) string {
+	switch {
+	case strings.HasPrefix(reason, "QOS") && reason != "QOSNotAllowed":
+		return "qos"
+	case strings.HasPrefix(reason, "Assoc"):
+		return "assoc"
 	}
-	out, _ := ioutil.ReadAll(stdout)
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
+	return ""
+}
+
+// LimitedJobs counts the pending jobs held back by the limits of their QOS
+// or association, which are bound by policy rather than by capacity
+func LimitedJobs(qm *QueueMetrics) map[string]float64 {
+	limited := map[string]float64{"qos": 0, "assoc": 0}
+	for reason, users := range qm.pending {
+		limit := LimitedReason(reason)
+		if limit == "" {
+			continue
+		}
+		for _, partitions := range users {
+			for _, count := range partitions {
+				limited[limit] += count
+			}
+		}
 	}
-	return out
+	return limited
+}
+
+// Execute the squeue command and return its output
+func QueueData() []byte {
+	return Execute("squeue", []string{"-h", "-o %P,%T,%C,%r,%u"})
 }
 
 /*
@@ -183,28 +224,31 @@ func QueueData() []byte {
 
 func NewQueueCollector() *QueueCollector {
 	return &QueueCollector{
-		pending:           prometheus.NewDesc("slurm_queue_pending", "Pending jobs in queue", []string{"user", "partition", "reason"}, nil),
-		running:           prometheus.NewDesc("slurm_queue_running", "Running jobs in the cluster", []string{"user", "partition"}, nil),
-		suspended:         prometheus.NewDesc("slurm_queue_suspended", "Suspended jobs in the cluster", []string{"user", "partition"}, nil),
-		cancelled:         prometheus.NewDesc("slurm_queue_cancelled", "Cancelled jobs in the cluster", []string{"user", "partition"}, nil),
-		completing:        prometheus.NewDesc("slurm_queue_completing", "Completing jobs in the cluster", []string{"user", "partition"}, nil),
-		completed:         prometheus.NewDesc("slurm_queue_completed", "Completed jobs in the cluster", []string{"user", "partition"}, nil),
-		configuring:       prometheus.NewDesc("slurm_queue_configuring", "Configuring jobs in the cluster", []string{"user", "partition"}, nil),
-		failed:            prometheus.NewDesc("slurm_queue_failed", "Number of failed jobs", []string{"user", "partition"}, nil),
-		timeout:           prometheus.NewDesc("slurm_queue_timeout", "Jobs stopped by timeout", []string{"user", "partition"}, nil),
-		preempted:         prometheus.NewDesc("slurm_queue_preempted", "Number of preempted jobs", []string{"user", "partition"}, nil),
-		node_fail:         prometheus.NewDesc("slurm_queue_node_fail", "Number of jobs stopped due to node fail", []string{"user", "partition"}, nil),
-		cores_pending:     prometheus.NewDesc("slurm_cores_pending", "Pending cores in queue", []string{"user", "partition", "reason"}, nil),
-		cores_running:     prometheus.NewDesc("slurm_cores_running", "Running cores in the cluster", []string{"user", "partition"}, nil),
-		cores_suspended:   prometheus.NewDesc("slurm_cores_suspended", "Suspended cores in the cluster", []string{"user", "partition"}, nil),
-		cores_cancelled:   prometheus.NewDesc("slurm_cores_cancelled", "Cancelled cores in the cluster", []string{"user", "partition"}, nil),
-		cores_completing:  prometheus.NewDesc("slurm_cores_completing", "Completing cores in the cluster", []string{"user", "partition"}, nil),
-		cores_completed:   prometheus.NewDesc("slurm_cores_completed", "Completed cores in the cluster", []string{"user", "partition"}, nil),
-		cores_configuring: prometheus.NewDesc("slurm_cores_configuring", "Configuring cores in the cluster", []string{"user", "partition"}, nil),
-		cores_failed:      prometheus.NewDesc("slurm_cores_failed", "Number of failed cores", []string{"user", "partition"}, nil),
-		cores_timeout:     prometheus.NewDesc("slurm_cores_timeout", "Cores stopped by timeout", []string{"user", "partition"}, nil),
-		cores_preempted:   prometheus.NewDesc("slurm_cores_preempted", "Number of preempted cores", []string{"user", "partition"}, nil),
-		cores_node_fail:   prometheus.NewDesc("slurm_cores_node_fail", "Number of cores stopped due to node fail", []string{"user", "partition"}, nil),
+		pending:           NewDesc("slurm_queue_pending", "Pending jobs in queue", []string{"user", "partition", "reason"}, nil),
+		running:           NewDesc("slurm_queue_running", "Running jobs in the cluster", []string{"user", "partition"}, nil),
+		suspended:         NewDesc("slurm_queue_suspended", "Suspended jobs in the cluster", []string{"user", "partition"}, nil),
+		cancelled:         NewDesc("slurm_queue_cancelled", "Cancelled jobs in the cluster", []string{"user", "partition"}, nil),
+		completing:        NewDesc("slurm_queue_completing", "Completing jobs in the cluster", []string{"user", "partition"}, nil),
+		completed:         NewDesc("slurm_queue_completed", "Completed jobs in the cluster", []string{"user", "partition"}, nil),
+		configuring:       NewDesc("slurm_queue_configuring", "Configuring jobs in the cluster", []string{"user", "partition"}, nil),
+		failed:            NewDesc("slurm_queue_failed", "Number of failed jobs", []string{"user", "partition"}, nil),
+		timeout:           NewDesc("slurm_queue_timeout", "Jobs stopped by timeout", []string{"user", "partition"}, nil),
+		preempted:         NewDesc("slurm_queue_preempted", "Number of preempted jobs", []string{"user", "partition"}, nil),
+		node_fail:         NewDesc("slurm_queue_node_fail", "Number of jobs stopped due to node fail", []string{"user", "partition"}, nil),
+		cores_pending:     NewDesc("slurm_cores_pending", "Pending cores in queue", []string{"user", "partition", "reason"}, nil),
+		cores_running:     NewDesc("slurm_cores_running", "Running cores in the cluster", []string{"user", "partition"}, nil),
+		cores_suspended:   NewDesc("slurm_cores_suspended", "Suspended cores in the cluster", []string{"user", "partition"}, nil),
+		cores_cancelled:   NewDesc("slurm_cores_cancelled", "Cancelled cores in the cluster", []string{"user", "partition"}, nil),
+		cores_completing:  NewDesc("slurm_cores_completing", "Completing cores in the cluster", []string{"user", "partition"}, nil),
+		cores_completed:   NewDesc("slurm_cores_completed", "Completed cores in the cluster", []string{"user", "partition"}, nil),
+		cores_configuring: NewDesc("slurm_cores_configuring", "Configuring cores in the cluster", []string{"user", "partition"}, nil),
+		cores_failed:      NewDesc("slurm_cores_failed", "Number of failed cores", []string{"user", "partition"}, nil),
+		cores_timeout:     NewDesc("slurm_cores_timeout", "Cores stopped by timeout", []string{"user", "partition"}, nil),
+		cores_preempted:   NewDesc("slurm_cores_preempted", "Number of preempted cores", []string{"user", "partition"}, nil),
+		cores_node_fail:   NewDesc("slurm_cores_node_fail", "Number of cores stopped due to node fail", []string{"user", "partition"}, nil),
+		held:              NewDesc("slurm_jobs_held", "Pending jobs held by an administrator or by their user", []string{"hold"}, nil),
+		qosLimit:          NewDesc("slurm_jobs_pending_qoslimit", "Pending jobs held back by a limit of their QOS", nil, nil),
+		assocLimit:        NewDesc("slurm_jobs_pending_assoclimit", "Pending jobs held back by a limit of their association", nil, nil),
 	}
 }
 
@@ -231,6 +275,9 @@ type QueueCollector struct {
 	cores_timeout     *prometheus.Desc
 	cores_preempted   *prometheus.Desc
 	cores_node_fail   *prometheus.Desc
+	held              *prometheus.Desc
+	qosLimit          *prometheus.Desc
+	assocLimit        *prometheus.Desc
 }
 
 func (qc *QueueCollector) Describe(ch chan<- *prometheus.Desc) {
@@ -256,6 +303,9 @@ func (qc *QueueCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- qc.cores_timeout
 	ch <- qc.cores_preempted
 	ch <- qc.cores_node_fail
+	ch <- qc.held
+	ch <- qc.qosLimit
+	ch <- qc.assocLimit
 }
 
 func (qc *QueueCollector) Collect(ch chan<- prometheus.Metric) {
@@ -285,6 +335,12 @@ func (qc *QueueCollector) Collect(ch chan<- prometheus.Metric) {
 	PushMetric(qm.c_timeout, ch, qc.cores_timeout, "")
 	PushMetric(qm.c_preempted, ch, qc.cores_preempted, "")
 	PushMetric(qm.c_node_fail, ch, qc.cores_node_fail, "")
+	for hold, count := range HeldJobs(qm) {
+		ch <- prometheus.MustNewConstMetric(qc.held, prometheus.GaugeValue, count, hold)
+	}
+	limited := LimitedJobs(qm)
+	ch <- prometheus.MustNewConstMetric(qc.qosLimit, prometheus.GaugeValue, limited["qos"])
+	ch <- prometheus.MustNewConstMetric(qc.assocLimit, prometheus.GaugeValue, limited["assoc"])
 }
 
 func PushMetric(m map[string]map[string]float64, ch chan<- prometheus.Metric, coll *prometheus.Desc, a_label string) {
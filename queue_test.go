@@ -19,6 +19,8 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestParseQueueMetrics(t *testing.T) {
@@ -30,3 +32,25 @@ func TestParseQueueMetrics(t *testing.T) {
 	data, err := ioutil.ReadAll(file)
 	t.Logf("%+v", ParseQueueMetrics(data))
 }
+
+func TestHeldJobs(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/squeue_held.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	held := HeldJobs(ParseQueueMetrics(data))
+	assert.Equal(t, map[string]float64{"admin": 2, "user": 3}, held)
+}
+
+func TestLimitedJobs(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/squeue_limits.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	limited := LimitedJobs(ParseQueueMetrics(data))
+	assert.Equal(t, map[string]float64{"qos": 3, "assoc": 3}, limited)
+	assert.Equal(t, "qos", LimitedReason("QOSMaxJobsPerUserLimit"))
+	assert.Equal(t, "assoc", LimitedReason("AssociationJobLimit"))
+	assert.Equal(t, "", LimitedReason("QOSNotAllowed"))
+	assert.Equal(t, "", LimitedReason("Resources"))
+}
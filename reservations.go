@@ -0,0 +1,127 @@
+/* Copyright 2017 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A reservation and the nodes it holds
+type Reservation struct {
+	name  string
+	state string
+	nodes []string
+}
+
+// Execute scontrol to get every reservation, one per line
+func ReservationsData() []byte {
+	return Execute("scontrol", []string{"show", "reservation", "-o"})
+}
+
+// ParseReservations takes the output of scontrol show reservation -o.
+// Without reservations scontrol prints "No reservations in the system",
+// which has no ReservationName= and is skipped.
+func ParseReservations(input []byte) []Reservation {
+	reservations := []Reservation{}
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := ParseScontrolFields(line)
+		name, ok := fields["ReservationName"]
+		if !ok {
+			continue
+		}
+		reservations = append(reservations, Reservation{
+			name:  name,
+			state: fields["State"],
+			nodes: ExpandNodeList(fields["Nodes"]),
+		})
+	}
+	return reservations
+}
+
+// ReservationGPUs sums the GPUs of the nodes of every active reservation
+// by type. A reservation holding only some cores of a node is accounted
+// with all the GPUs of the node. Given the idle GPUs of every node (see
+// ParseNodeIdleGPUs) it sums the reserved GPUs running no job instead.
+func ReservationGPUs(reservations []Reservation, node_gpus map[string]map[string]float64) map[string]map[string]float64 {
+	result := make(map[string]map[string]float64)
+	for _, r := range reservations {
+		if r.state != "ACTIVE" {
+			continue
+		}
+		for _, node := range r.nodes {
+			for gpu_type, count := range node_gpus[node] {
+				if result[r.name] == nil {
+					result[r.name] = make(map[string]float64)
+				}
+				result[r.name][gpu_type] += count
+			}
+		}
+	}
+	return result
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * Slurm reservations metrics into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+func NewReservationsCollector() *ReservationsCollector {
+	return &ReservationsCollector{
+		parseErrors: &ParseErrors{},
+		gpus:        NewDesc("slurm_reservation_gpus", "GPUs of the nodes in an active reservation by type", []string{"name", "type"}, nil),
+		idle:        NewDesc("slurm_reservation_gpus_idle", "GPUs of the nodes in an active reservation running no job by type", []string{"name", "type"}, nil),
+	}
+}
+
+type ReservationsCollector struct {
+	gpus        *prometheus.Desc
+	idle        *prometheus.Desc
+	parseErrors *ParseErrors
+}
+
+func (rc *ReservationsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rc.gpus
+	ch <- rc.idle
+}
+
+func (rc *ReservationsCollector) Collect(ch chan<- prometheus.Metric) {
+	reservations := ParseReservations(ReservationsData())
+	nodes, err := ScontrolNodesData()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(rc.gpus, err)
+		return
+	}
+	for name, types := range ReservationGPUs(reservations, ParseNodeGPUs(nodes, rc.parseErrors)) {
+		for gpu_type, count := range types {
+			if gpuTypeFilter.Allowed(gpu_type) {
+				ch <- prometheus.MustNewConstMetric(rc.gpus, prometheus.GaugeValue, count, name, gpu_type)
+			}
+		}
+	}
+	for name, types := range ReservationGPUs(reservations, ParseNodeIdleGPUs(nodes, rc.parseErrors)) {
+		for gpu_type, count := range types {
+			if gpuTypeFilter.Allowed(gpu_type) {
+				ch <- prometheus.MustNewConstMetric(rc.idle, prometheus.GaugeValue, count, name, gpu_type)
+			}
+		}
+	}
+	if err := rc.parseErrors.Take(); err != nil {
+		ch <- prometheus.NewInvalidMetric(rc.gpus, err)
+	}
+}
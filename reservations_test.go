@@ -0,0 +1,83 @@
+/* Copyright 2017 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseReservations(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/scontrol_reservations.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	reservations := ParseReservations(data)
+	assert.Equal(t, 3, len(reservations))
+	assert.Equal(t, Reservation{"maint", "ACTIVE", []string{"gpu01", "gpu02"}}, reservations[0])
+	assert.Equal(t, []string{"gpu03", "c01"}, reservations[1].nodes)
+
+	assert.Equal(t, 0, len(ParseReservations([]byte("No reservations in the system\n"))))
+}
+
+func TestReservationGPUs(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/scontrol_reservations.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	nodes, err := ioutil.ReadFile("test_data/scontrol_nodes.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	gpus := ReservationGPUs(ParseReservations(data), ParseNodeGPUs(nodes, nil))
+	t.Logf("%+v", gpus)
+
+	assert.Equal(t, map[string]float64{"a100": 8}, gpus["maint"])
+	// c01 has no GPUs
+	assert.Equal(t, map[string]float64{"v100": 2, "k80": 1}, gpus["course"])
+	// upgrade is not active yet
+	assert.NotContains(t, gpus, "upgrade")
+}
+
+func TestReservationIdleGPUs(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/scontrol_reservations.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	nodes, err := ioutil.ReadFile("test_data/scontrol_nodes.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	idle := ReservationGPUs(ParseReservations(data), ParseNodeIdleGPUs(nodes, nil))
+	t.Logf("%+v", idle)
+
+	// gpu01 runs jobs on 2 of its GPUs, gpu02 runs none
+	assert.Equal(t, map[string]float64{"a100": 6}, idle["maint"])
+	// gpu03 is fully allocated
+	assert.Equal(t, map[string]float64{"v100": 0, "k80": 0}, idle["course"])
+	assert.NotContains(t, idle, "upgrade")
+}
+
+func TestReservationNoConsumeGPUs(t *testing.T) {
+	// The quadro of viz01 are no_consume, in neither the total nor the idle
+	reservations := ParseReservations([]byte("ReservationName=viz Nodes=viz01 NodeCnt=1 State=ACTIVE\n"))
+	nodes := []byte("NodeName=viz01 Gres=gpu:quadro:no_consume:2,gpu:a100:2(S:0) AllocTRES=cpu=2,gres/gpu:a100=1\n")
+
+	assert.Equal(t, map[string]float64{"a100": 2}, ReservationGPUs(reservations, ParseNodeGPUs(nodes, nil))["viz"])
+	assert.Equal(t, map[string]float64{"a100": 1}, ReservationGPUs(reservations, ParseNodeIdleGPUs(nodes, nil))["viz"])
+}
@@ -16,14 +16,12 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>. */
 package main
 
 import (
-	"io/ioutil"
-	"os/exec"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/log"
 )
 
 /*
@@ -52,23 +50,12 @@ type SchedulerMetrics struct {
 	user_rpc_stats_count              map[string]float64
 	user_rpc_stats_avg_time           map[string]float64
 	user_rpc_stats_total_time         map[string]float64
+	stats_since                       float64
 }
 
 // Execute the sdiag command and return its output
 func SchedulerData() []byte {
-	cmd := exec.Command("sdiag")
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
-	}
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
-	}
-	out, _ := ioutil.ReadAll(stdout)
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
-	}
-	return out
+	return Execute("sdiag", nil)
 }
 
 // Extract the relevant metrics from the sdiag output
@@ -80,6 +67,10 @@ func ParseSchedulerMetrics(input []byte) *SchedulerMetrics {
 	lc_count := 0
 	mc_count := 0
 	for _, line := range lines {
+		if since, ok := ParseStatsSince(line); ok {
+			sm.stats_since = since
+			continue
+		}
 		if strings.Contains(line, ":") {
 			state := strings.Split(line, ":")[0]
 			st := regexp.MustCompile(`^Server thread`)
@@ -209,6 +200,40 @@ func ParseRpcStats(lines []string) []map[string]float64 {
 	return rpc_stats_final
 }
 
+// SchedulerCycleBusyRatio returns the share of the time spent in the
+// main scheduling cycle, the mean cycle time over the mean time between
+// two cycles. Close to 1, the scheduler is saturated.
+func SchedulerCycleBusyRatio(sm *SchedulerMetrics) float64 {
+	if sm.cycle_per_minute == 0 {
+		return 0
+	}
+	interval := 60e6 / sm.cycle_per_minute // microseconds
+	return sm.mean_cycle / interval
+}
+
+// ParseStatsSince returns the Unix time of the "Data since" line of
+// sdiag, when the statistics were reset by a restart of the controller
+// or at midnight. Recent Slurm versions add the Unix time in brackets,
+// e.g. "Data since      Thu Jun 01 00:00:00 2023 (1685577600)",
+// otherwise the date is read in the local time zone.
+func ParseStatsSince(line string) (float64, bool) {
+	if !strings.HasPrefix(line, "Data since") {
+		return 0, false
+	}
+	date := strings.TrimSpace(strings.TrimPrefix(line, "Data since"))
+	if i := strings.Index(date, "("); i >= 0 {
+		if since, err := strconv.ParseFloat(strings.TrimSuffix(date[i+1:], ")"), 64); err == nil {
+			return since, true
+		}
+		date = date[:i]
+	}
+	since, err := time.ParseInLocation("Mon Jan 2 15:04:05 2006", strings.Join(strings.Fields(date), " "), time.Local)
+	if err != nil {
+		return 0, false
+	}
+	return float64(since.Unix()), true
+}
+
 // Returns the scheduler metrics
 func SchedulerGetMetrics() *SchedulerMetrics {
 	return ParseSchedulerMetrics(SchedulerData())
@@ -228,6 +253,7 @@ type SchedulerCollector struct {
 	last_cycle                        *prometheus.Desc
 	mean_cycle                        *prometheus.Desc
 	cycle_per_minute                  *prometheus.Desc
+	cycle_busy_ratio                  *prometheus.Desc
 	backfill_last_cycle               *prometheus.Desc
 	backfill_mean_cycle               *prometheus.Desc
 	backfill_depth_mean               *prometheus.Desc
@@ -240,6 +266,7 @@ type SchedulerCollector struct {
 	user_rpc_stats_count              *prometheus.Desc
 	user_rpc_stats_avg_time           *prometheus.Desc
 	user_rpc_stats_total_time         *prometheus.Desc
+	stats_since                       *prometheus.Desc
 }
 
 // Send all metric descriptions
@@ -250,6 +277,7 @@ func (c *SchedulerCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.last_cycle
 	ch <- c.mean_cycle
 	ch <- c.cycle_per_minute
+	ch <- c.cycle_busy_ratio
 	ch <- c.backfill_last_cycle
 	ch <- c.backfill_mean_cycle
 	ch <- c.backfill_depth_mean
@@ -262,6 +290,7 @@ func (c *SchedulerCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.user_rpc_stats_count
 	ch <- c.user_rpc_stats_avg_time
 	ch <- c.user_rpc_stats_total_time
+	ch <- c.stats_since
 }
 
 // Send the values of all metrics
@@ -273,12 +302,16 @@ func (sc *SchedulerCollector) Collect(ch chan<- prometheus.Metric) {
 	ch <- prometheus.MustNewConstMetric(sc.last_cycle, prometheus.GaugeValue, sm.last_cycle)
 	ch <- prometheus.MustNewConstMetric(sc.mean_cycle, prometheus.GaugeValue, sm.mean_cycle)
 	ch <- prometheus.MustNewConstMetric(sc.cycle_per_minute, prometheus.GaugeValue, sm.cycle_per_minute)
+	ch <- prometheus.MustNewConstMetric(sc.cycle_busy_ratio, prometheus.GaugeValue, SchedulerCycleBusyRatio(sm))
 	ch <- prometheus.MustNewConstMetric(sc.backfill_last_cycle, prometheus.GaugeValue, sm.backfill_last_cycle)
 	ch <- prometheus.MustNewConstMetric(sc.backfill_mean_cycle, prometheus.GaugeValue, sm.backfill_mean_cycle)
 	ch <- prometheus.MustNewConstMetric(sc.backfill_depth_mean, prometheus.GaugeValue, sm.backfill_depth_mean)
 	ch <- prometheus.MustNewConstMetric(sc.total_backfilled_jobs_since_start, prometheus.GaugeValue, sm.total_backfilled_jobs_since_start)
 	ch <- prometheus.MustNewConstMetric(sc.total_backfilled_jobs_since_cycle, prometheus.GaugeValue, sm.total_backfilled_jobs_since_cycle)
 	ch <- prometheus.MustNewConstMetric(sc.total_backfilled_heterogeneous, prometheus.GaugeValue, sm.total_backfilled_heterogeneous)
+	if sm.stats_since > 0 {
+		ch <- prometheus.MustNewConstMetric(sc.stats_since, prometheus.GaugeValue, sm.stats_since)
+	}
 	for rpc_type, value := range sm.rpc_stats_count {
 		ch <- prometheus.MustNewConstMetric(sc.rpc_stats_count, prometheus.GaugeValue, value, rpc_type)
 	}
@@ -307,92 +340,102 @@ func NewSchedulerCollector() *SchedulerCollector {
 	user_rpc_stats_labels := make([]string, 0, 1)
 	user_rpc_stats_labels = append(user_rpc_stats_labels, "user")
 	return &SchedulerCollector{
-		threads: prometheus.NewDesc(
+		threads: NewDesc(
 			"slurm_scheduler_threads",
 			"Information provided by the Slurm sdiag command, number of scheduler threads ",
 			nil,
 			nil),
-		queue_size: prometheus.NewDesc(
+		queue_size: NewDesc(
 			"slurm_scheduler_queue_size",
 			"Information provided by the Slurm sdiag command, length of the scheduler queue",
 			nil,
 			nil),
-		dbd_queue_size: prometheus.NewDesc(
+		dbd_queue_size: NewDesc(
 			"slurm_scheduler_dbd_queue_size",
 			"Information provided by the Slurm sdiag command, length of the DBD agent queue",
 			nil,
 			nil),
-		last_cycle: prometheus.NewDesc(
+		last_cycle: NewDesc(
 			"slurm_scheduler_last_cycle",
 			"Information provided by the Slurm sdiag command, scheduler last cycle time in (microseconds)",
 			nil,
 			nil),
-		mean_cycle: prometheus.NewDesc(
+		mean_cycle: NewDesc(
 			"slurm_scheduler_mean_cycle",
 			"Information provided by the Slurm sdiag command, scheduler mean cycle time in (microseconds)",
 			nil,
 			nil),
-		cycle_per_minute: prometheus.NewDesc(
+		cycle_per_minute: NewDesc(
 			"slurm_scheduler_cycle_per_minute",
 			"Information provided by the Slurm sdiag command, number scheduler cycles per minute",
 			nil,
 			nil),
-		backfill_last_cycle: prometheus.NewDesc(
+		stats_since: NewDesc(
+			"slurm_controller_stats_since_timestamp_seconds",
+			"Information provided by the Slurm sdiag command, Unix time of the last reset of the statistics, by a restart of the controller or at midnight",
+			nil,
+			nil),
+		cycle_busy_ratio: NewDesc(
+			"slurm_scheduler_cycle_busy_ratio",
+			"Share of the time spent in the main scheduling cycle, mean cycle time over the mean time between cycles",
+			nil,
+			nil),
+		backfill_last_cycle: NewDesc(
 			"slurm_scheduler_backfill_last_cycle",
 			"Information provided by the Slurm sdiag command, scheduler backfill last cycle time in (microseconds)",
 			nil,
 			nil),
-		backfill_mean_cycle: prometheus.NewDesc(
+		backfill_mean_cycle: NewDesc(
 			"slurm_scheduler_backfill_mean_cycle",
 			"Information provided by the Slurm sdiag command, scheduler backfill mean cycle time in (microseconds)",
 			nil,
 			nil),
-		backfill_depth_mean: prometheus.NewDesc(
+		backfill_depth_mean: NewDesc(
 			"slurm_scheduler_backfill_depth_mean",
 			"Information provided by the Slurm sdiag command, scheduler backfill mean depth",
 			nil,
 			nil),
-		total_backfilled_jobs_since_start: prometheus.NewDesc(
+		total_backfilled_jobs_since_start: NewDesc(
 			"slurm_scheduler_backfilled_jobs_since_start_total",
 			"Information provided by the Slurm sdiag command, number of jobs started thanks to backfilling since last slurm start",
 			nil,
 			nil),
-		total_backfilled_jobs_since_cycle: prometheus.NewDesc(
+		total_backfilled_jobs_since_cycle: NewDesc(
 			"slurm_scheduler_backfilled_jobs_since_cycle_total",
 			"Information provided by the Slurm sdiag command, number of jobs started thanks to backfilling since last time stats where reset",
 			nil,
 			nil),
-		total_backfilled_heterogeneous: prometheus.NewDesc(
+		total_backfilled_heterogeneous: NewDesc(
 			"slurm_scheduler_backfilled_heterogeneous_total",
 			"Information provided by the Slurm sdiag command, number of heterogeneous job components started thanks to backfilling since last Slurm start",
 			nil,
 			nil),
-		rpc_stats_count: prometheus.NewDesc(
+		rpc_stats_count: NewDesc(
 			"slurm_rpc_stats",
 			"Information provided by the Slurm sdiag command, rpc count statistic",
 			rpc_stats_labels,
 			nil),
-		rpc_stats_avg_time: prometheus.NewDesc(
+		rpc_stats_avg_time: NewDesc(
 			"slurm_rpc_stats_avg_time",
 			"Information provided by the Slurm sdiag command, rpc average time statistic",
 			rpc_stats_labels,
 			nil),
-		rpc_stats_total_time: prometheus.NewDesc(
+		rpc_stats_total_time: NewDesc(
 			"slurm_rpc_stats_total_time",
 			"Information provided by the Slurm sdiag command, rpc total time statistic",
 			rpc_stats_labels,
 			nil),
-		user_rpc_stats_count: prometheus.NewDesc(
+		user_rpc_stats_count: NewDesc(
 			"slurm_user_rpc_stats",
 			"Information provided by the Slurm sdiag command, rpc count statistic per user",
 			user_rpc_stats_labels,
 			nil),
-		user_rpc_stats_avg_time: prometheus.NewDesc(
+		user_rpc_stats_avg_time: NewDesc(
 			"slurm_user_rpc_stats_avg_time",
 			"Information provided by the Slurm sdiag command, rpc average time statistic per user",
 			user_rpc_stats_labels,
 			nil),
-		user_rpc_stats_total_time: prometheus.NewDesc(
+		user_rpc_stats_total_time: NewDesc(
 			"slurm_user_rpc_stats_total_time",
 			"Information provided by the Slurm sdiag command, rpc total time statistic per user",
 			user_rpc_stats_labels,
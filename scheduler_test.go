@@ -19,6 +19,9 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestSchedulerMetrics(t *testing.T) {
@@ -30,3 +33,30 @@ func TestSchedulerMetrics(t *testing.T) {
 	data, err := ioutil.ReadAll(file)
 	t.Logf("%+v", ParseSchedulerMetrics(data))
 }
+
+func TestSchedulerCycleBusyRatio(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sdiag.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	sm := ParseSchedulerMetrics(data)
+	// Mean cycle of 74593us, 63 cycles per minute
+	assert.InDelta(t, 74593*63/60e6, SchedulerCycleBusyRatio(sm), 1e-9)
+
+	assert.Equal(t, 0.0, SchedulerCycleBusyRatio(&SchedulerMetrics{mean_cycle: 1000}))
+}
+
+func TestStatsSince(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sdiag.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	since := time.Date(2017, time.April, 12, 2, 0, 0, 0, time.Local)
+	assert.Equal(t, float64(since.Unix()), ParseSchedulerMetrics(data).stats_since)
+
+	since_epoch, ok := ParseStatsSince("Data since      Thu Jun 01 00:00:00 2023 (1685577600)")
+	assert.True(t, ok)
+	assert.Equal(t, float64(1685577600), since_epoch)
+	_, ok = ParseStatsSince("Data since      unknown")
+	assert.False(t, ok)
+}
@@ -0,0 +1,137 @@
+/* Copyright 2017-2020 Victor Penso, Matteo Dessalvi, Joeri Hermans
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A collect in progress, shared with the scrapes arriving meanwhile
+type scrapeCall struct {
+	done    chan struct{}
+	metrics []prometheus.Metric
+}
+
+// The metrics of the startup collect are served to the first scrape only
+// within this age, a later first scrape runs the Slurm commands again.
+const prewarmMaxAge = time.Minute
+
+// ScrapeLockCollector wraps a collector so that overlapping scrapes don't
+// run the Slurm commands twice: when a scrape takes longer than the
+// scrape interval, the next one waits for the collect in progress and
+// reuses its metrics.
+type ScrapeLockCollector struct {
+	collector prometheus.Collector
+
+	mu      sync.Mutex
+	call    *scrapeCall
+	waiting int
+	// The metrics of the startup collect, until the first scrape
+	warm     []prometheus.Metric
+	warmedAt time.Time
+	scraped  bool
+}
+
+func NewScrapeLockCollector(collector prometheus.Collector) *ScrapeLockCollector {
+	return &ScrapeLockCollector{collector: collector}
+}
+
+func (sc *ScrapeLockCollector) Describe(ch chan<- *prometheus.Desc) {
+	sc.collector.Describe(ch)
+}
+
+func (sc *ScrapeLockCollector) Collect(ch chan<- prometheus.Metric) {
+	sc.mu.Lock()
+	sc.scraped = true
+	metrics := sc.warm
+	if time.Since(sc.warmedAt) > prewarmMaxAge {
+		metrics = nil
+	}
+	sc.warm = nil
+	sc.mu.Unlock()
+
+	if metrics == nil {
+		metrics = sc.collect()
+	}
+	for _, m := range metrics {
+		ch <- m
+	}
+}
+
+// Warm runs a collect and keeps its metrics for the first scrape, unless
+// a scrape already got them while it was running.
+func (sc *ScrapeLockCollector) Warm() {
+	metrics := sc.collect()
+	sc.mu.Lock()
+	if !sc.scraped {
+		sc.warm = metrics
+		sc.warmedAt = time.Now()
+	}
+	sc.mu.Unlock()
+}
+
+// Run the wrapped collector, or wait for the collect in progress
+func (sc *ScrapeLockCollector) collect() []prometheus.Metric {
+	sc.mu.Lock()
+	call := sc.call
+	if call != nil {
+		sc.waiting++
+		sc.mu.Unlock()
+		<-call.done
+		return call.metrics
+	}
+	call = &scrapeCall{done: make(chan struct{})}
+	sc.call = call
+	sc.mu.Unlock()
+
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		sc.collector.Collect(metrics)
+		close(metrics)
+	}()
+	for m := range metrics {
+		call.metrics = append(call.metrics, m)
+	}
+
+	sc.mu.Lock()
+	sc.call = nil
+	sc.waiting = 0
+	sc.mu.Unlock()
+	close(call.done)
+	return call.metrics
+}
+
+// Prewarm runs one collect of every collector at startup. Its metrics are
+// served to the first scrape, and a scrape arriving meanwhile shares the
+// collect in progress instead of running the Slurm commands cold.
+func Prewarm(collectors []prometheus.Collector) {
+	var wg sync.WaitGroup
+	for _, collector := range collectors {
+		sc, ok := collector.(*ScrapeLockCollector)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(sc *ScrapeLockCollector) {
+			defer wg.Done()
+			sc.Warm()
+		}(sc)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,159 @@
+/* Copyright 2017-2020 Victor Penso, Matteo Dessalvi, Joeri Hermans
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+// A collector standing for a slow Slurm command, blocked until released
+type slowCollector struct {
+	desc    *prometheus.Desc
+	started chan struct{}
+	release chan struct{}
+	runs    int
+}
+
+func (c *slowCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *slowCollector) Collect(ch chan<- prometheus.Metric) {
+	c.runs++
+	c.started <- struct{}{}
+	<-c.release
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(c.runs))
+}
+
+func TestScrapeLockCollector(t *testing.T) {
+	slow := &slowCollector{
+		desc:    prometheus.NewDesc("slurm_test", "Test metric", nil, nil),
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	sc := NewScrapeLockCollector(slow)
+
+	var wg sync.WaitGroup
+	results := make([][]prometheus.Metric, 2)
+	scrape := func(i int) {
+		defer wg.Done()
+		ch := make(chan prometheus.Metric, 10)
+		sc.Collect(ch)
+		close(ch)
+		for m := range ch {
+			results[i] = append(results[i], m)
+		}
+	}
+
+	wg.Add(2)
+	go scrape(0)
+	<-slow.started
+	// The second scrape arrives while the first one is still running
+	go scrape(1)
+	for {
+		sc.mu.Lock()
+		waiting := sc.waiting
+		sc.mu.Unlock()
+		if waiting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(slow.release)
+	wg.Wait()
+
+	assert.Equal(t, 1, slow.runs)
+	assert.Equal(t, 1, len(results[0]))
+	assert.Equal(t, results[0], results[1])
+
+	// Once done, the next scrape runs the collector again
+	go func() { <-slow.started }()
+	ch := make(chan prometheus.Metric, 10)
+	sc.Collect(ch)
+	assert.Equal(t, 2, slow.runs)
+}
+
+func TestPrewarm(t *testing.T) {
+	slow := &slowCollector{
+		desc:    prometheus.NewDesc("slurm_test", "Test metric", nil, nil),
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	sc := NewScrapeLockCollector(slow)
+
+	done := make(chan struct{})
+	go func() {
+		Prewarm([]prometheus.Collector{sc})
+		close(done)
+	}()
+	<-slow.started
+
+	// The first scrape arrives while the startup collect is still running
+	ch := make(chan prometheus.Metric, 10)
+	go func() {
+		for {
+			sc.mu.Lock()
+			waiting := sc.waiting
+			sc.mu.Unlock()
+			if waiting == 1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		close(slow.release)
+	}()
+	sc.Collect(ch)
+	<-done
+
+	assert.Equal(t, 1, slow.runs)
+	assert.Equal(t, 1, len(ch))
+}
+
+func TestPrewarmCache(t *testing.T) {
+	slow := &slowCollector{
+		desc:    prometheus.NewDesc("slurm_test", "Test metric", nil, nil),
+		started: make(chan struct{}, 10),
+		release: make(chan struct{}),
+	}
+	close(slow.release)
+	sc := NewScrapeLockCollector(slow)
+	Prewarm([]prometheus.Collector{sc})
+	assert.Equal(t, 1, slow.runs)
+	assert.Equal(t, 1, len(sc.warm))
+
+	// The first scrape gets the startup collect without running it again
+	ch := make(chan prometheus.Metric, 10)
+	sc.Collect(ch)
+	assert.Equal(t, 1, slow.runs)
+	assert.Equal(t, 1, len(ch))
+	assert.Nil(t, sc.warm)
+
+	// The next ones run the collector
+	sc.Collect(ch)
+	assert.Equal(t, 2, slow.runs)
+
+	// A startup collect too old for the first scrape is dropped
+	sc = NewScrapeLockCollector(slow)
+	sc.Warm()
+	sc.warmedAt = time.Now().Add(-2 * prewarmMaxAge)
+	sc.Collect(ch)
+	assert.Equal(t, 4, slow.runs)
+}
@@ -16,28 +16,13 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>. */
 package main
 
 import (
-        "io/ioutil"
-        "os/exec"
-        "log"
         "strings"
         "strconv"
         "github.com/prometheus/client_golang/prometheus"
 )
 
 func FairShareData() []byte {
-        cmd := exec.Command( "sshare", "-n", "-P", "-o", "account,fairshare" )
-        stdout, err := cmd.StdoutPipe()
-        if err != nil {
-                log.Fatal(err)
-        }
-        if err := cmd.Start(); err != nil {
-                log.Fatal(err)
-        }
-        out, _ := ioutil.ReadAll(stdout)
-        if err := cmd.Wait(); err != nil {
-                log.Fatal(err)
-        }
-        return out
+        return Execute("sshare", []string{"-n", "-P", "-o", "account,fairshare"})
 }
 
 type FairShareMetrics struct {
@@ -70,7 +55,7 @@ type FairShareCollector struct {
 func NewFairShareCollector() *FairShareCollector {
         labels := []string{"account"}
         return &FairShareCollector{
-                fairshare: prometheus.NewDesc("slurm_account_fairshare","FairShare for account" , labels,nil),
+                fairshare: NewDesc("slurm_account_fairshare","FairShare for account" , labels,nil),
         }
 }
 
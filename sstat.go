@@ -0,0 +1,142 @@
+/* Copyright 2017 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// Execute the squeue command and return the id and elapsed time of the
+// running jobs
+func SstatJobsData() []byte {
+	return Execute("squeue", []string{"-h", "-t", "RUNNING", "-o", "%A %M"})
+}
+
+// ParseSstatJobs picks the jobs sstat is run for: sstat is expensive, so
+// only the max longest running jobs are sampled. It returns their ids
+// and their elapsed time in seconds.
+func ParseSstatJobs(input []byte, max int) ([]string, map[string]float64) {
+	elapsed := make(map[string]float64)
+	jobs := []string{}
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		d, ok := ParseSlurmDuration(fields[1])
+		if !ok {
+			continue
+		}
+		jobs = append(jobs, fields[0])
+		elapsed[fields[0]] = d.Seconds()
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if elapsed[jobs[i]] != elapsed[jobs[j]] {
+			return elapsed[jobs[i]] > elapsed[jobs[j]]
+		}
+		return jobs[i] < jobs[j]
+	})
+	if len(jobs) > max {
+		jobs = jobs[:max]
+	}
+	return jobs, elapsed
+}
+
+// Execute the sstat command and return the usage of all the running
+// steps of the given jobs, sstat fails when the jobs ended since squeue
+func SstatData(jobs []string) ([]byte, error) {
+	return ExecuteError("sstat", []string{"-a", "-n", "-p", "-o", "JobID,MaxRSS,AveCPU", "-j", strings.Join(jobs, ",")})
+}
+
+type JobUsage struct {
+	maxrss float64 // bytes
+	avecpu float64 // seconds
+}
+
+// ParseSstat takes the pipe-delimited output of sstat and returns the
+// highest MaxRSS and AveCPU over the steps of every job
+func ParseSstat(input []byte) map[string]*JobUsage {
+	jobs := make(map[string]*JobUsage)
+	for _, line := range strings.Split(string(input), "\n") {
+		// JobID|MaxRSS|AveCPU|, e.g. 1234.batch|2048564K|01:02:03|, or
+		// 1234.batch|2097729536|01:02:03| with the raw bytes of --noconvert
+		fields := strings.Split(line, "|")
+		if len(fields) < 3 || fields[0] == "" {
+			continue
+		}
+		job := strings.Split(fields[0], ".")[0]
+		if jobs[job] == nil {
+			jobs[job] = &JobUsage{}
+		}
+		if maxrss, ok := ParseGresCount(fields[1]); ok && maxrss > jobs[job].maxrss {
+			jobs[job].maxrss = maxrss
+		}
+		// AveCPU has milliseconds below a minute, e.g. 00:12.345
+		if avecpu, ok := ParseSlurmDuration(strings.Split(fields[2], ".")[0]); ok && avecpu.Seconds() > jobs[job].avecpu {
+			jobs[job].avecpu = avecpu.Seconds()
+		}
+	}
+	return jobs
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * Slurm live job usage into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+func NewSstatCollector() *SstatCollector {
+	labels := []string{"job"}
+	return &SstatCollector{
+		maxrss:        NewDesc("slurm_job_maxrss_bytes", "Highest resident memory of the steps of the running job", labels, nil),
+		cpuEfficiency: NewDesc("slurm_job_cpu_efficiency", "Average CPU time of the tasks of the running job over its elapsed time", labels, nil),
+		maxJobs:       *sstatMaxJobs,
+	}
+}
+
+type SstatCollector struct {
+	maxrss        *prometheus.Desc
+	cpuEfficiency *prometheus.Desc
+	maxJobs       int
+}
+
+func (sc *SstatCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sc.maxrss
+	ch <- sc.cpuEfficiency
+}
+
+func (sc *SstatCollector) Collect(ch chan<- prometheus.Metric) {
+	jobs, elapsed := ParseSstatJobs(SstatJobsData(), sc.maxJobs)
+	if len(jobs) == 0 {
+		return
+	}
+	sstat, err := SstatData(jobs)
+	if err != nil {
+		// The sample is skipped rather than failing the scrape
+		log.Warnf("Skipped the sstat sample: %v", err)
+		return
+	}
+	for job, usage := range ParseSstat(sstat) {
+		ch <- prometheus.MustNewConstMetric(sc.maxrss, prometheus.GaugeValue, usage.maxrss, job)
+		if elapsed[job] > 0 {
+			ch <- prometheus.MustNewConstMetric(sc.cpuEfficiency, prometheus.GaugeValue, usage.avecpu/elapsed[job], job)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+/* Copyright 2017 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSstatJobs(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/squeue_elapsed.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	// The longest running jobs are sampled first
+	jobs, elapsed := ParseSstatJobs(data, 3)
+	assert.Equal(t, []string{"1003", "1001", "1005"}, jobs)
+	assert.Equal(t, float64(3600), elapsed["1001"])
+	assert.Equal(t, float64(300), elapsed["1002"])
+}
+
+func TestSstat(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sstat.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	jobs := ParseSstat(data)
+
+	assert.Equal(t, 3, len(jobs))
+	// The highest of the steps, with a byte suffix
+	assert.Equal(t, float64(3<<30), jobs["1001"].maxrss)
+	assert.Equal(t, float64(3570), jobs["1001"].avecpu)
+	assert.Equal(t, float64(512<<20), jobs["1002"].maxrss)
+	assert.Equal(t, float64(12), jobs["1002"].avecpu)
+	assert.Equal(t, &JobUsage{}, jobs["1003"])
+}
+
+func TestSstatNoConvert(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/sstat_noconvert.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	converted, err := ioutil.ReadFile("test_data/sstat.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	jobs := ParseSstat(data)
+
+	// The raw bytes of the same steps
+	assert.Equal(t, float64(3<<30), jobs["1001"].maxrss)
+	assert.Equal(t, float64(512<<20), jobs["1002"].maxrss)
+	assert.Equal(t, ParseSstat(converted), jobs)
+}
+
+func TestSstatCollector(t *testing.T) {
+	defer fakeSlurm(t, map[string][]fakeOutput{
+		"squeue": {{"*", "test_data/squeue_elapsed.txt"}},
+		"sstat":  {{"*", "test_data/sstat.txt"}},
+	})()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewSstatCollector())
+	metrics := collectMetrics(t, registry)
+	assert.Equal(t, float64(3<<30), metrics[`slurm_job_maxrss_bytes{job="1001"}`])
+}
+
+func TestSstatCollectorFailure(t *testing.T) {
+	// sstat fails, e.g. the sampled jobs ended since squeue
+	defer fakeSlurm(t, map[string][]fakeOutput{
+		"squeue": {{"*", "test_data/squeue_elapsed.txt"}},
+	})()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewSstatCollector())
+	// The sample is skipped, the scrape goes on
+	for name := range collectMetrics(t, registry) {
+		assert.False(t, strings.HasPrefix(name, "slurm_job_"), name)
+	}
+}
@@ -0,0 +1,137 @@
+/* Copyright 2017 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Binary multipliers of the unit suffixes of Slurm counts, e.g. 500G
+var gresUnits = map[byte]float64{
+	'K': 1 << 10,
+	'M': 1 << 20,
+	'G': 1 << 30,
+	'T': 1 << 40,
+	'P': 1 << 50,
+}
+
+// ParseGresCount parses a gres or TRES count, either a plain number or a
+// number followed by a unit suffix, e.g. "107374182400" or "100G"
+func ParseGresCount(value string) (float64, bool) {
+	value = strings.TrimSpace(value)
+	multiplier := float64(1)
+	if len(value) > 0 {
+		if unit, ok := gresUnits[value[len(value)-1]]; ok {
+			multiplier = unit
+			value = value[:len(value)-1]
+		}
+	}
+	count, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, false
+	}
+	return count * multiplier, true
+}
+
+type TmpDiskMetrics struct {
+	alloc float64
+	total float64
+}
+
+// ParseTmpDiskMetrics returns the local scratch of the nodes managed as a
+// tmpdisk gres, in bytes. The total comes from the CfgTRES= of the node,
+// or its Gres= when the gres is not a TRES, the allocated scratch from
+// its AllocTRES=.
+func ParseTmpDiskMetrics(input []byte, pe *ParseErrors) map[string]*TmpDiskMetrics {
+	nodes := make(map[string]*TmpDiskMetrics)
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := ParseScontrolFields(line)
+		node, ok := fields["NodeName"]
+		if !ok {
+			continue
+		}
+		total, found := tmpDiskTRES(fields["CfgTRES"], pe)
+		if !found {
+			for _, resource := range SplitGres(fields["Gres"]) {
+				// tmpdisk:<count>, with an optional flag like no_consume
+				values := strings.Split(strings.Split(resource, "(")[0], ":")
+				if values[0] != "tmpdisk" || len(values) < 2 {
+					continue
+				}
+				if count, ok := ParseGresCount(values[len(values)-1]); ok {
+					total += count
+					found = true
+				}
+			}
+		}
+		if !found {
+			continue
+		}
+		alloc, _ := tmpDiskTRES(fields["AllocTRES"], pe)
+		nodes[node] = &TmpDiskMetrics{alloc, total}
+	}
+	return nodes
+}
+
+// tmpDiskTRES returns the gres/tmpdisk count of a TRES list
+func tmpDiskTRES(tres string, pe *ParseErrors) (float64, bool) {
+	count, ok := ParseTRES(tres, pe)["gres/tmpdisk"]
+	return count, ok
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * Slurm tmpdisk gres metrics into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+func NewTmpDiskCollector() *TmpDiskCollector {
+	labels := []string{"node"}
+	return &TmpDiskCollector{
+		parseErrors: &ParseErrors{},
+		alloc:       NewDesc("slurm_tmpdisk_alloc_bytes", "Local scratch allocated to jobs per node (gres/tmpdisk)", labels, nil),
+		total:       NewDesc("slurm_tmpdisk_total_bytes", "Local scratch configured per node (gres/tmpdisk)", labels, nil),
+	}
+}
+
+type TmpDiskCollector struct {
+	alloc       *prometheus.Desc
+	total       *prometheus.Desc
+	parseErrors *ParseErrors
+}
+
+func (tc *TmpDiskCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tc.alloc
+	ch <- tc.total
+}
+
+func (tc *TmpDiskCollector) Collect(ch chan<- prometheus.Metric) {
+	scontrol, err := ScontrolNodesData()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(tc.alloc, err)
+		return
+	}
+	for node, tm := range ParseTmpDiskMetrics(scontrol, tc.parseErrors) {
+		ch <- prometheus.MustNewConstMetric(tc.alloc, prometheus.GaugeValue, tm.alloc, node)
+		ch <- prometheus.MustNewConstMetric(tc.total, prometheus.GaugeValue, tm.total, node)
+	}
+	if err := tc.parseErrors.Take(); err != nil {
+		ch <- prometheus.NewInvalidMetric(tc.alloc, err)
+	}
+}
@@ -0,0 +1,55 @@
+/* Copyright 2017 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseGresCount(t *testing.T) {
+	counts := map[string]float64{
+		"107374182400": 107374182400,
+		"100G":         100 << 30,
+		"512M":         512 << 20,
+		"1T":           1 << 40,
+		"3":            3,
+	}
+	for value, expected := range counts {
+		count, ok := ParseGresCount(value)
+		assert.True(t, ok, value)
+		assert.Equal(t, expected, count, value)
+	}
+	_, ok := ParseGresCount("N/A")
+	assert.False(t, ok)
+}
+
+func TestTmpDiskMetrics(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/scontrol_nodes_tmpdisk.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	nodes := ParseTmpDiskMetrics(data, nil)
+
+	// a048 has no tmpdisk gres
+	assert.Equal(t, 3, len(nodes))
+	assert.Equal(t, &TmpDiskMetrics{100 << 30, 800 << 30}, nodes["c01"])
+	// Without the gres in the TRES the total comes from Gres=
+	assert.Equal(t, &TmpDiskMetrics{0, 1 << 40}, nodes["c02"])
+	assert.Equal(t, &TmpDiskMetrics{512 << 20, 2048 << 20}, nodes["gpu01"])
+}
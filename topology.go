@@ -0,0 +1,106 @@
+/* Copyright 2017 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A switch of the network tree of the topology/tree plugin
+type Switch struct {
+	name     string
+	level    float64
+	nodes    []string
+	switches []string
+}
+
+// Execute scontrol to get the switches of the network topology, one per line
+func TopologyData() []byte {
+	return Execute("scontrol", []string{"show", "topology"})
+}
+
+// ParseTopology takes the output of scontrol show topology, e.g.
+// SwitchName=s1 Level=1 LinkSpeed=1 Switches=s[2-3] Nodes=gpu[01-04].
+// The nodes of a switch are the nodes below it, through its child
+// switches too. Without the topology/tree plugin there is no SwitchName=
+// and no switch.
+func ParseTopology(input []byte, pe *ParseErrors) []Switch {
+	switches := []Switch{}
+	for _, line := range strings.Split(string(input), "\n") {
+		fields := ParseScontrolFields(line)
+		name, ok := fields["SwitchName"]
+		if !ok {
+			continue
+		}
+		level, err := strconv.ParseFloat(fields["Level"], 64)
+		if err != nil {
+			pe.Report("switch %q, level %q", name, fields["Level"])
+			continue
+		}
+		s := Switch{name: name, level: level, nodes: []string{}, switches: []string{}}
+		if fields["Nodes"] != "" && fields["Nodes"] != "(null)" {
+			s.nodes = ExpandNodeList(fields["Nodes"])
+		}
+		if fields["Switches"] != "" && fields["Switches"] != "(null)" {
+			s.switches = ExpandNodeList(fields["Switches"])
+		}
+		switches = append(switches, s)
+	}
+	return switches
+}
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * Slurm network topology metrics into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+func NewTopologyCollector() *TopologyCollector {
+	labels := []string{"switch"}
+	return &TopologyCollector{
+		parseErrors: &ParseErrors{},
+		nodes:       NewDesc("slurm_topology_switch_nodes", "Nodes below the switch of the network tree", labels, nil),
+		level:       NewDesc("slurm_topology_switch_level", "Level of the switch in the network tree, 0 for the switches linking nodes", labels, nil),
+		switches:    NewDesc("slurm_topology_switch_children", "Switches linked below the switch of the network tree", labels, nil),
+	}
+}
+
+type TopologyCollector struct {
+	nodes       *prometheus.Desc
+	level       *prometheus.Desc
+	switches    *prometheus.Desc
+	parseErrors *ParseErrors
+}
+
+func (tc *TopologyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tc.nodes
+	ch <- tc.level
+	ch <- tc.switches
+}
+
+func (tc *TopologyCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range ParseTopology(TopologyData(), tc.parseErrors) {
+		ch <- prometheus.MustNewConstMetric(tc.nodes, prometheus.GaugeValue, float64(len(s.nodes)), s.name)
+		ch <- prometheus.MustNewConstMetric(tc.level, prometheus.GaugeValue, s.level, s.name)
+		ch <- prometheus.MustNewConstMetric(tc.switches, prometheus.GaugeValue, float64(len(s.switches)), s.name)
+	}
+	if err := tc.parseErrors.Take(); err != nil {
+		ch <- prometheus.NewInvalidMetric(tc.nodes, err)
+	}
+}
@@ -0,0 +1,82 @@
+/* Copyright 2017 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTopology(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/scontrol_topology.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	switches := ParseTopology(data, nil)
+	assert.Equal(t, 3, len(switches))
+	assert.Equal(t, Switch{"s1", 0, []string{"gpu01", "gpu02"}, []string{}}, switches[0])
+	assert.Equal(t, []string{"s1", "s2"}, switches[2].switches)
+
+	// topology/none
+	assert.Equal(t, 0, len(ParseTopology([]byte(""), nil)))
+}
+
+func TestTopologyCollector(t *testing.T) {
+	defer fakeSlurm(t, map[string][]fakeOutput{
+		"scontrol": {{"*", "test_data/scontrol_topology.txt"}},
+	})()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewTopologyCollector())
+	metrics := collectMetrics(t, registry)
+
+	assert.Equal(t, float64(2), metrics[`slurm_topology_switch_nodes{switch="s1"}`])
+	assert.Equal(t, float64(3), metrics[`slurm_topology_switch_nodes{switch="s2"}`])
+	assert.Equal(t, float64(5), metrics[`slurm_topology_switch_nodes{switch="top"}`])
+	assert.Equal(t, float64(1), metrics[`slurm_topology_switch_level{switch="top"}`])
+	assert.Equal(t, float64(2), metrics[`slurm_topology_switch_children{switch="top"}`])
+	assert.Equal(t, float64(0), metrics[`slurm_topology_switch_children{switch="s2"}`])
+}
+
+func TestTopologyCollectorStrict(t *testing.T) {
+	defer func(strict bool) { *parseStrict = strict }(*parseStrict)
+	defer fakeSlurm(t, map[string][]fakeOutput{
+		"sinfo": {{"*", "test_data/sinfo_gpus.txt"}},
+		"scontrol": {
+			{"*topology*", "test_data/scontrol_topology_malformed.txt"},
+			{"*", "test_data/scontrol_nodes.txt"},
+		},
+		"squeue": {
+			{"*state:.*", "test_data/squeue_tres_states.txt"},
+		},
+	})()
+	*parseStrict = true
+
+	topology := prometheus.NewRegistry()
+	topology.MustRegister(NewTopologyCollector())
+	_, err := topology.Gather()
+	assert.Error(t, err)
+
+	// The malformed switch fails the topology scrape only, it is not
+	// counted as a GPU parse error
+	gpus := prometheus.NewRegistry()
+	gpus.MustRegister(NewGPUsCollector())
+	metrics := collectMetrics(t, gpus)
+	assert.Equal(t, float64(0), metrics["slurm_gpus_parse_errors_total"])
+}
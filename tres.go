@@ -0,0 +1,69 @@
+/* Copyright 2017 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/*
+ * Implement the Prometheus Collector interface and feed the
+ * allocated TRES metrics into it.
+ * https://godoc.org/github.com/prometheus/client_golang/prometheus#Collector
+ */
+
+// NewTRESCollector builds the collector of every TRES allocated to the
+// running jobs, the TRES matching the anchored include expression only
+// (all of them if empty). The expression is checked by ValidateFlags.
+func NewTRESCollector(include string) *TRESCollector {
+	tc := &TRESCollector{
+		parseErrors: &ParseErrors{},
+		alloc:       NewDesc("slurm_tres_alloc", "TRES allocated to the running jobs, the memory in bytes", []string{"tres"}, nil),
+	}
+	if include != "" {
+		tc.include = regexp.MustCompile("^(?:" + include + ")$")
+	}
+	return tc
+}
+
+type TRESCollector struct {
+	alloc       *prometheus.Desc
+	include     *regexp.Regexp
+	parseErrors *ParseErrors
+}
+
+func (tc *TRESCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tc.alloc
+}
+
+func (tc *TRESCollector) Collect(ch chan<- prometheus.Metric) {
+	// The squeue of the GPU collector, shared when both run in the scrape
+	jobs, err := TRESAllocData(JobStates(*gpuAllocStates))
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(tc.alloc, err)
+		return
+	}
+	for tres, count := range ParseTRESAlloc(SelectTRES(jobs, []string{"RUNNING"}), tc.parseErrors) {
+		if tc.include == nil || tc.include.MatchString(tres) {
+			ch <- prometheus.MustNewConstMetric(tc.alloc, prometheus.GaugeValue, count, tres)
+		}
+	}
+	if err := tc.parseErrors.Take(); err != nil {
+		ch <- prometheus.NewInvalidMetric(tc.alloc, err)
+	}
+}
@@ -0,0 +1,49 @@
+/* Copyright 2017 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTRESCollector(t *testing.T) {
+	defer fakeSlurm(t, map[string][]fakeOutput{
+		"squeue": {{"*", "test_data/squeue_tres_states.txt"}},
+	})()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewTRESCollector(""))
+	metrics := collectMetrics(t, registry)
+
+	// Every TRES of the running jobs gets its series
+	assert.Equal(t, 8, len(metrics))
+	assert.Equal(t, float64(86), metrics[`slurm_tres_alloc{tres="cpu"}`])
+	assert.Equal(t, float64(380<<30), metrics[`slurm_tres_alloc{tres="mem"}`])
+	assert.Equal(t, float64(6), metrics[`slurm_tres_alloc{tres="node"}`])
+	assert.Equal(t, float64(6), metrics[`slurm_tres_alloc{tres="gres/gpu:a100"}`])
+	assert.Equal(t, float64(1), metrics[`slurm_tres_alloc{tres="gres/gpu:quadro"}`])
+	assert.Equal(t, float64(8), metrics[`slurm_tres_alloc{tres="gres/gpu"}`])
+
+	registry = prometheus.NewRegistry()
+	registry.MustRegister(NewTRESCollector("cpu|gres/gpu:.*"))
+	metrics = collectMetrics(t, registry)
+	assert.Equal(t, 4, len(metrics))
+	assert.Contains(t, metrics, `slurm_tres_alloc{tres="gres/gpu:v100"}`)
+	assert.NotContains(t, metrics, `slurm_tres_alloc{tres="gres/gpu"}`)
+}
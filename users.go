@@ -16,30 +16,17 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>. */
 package main
 
 import (
-	"io/ioutil"
-	"log"
-	"os/exec"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 func UsersData() []byte {
-	cmd := exec.Command("squeue", "-a", "-r", "-h", "-o %A|%u|%T|%C")
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
-	}
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
-	}
-	out, _ := ioutil.ReadAll(stdout)
-	if err := cmd.Wait(); err != nil {
-		log.Fatal(err)
-	}
-	return out
+	return Execute("squeue", []string{"-a", "-r", "-h", "-o %A|%u|%T|%C"})
 }
 
 type UserJobMetrics struct {
@@ -79,20 +66,70 @@ func ParseUsersMetrics(input []byte) map[string]*UserJobMetrics {
 	return users
 }
 
+// Execute the squeue command and return the user and the submit time of
+// the pending jobs, one line per array task like UsersData
+func PendingUsersData() []byte {
+	return Execute("squeue", []string{"-a", "-r", "--state=PENDING", "-h", "-o", "%u %V"})
+}
+
+type UserPending struct {
+	user       string
+	maxPending float64 // seconds
+}
+
+// ParsePendingUsers takes the "user submit" lines of squeue and returns
+// how long the oldest pending job of every user has been waiting at now,
+// sorted by decreasing wait (then by name for the ties)
+func ParsePendingUsers(input []byte, now time.Time) []UserPending {
+	users := make(map[string]*UserPending)
+	for _, line := range strings.Split(string(input), "\n") {
+		// e.g. user1 2020-03-01T10:00:00
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		submit, err := time.ParseInLocation("2006-01-02T15:04:05", fields[1], time.Local)
+		if err != nil {
+			continue
+		}
+		if users[fields[0]] == nil {
+			users[fields[0]] = &UserPending{user: fields[0]}
+		}
+		if wait := now.Sub(submit).Seconds(); wait > users[fields[0]].maxPending {
+			users[fields[0]].maxPending = wait
+		}
+	}
+	ranking := make([]UserPending, 0, len(users))
+	for _, user := range users {
+		ranking = append(ranking, *user)
+	}
+	sort.Slice(ranking, func(i, j int) bool {
+		if ranking[i].maxPending != ranking[j].maxPending {
+			return ranking[i].maxPending > ranking[j].maxPending
+		}
+		return ranking[i].user < ranking[j].user
+	})
+	return ranking
+}
+
 type UsersCollector struct {
 	pending      *prometheus.Desc
 	running      *prometheus.Desc
 	running_cpus *prometheus.Desc
 	suspended    *prometheus.Desc
+	maxPending   *prometheus.Desc
+	pendingTop   int
 }
 
 func NewUsersCollector() *UsersCollector {
 	labels := []string{"user"}
 	return &UsersCollector{
-		pending:      prometheus.NewDesc("slurm_user_jobs_pending", "Pending jobs for user", labels, nil),
-		running:      prometheus.NewDesc("slurm_user_jobs_running", "Running jobs for user", labels, nil),
-		running_cpus: prometheus.NewDesc("slurm_user_cpus_running", "Running cpus for user", labels, nil),
-		suspended:    prometheus.NewDesc("slurm_user_jobs_suspended", "Suspended jobs for user", labels, nil),
+		pending:      NewDesc("slurm_user_jobs_pending", "Pending jobs for user", labels, nil),
+		running:      NewDesc("slurm_user_jobs_running", "Running jobs for user", labels, nil),
+		running_cpus: NewDesc("slurm_user_cpus_running", "Running cpus for user", labels, nil),
+		suspended:    NewDesc("slurm_user_jobs_suspended", "Suspended jobs for user", labels, nil),
+		maxPending:   NewDesc("slurm_user_max_pending_seconds", "Time the oldest pending job of the user has been waiting", labels, nil),
+		pendingTop:   *usersPendingTop,
 	}
 }
 
@@ -101,10 +138,19 @@ func (uc *UsersCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- uc.running
 	ch <- uc.running_cpus
 	ch <- uc.suspended
+	ch <- uc.maxPending
 }
 
 func (uc *UsersCollector) Collect(ch chan<- prometheus.Metric) {
 	um := ParseUsersMetrics(UsersData())
+	pending := ParsePendingUsers(PendingUsersData(), time.Now())
+	// Only the users waiting the longest get the pending wait
+	if uc.pendingTop > 0 && len(pending) > uc.pendingTop {
+		pending = pending[:uc.pendingTop]
+	}
+	for _, p := range pending {
+		ch <- prometheus.MustNewConstMetric(uc.maxPending, prometheus.GaugeValue, p.maxPending, p.user)
+	}
 	for u := range um {
 		if um[u].pending > 0 {
 			ch <- prometheus.MustNewConstMetric(uc.pending, prometheus.GaugeValue, um[u].pending, u)
@@ -0,0 +1,66 @@
+/* Copyright 2017 Victor Penso, Matteo Dessalvi
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>. */
+
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePendingUsers(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/squeue_pending_users.txt")
+	if err != nil {
+		t.Fatalf("Can not open test data: %v", err)
+	}
+	now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.Local)
+	users := ParsePendingUsers(data, now)
+
+	// The users waiting the longest first, the jobs without a submit
+	// time are left out
+	assert.Equal(t, []UserPending{
+		{"user1", 7200},
+		{"user2", 1800},
+		{"user3", 1800},
+	}, users)
+}
+
+func TestUsersCollectorPendingTop(t *testing.T) {
+	defer fakeSlurm(t, map[string][]fakeOutput{
+		"squeue": {
+			{"*%V*", "test_data/squeue_pending_users.txt"},
+			{"*", "test_data/squeue_users.txt"},
+		},
+	})()
+
+	collector := NewUsersCollector()
+	collector.pendingTop = 1
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	metrics := collectMetrics(t, registry)
+
+	assert.True(t, metrics[`slurm_user_max_pending_seconds{user="user1"}`] > 0)
+	_, ok := metrics[`slurm_user_max_pending_seconds{user="user2"}`]
+	assert.False(t, ok)
+	// The pending jobs are still counted for every user, the jobs without
+	// a submit time included
+	assert.Equal(t, float64(3), metrics[`slurm_user_jobs_pending{user="user1"}`])
+	assert.Equal(t, float64(2), metrics[`slurm_user_jobs_pending{user="user2"}`])
+	assert.Equal(t, float64(1), metrics[`slurm_user_jobs_pending{user="user3"}`])
+}